@@ -36,10 +36,25 @@ func (e *HTTPStatusError) Error() string {
 }
 
 func (c *BaseClient) DoRequest(ctx context.Context, r Request, output interface{}) error {
-	req, err := c.newRequest(ctx, r)
+	body, err := c.DoStreamRequest(ctx, r)
 	if err != nil {
 		return err
 	}
+	defer body.Close()
+
+	if output == nil {
+		return nil
+	}
+	return json.NewDecoder(body).Decode(output)
+}
+
+// DoStreamRequest sends the request and returns the body of the response, to
+// be closed by the caller
+func (c *BaseClient) DoStreamRequest(ctx context.Context, r Request) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, r)
+	if err != nil {
+		return nil, err
+	}
 
 	client := http.DefaultClient
 	if c.Client != nil {
@@ -47,21 +62,18 @@ func (c *BaseClient) DoRequest(ctx context.Context, r Request, output interface{
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if (r.Method == "GET" && resp.StatusCode != http.StatusOK) || (resp.StatusCode >= 300) {
+		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return &HTTPStatusError{resp.StatusCode, string(body)}
-	}
-	if output == nil {
-		return nil
+		return nil, &HTTPStatusError{resp.StatusCode, string(body)}
 	}
-	return json.NewDecoder(resp.Body).Decode(output)
+	return resp.Body, nil
 }
 
 func (c *BaseClient) newRequest(ctx context.Context, r Request) (*http.Request, error) {
@@ -67,7 +67,8 @@ type pinataClient struct {
 	filesMetadata []byte
 }
 
-type uploadResponse struct {
+// PinataUploadResponse is the metadata returned by PinContent of the Pinata client
+type PinataUploadResponse struct {
 	IPFSHash    string    `json:"ipfsHash"`
 	PinSize     int64     `json:"pinSize"`
 	Timestamp   time.Time `json:"timestamp"`
@@ -85,7 +86,7 @@ func (p *pinataClient) PinContent(ctx context.Context, filename, fileContentType
 	body, contentType := multipartBody(parts)
 	defer body.Close()
 
-	var res *uploadResponse
+	var res *PinataUploadResponse
 	err := p.DoRequest(ctx, Request{
 		Method:      "POST",
 		URL:         "/pinning/pinFileToIPFS",
@@ -0,0 +1,204 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const kuboAddOptions = "cid-version=1&raw-leaves=true&pin=true"
+
+var _ IPFS = (*KuboClient)(nil)
+
+// KuboClient is a client of the HTTP RPC API of a Kubo (go-ipfs) node, e.g.
+// http://localhost:5001
+type KuboClient struct {
+	BaseClient
+}
+
+func NewKuboClient(baseUrl string, headers map[string]string) *KuboClient {
+	return &KuboClient{
+		BaseClient: BaseClient{
+			BaseUrl:     strings.TrimSuffix(baseUrl, "/") + "/api/v0",
+			BaseHeaders: headers,
+		},
+	}
+}
+
+// KuboAddResponse is the metadata returned by PinContent of the Kubo client
+type KuboAddResponse struct {
+	Name string `json:"Name"`
+	Hash string `json:"Hash"`
+	// Size is the size of the DAG, with the UnixFS overhead
+	Size int64 `json:"Size,string"`
+}
+
+// KuboFileStat is the description of a file or directory of the node
+type KuboFileStat struct {
+	Hash           string `json:"Hash"`
+	Size           int64  `json:"Size"`
+	CumulativeSize int64  `json:"CumulativeSize"`
+	// Type is "file" or "directory"
+	Type string `json:"Type"`
+}
+
+// KuboFileEntry is an entry of an MFS directory
+type KuboFileEntry struct {
+	Name string `json:"Name"`
+	// Type is 0 for files and 1 for directories
+	Type int    `json:"Type"`
+	Size int64  `json:"Size"`
+	Hash string `json:"Hash"`
+}
+
+// PinContent adds the data as a CIDv1 with raw leaves, and pins it with the
+// file name as pin name
+func (k *KuboClient) PinContent(ctx context.Context, filename, fileContentType string, data io.Reader) (string, interface{}, error) {
+	body, contentType := multipartBody([]part{{"file", filename, fileContentType, data}})
+	defer body.Close()
+
+	var res *KuboAddResponse
+	err := k.DoRequest(ctx, Request{
+		Method:      "POST",
+		URL:         "/add?" + kuboAddOptions + "&pin-name=" + url.QueryEscape(filename),
+		Body:        body,
+		ContentType: contentType,
+	}, &res)
+	if err != nil {
+		return "", nil, err
+	}
+	return res.Hash, res, nil
+}
+
+// Pin pins the DAG of the CID recursively
+func (k *KuboClient) Pin(ctx context.Context, cid string) error {
+	return k.rpc(ctx, "/pin/add", url.Values{"arg": {cid}}, nil)
+}
+
+// Unpin removes the recursive pin of the CID. Content that isn't pinned is
+// ignored, so that unpinning is idempotent.
+func (k *KuboClient) Unpin(ctx context.Context, cid string) error {
+	err := k.rpc(ctx, "/pin/rm", url.Values{"arg": {cid}}, nil)
+	if isKuboError(err, "not pinned") {
+		return nil
+	}
+	return err
+}
+
+// List returns the recursive pins of the node, ordered by CID, or the one of
+// cid when set. The sizes aren't returned by Kubo and are left to 0.
+func (k *KuboClient) List(ctx context.Context, pageSize, pageOffset int, cid string) (*PinList, int, error) {
+	params := url.Values{"type": {"recursive"}, "names": {"true"}}
+	if cid != "" {
+		params.Set("arg", cid)
+	}
+	var res struct {
+		Keys map[string]struct {
+			Name string `json:"Name"`
+		} `json:"Keys"`
+	}
+	err := k.rpc(ctx, "/pin/ls", params, &res)
+	if isKuboError(err, "not pinned") {
+		return &PinList{Pins: []PinInfo{}}, -1, nil
+	} else if err != nil {
+		return nil, -1, err
+	}
+
+	cids := make([]string, 0, len(res.Keys))
+	for key := range res.Keys {
+		cids = append(cids, key)
+	}
+	sort.Strings(cids)
+	pl := &PinList{Count: int64(len(cids)), Pins: []PinInfo{}}
+	if pageOffset < len(cids) {
+		cids = cids[pageOffset:]
+	} else {
+		cids = nil
+	}
+	next := -1
+	if pageSize > 0 && len(cids) > pageSize {
+		cids = cids[:pageSize]
+		next = pageOffset + pageSize
+	}
+	for _, key := range cids {
+		pin := PinInfo{ID: key, IPFSPinHash: key}
+		pin.Metadata.Name = res.Keys[key].Name
+		pl.Pins = append(pl.Pins, pin)
+	}
+	return pl, next, nil
+}
+
+// Cat returns the content of the IPFS path from offset, limited to length
+// bytes unless it's negative
+func (k *KuboClient) Cat(ctx context.Context, ipfsPath string, offset, length int64) (io.ReadCloser, error) {
+	params := url.Values{"arg": {ipfsPath}}
+	if offset > 0 {
+		params.Set("offset", strconv.FormatInt(offset, 10))
+	}
+	if length >= 0 {
+		params.Set("length", strconv.FormatInt(length, 10))
+	}
+	return k.DoStreamRequest(ctx, Request{
+		Method: "POST",
+		URL:    "/cat?" + params.Encode(),
+	})
+}
+
+// FilesStat describes the file or directory of the MFS or IPFS path
+func (k *KuboClient) FilesStat(ctx context.Context, filePath string) (*KuboFileStat, error) {
+	var res *KuboFileStat
+	if err := k.rpc(ctx, "/files/stat", url.Values{"arg": {filePath}}, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// FilesCp copies the IPFS path to the MFS path, creating its parent directories
+func (k *KuboClient) FilesCp(ctx context.Context, src, dst string) error {
+	return k.rpc(ctx, "/files/cp", url.Values{"arg": {src, dst}, "parents": {"true"}}, nil)
+}
+
+// FilesRm removes the file or directory of the MFS path
+func (k *KuboClient) FilesRm(ctx context.Context, filePath string) error {
+	return k.rpc(ctx, "/files/rm", url.Values{"arg": {filePath}, "force": {"true"}}, nil)
+}
+
+// FilesLs lists the entries of the MFS directory
+func (k *KuboClient) FilesLs(ctx context.Context, dirPath string) ([]KuboFileEntry, error) {
+	var res struct {
+		Entries []KuboFileEntry `json:"Entries"`
+	}
+	params := url.Values{"arg": {dirPath}, "long": {"true"}, "U": {"true"}}
+	if err := k.rpc(ctx, "/files/ls", params, &res); err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// SwarmConnect connects the node to the peers of the multiaddrs
+func (k *KuboClient) SwarmConnect(ctx context.Context, addrs []string) error {
+	return k.rpc(ctx, "/swarm/connect", url.Values{"arg": addrs}, nil)
+}
+
+// IsKuboNotFound returns whether the error is the one of a missing MFS file
+func IsKuboNotFound(err error) bool {
+	return isKuboError(err, "does not exist")
+}
+
+// rpc calls the command, all of them being POST requests
+func (k *KuboClient) rpc(ctx context.Context, command string, params url.Values, output interface{}) error {
+	return k.DoRequest(ctx, Request{
+		Method: "POST",
+		URL:    command + "?" + params.Encode(),
+	}, output)
+}
+
+// isKuboError returns whether the error returned by the node contains msg
+func isKuboError(err error, msg string) bool {
+	var httpErr *HTTPStatusError
+	return errors.As(err, &httpErr) && strings.Contains(httpErr.Body, msg)
+}
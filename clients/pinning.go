@@ -0,0 +1,279 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of the pins of the IPFS Pinning Service API
+const (
+	PinStatusQueued  = "queued"
+	PinStatusPinning = "pinning"
+	PinStatusPinned  = "pinned"
+	PinStatusFailed  = "failed"
+)
+
+const (
+	pinningDefaultPollInterval = 2 * time.Second
+	// pinningMaxLimit is the maximum number of pins listed by a request
+	pinningMaxLimit = 1000
+)
+
+var allPinStatuses = []string{PinStatusQueued, PinStatusPinning, PinStatusPinned, PinStatusFailed}
+
+var _ IPFS = (*PinningServiceClient)(nil)
+
+// Pin is the object pinned by the pinning service
+type Pin struct {
+	CID     string            `json:"cid"`
+	Name    string            `json:"name,omitempty"`
+	Origins []string          `json:"origins,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+// PinStatus is the status of a pin request
+type PinStatus struct {
+	RequestID string            `json:"requestid"`
+	Status    string            `json:"status"`
+	Created   time.Time         `json:"created"`
+	Pin       Pin               `json:"pin"`
+	Delegates []string          `json:"delegates"`
+	Info      map[string]string `json:"info,omitempty"`
+}
+
+// PinResults is a page of the pin requests
+type PinResults struct {
+	Count   int64       `json:"count"`
+	Results []PinStatus `json:"results"`
+}
+
+// PinQuery filters the listed pin requests. The service only lists the pinned
+// ones without Status.
+type PinQuery struct {
+	CID    []string
+	Name   string
+	Status []string
+	Before time.Time
+	Limit  int
+}
+
+// PinningServiceClient is a client of a service implementing the vendor-neutral
+// IPFS Pinning Service API, e.g. https://api.filebase.io/v1/ipfs or
+// https://api.pinata.cloud/psa. The service pins CIDs, so the content saved with
+// PinContent is added to an IPFS node first, the origin of the pin, which is
+// connected to the delegates of the service when it's a Kubo node. The content
+// stays pinned by the node until it's unpinned from the service.
+type PinningServiceClient struct {
+	BaseClient
+	node          IPFS
+	origins       []string
+	filesMetadata map[string]string
+	// PollInterval is the interval of the status requests while waiting for pins
+	PollInterval time.Duration
+}
+
+// NewPinningServiceClient creates a client of the service at endpoint, adding
+// the content to node, with the origins as the multiaddrs of the node
+func NewPinningServiceClient(endpoint, accessToken string, node IPFS, origins []string, filesMetadata map[string]string) *PinningServiceClient {
+	return &PinningServiceClient{
+		BaseClient: BaseClient{
+			BaseUrl: strings.TrimSuffix(endpoint, "/"),
+			BaseHeaders: map[string]string{
+				"Authorization": "Bearer " + accessToken,
+			},
+		},
+		node:          node,
+		origins:       origins,
+		filesMetadata: filesMetadata,
+		PollInterval:  pinningDefaultPollInterval,
+	}
+}
+
+// PinContent adds the data to the node, asks the service to pin its CID and
+// waits until it's pinned. The metadata is the *PinStatus of the pin.
+func (p *PinningServiceClient) PinContent(ctx context.Context, filename, fileContentType string, data io.Reader) (string, interface{}, error) {
+	if p.node == nil {
+		return "", nil, fmt.Errorf("no IPFS node to add the content pinned by the service")
+	}
+	cid, _, err := p.node.PinContent(ctx, filename, fileContentType, data)
+	if err != nil {
+		return "", nil, err
+	}
+	status, err := p.AddPin(ctx, Pin{CID: cid, Name: filename, Origins: p.origins, Meta: p.filesMetadata})
+	if err != nil {
+		return "", nil, err
+	}
+	if connector, ok := p.node.(interface {
+		SwarmConnect(ctx context.Context, addrs []string) error
+	}); ok && len(status.Delegates) > 0 {
+		// best effort, the service also finds the content through the origins
+		connector.SwarmConnect(ctx, status.Delegates)
+	}
+	status, err = p.WaitPinned(ctx, status.RequestID)
+	if err != nil {
+		return "", nil, err
+	}
+	return cid, status, nil
+}
+
+// Unpin removes all the pin requests of the CID, and the pin of the content
+// added to the node by PinContent
+func (p *PinningServiceClient) Unpin(ctx context.Context, cid string) error {
+	res, err := p.ListPins(ctx, PinQuery{CID: []string{cid}, Status: allPinStatuses, Limit: pinningMaxLimit})
+	if err != nil {
+		return err
+	}
+	for _, status := range res.Results {
+		if err := p.DeletePin(ctx, status.RequestID); err != nil {
+			return err
+		}
+	}
+	if p.node == nil {
+		return nil
+	}
+	return p.node.Unpin(ctx, cid)
+}
+
+// List returns the pinned objects, most recent first, or the ones of cid when
+// set. The service returns neither their IDs nor their sizes, so ID is the
+// request ID and Size is left to 0.
+func (p *PinningServiceClient) List(ctx context.Context, pageSize, pageOffset int, cid string) (*PinList, int, error) {
+	if pageSize <= 0 {
+		pageSize = pinningMaxLimit
+	}
+	query := PinQuery{Status: []string{PinStatusPinned}}
+	if cid != "" {
+		query.CID = []string{cid}
+	}
+	pl := &PinList{Pins: []PinInfo{}}
+	// the pages of the service are set with the creation time of the last pin
+	skip := pageOffset
+	for {
+		query.Limit = skip + pageSize - len(pl.Pins)
+		if query.Limit > pinningMaxLimit {
+			query.Limit = pinningMaxLimit
+		}
+		res, err := p.ListPins(ctx, query)
+		if err != nil {
+			return nil, -1, err
+		}
+		pl.Count = res.Count
+		for _, status := range res.Results {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			pin := PinInfo{ID: status.RequestID, IPFSPinHash: status.Pin.CID}
+			pin.Metadata.Name = status.Pin.Name
+			pin.Metadata.KeyValues = status.Pin.Meta
+			pl.Pins = append(pl.Pins, pin)
+		}
+		if len(pl.Pins) >= pageSize {
+			return pl, pageOffset + len(pl.Pins), nil
+		}
+		if len(res.Results) < query.Limit {
+			return pl, -1, nil
+		}
+		query.Before = res.Results[len(res.Results)-1].Created
+	}
+}
+
+// AddPin asks the service to pin the object
+func (p *PinningServiceClient) AddPin(ctx context.Context, pin Pin) (*PinStatus, error) {
+	body, err := json.Marshal(pin)
+	if err != nil {
+		return nil, err
+	}
+	var res *PinStatus
+	err = p.DoRequest(ctx, Request{
+		Method:      "POST",
+		URL:         "/pins",
+		Body:        bytes.NewReader(body),
+		ContentType: jsonMimeType,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetPin returns the status of the pin request
+func (p *PinningServiceClient) GetPin(ctx context.Context, requestID string) (*PinStatus, error) {
+	var res *PinStatus
+	err := p.DoRequest(ctx, Request{
+		Method: "GET",
+		URL:    "/pins/" + url.PathEscape(requestID),
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListPins returns the pin requests matching the query, most recent first
+func (p *PinningServiceClient) ListPins(ctx context.Context, query PinQuery) (*PinResults, error) {
+	params := url.Values{}
+	if len(query.CID) > 0 {
+		params.Set("cid", strings.Join(query.CID, ","))
+	}
+	if query.Name != "" {
+		params.Set("name", query.Name)
+	}
+	if len(query.Status) > 0 {
+		params.Set("status", strings.Join(query.Status, ","))
+	}
+	if !query.Before.IsZero() {
+		params.Set("before", query.Before.Format(time.RFC3339Nano))
+	}
+	if query.Limit > 0 {
+		params.Set("limit", strconv.Itoa(query.Limit))
+	}
+	var res *PinResults
+	err := p.DoRequest(ctx, Request{
+		Method: "GET",
+		URL:    "/pins?" + params.Encode(),
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeletePin removes the pin request
+func (p *PinningServiceClient) DeletePin(ctx context.Context, requestID string) error {
+	return p.DoRequest(ctx, Request{
+		Method: "DELETE",
+		URL:    "/pins/" + url.PathEscape(requestID),
+	}, nil)
+}
+
+// WaitPinned polls the status of the pin request until it's pinned, and
+// returns an error if it fails
+func (p *PinningServiceClient) WaitPinned(ctx context.Context, requestID string) (*PinStatus, error) {
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+	for {
+		status, err := p.GetPin(ctx, requestID)
+		if err != nil {
+			return nil, err
+		}
+		switch status.Status {
+		case PinStatusPinned:
+			return status, nil
+		case PinStatusFailed:
+			return nil, fmt.Errorf("pinning %s failed: %v", status.Pin.CID, status.Info)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	W3upServiceURL = "https://up.web3.storage"
+	W3upServiceDID = "did:web:web3.storage"
+)
+
+const (
+	ucanVersion = "0.9.1"
+	// ucanTTL is the expiration of the invocations
+	ucanTTL = 30 * time.Second
+
+	codecCar        = 0x0202
+	codecEd25519Pub = 0xed
+	codecDIDCore    = 0x0d1d
+	codecEdDSASig   = 0xd0ed
+)
+
+// W3upClient invokes the capabilities of a w3up (web3.storage) service on a
+// space, as the principal the space delegated them to with a UCAN proof. The
+// invocations are UCANs sent in CARs, with the proof, and the service replies
+// with the dag-cbor results of the invocations.
+type W3upClient struct {
+	BaseClient
+	serviceDID string
+	signer     ed25519.PrivateKey
+	did        string
+	space      string
+	// proof is the root of the delegation, and proofBlocks its DAG
+	proof       cid.Cid
+	proofBlocks map[cid.Cid][]byte
+}
+
+// NewW3upClient creates a client of the service for the principal, delegated
+// the capabilities of a space by the proof, a CAR of the delegation
+func NewW3upClient(serviceURL, serviceDID string, principalKey ed25519.PrivateKey, proof []byte) (*W3upClient, error) {
+	w := &W3upClient{
+		BaseClient:  BaseClient{BaseUrl: strings.TrimSuffix(serviceURL, "/")},
+		serviceDID:  serviceDID,
+		signer:      principalKey,
+		did:         DIDKey(principalKey.Public().(ed25519.PublicKey)),
+		proofBlocks: map[cid.Cid][]byte{},
+	}
+	// the CAR reader rejects the CARs without roots, as exported by ucanto
+	br := bufio.NewReader(bytes.NewReader(proof))
+	headerData, err := util.LdRead(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UCAN proof format: %w", err)
+	}
+	var header car.CarHeader
+	if err := cbornode.DecodeInto(headerData, &header); err != nil {
+		return nil, fmt.Errorf("invalid UCAN proof format: %w", err)
+	}
+	if len(header.Roots) > 1 {
+		return nil, fmt.Errorf("invalid UCAN proof format: %d roots", len(header.Roots))
+	}
+	for {
+		c, data, err := util.ReadNode(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid UCAN proof format: %w", err)
+		}
+		w.proofBlocks[c] = data
+		// without root, the delegation is the last block
+		w.proof = c
+	}
+	if len(header.Roots) == 1 {
+		w.proof = header.Roots[0]
+	}
+	delegation, err := ParseUCAN(w.proof, w.proofBlocks[w.proof])
+	if err != nil {
+		return nil, fmt.Errorf("invalid UCAN proof format: %w", err)
+	}
+	if delegation.Audience != w.did {
+		return nil, fmt.Errorf("UCAN proof delegated to %s, not to the principal %s", delegation.Audience, w.did)
+	}
+	if len(delegation.Capabilities) == 0 || !strings.HasPrefix(delegation.Capabilities[0].With, "did:") {
+		return nil, errors.New("UCAN proof doesn't delegate the capabilities of a space")
+	}
+	w.space = delegation.Capabilities[0].With
+	return w, nil
+}
+
+// ParseW3upPrincipalKey returns the ed25519 key derived from the base64 secret,
+// as W3_PRINCIPAL_KEY was used by livepeer-w3
+func ParseW3upPrincipalKey(secret string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+	if err != nil {
+		return nil, fmt.Errorf("invalid principal key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid principal key: %d bytes instead of %d", len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// DIDKey returns the did:key of the ed25519 public key
+func DIDKey(pub ed25519.PublicKey) string {
+	key, _ := multibase.Encode(multibase.Base58BTC, append(binary.AppendUvarint(nil, codecEd25519Pub), pub...))
+	return "did:key:" + key
+}
+
+// DID returns the DID of the principal
+func (w *W3upClient) DID() string {
+	return w.did
+}
+
+// Space returns the DID of the space of the proof
+func (w *W3upClient) Space() string {
+	return w.space
+}
+
+// StoreAdd stores the CAR in the space, and returns its CID
+func (w *W3upClient) StoreAdd(ctx context.Context, carData io.ReadSeeker) (cid.Cid, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, carData)
+	if err != nil {
+		return cid.Undef, err
+	}
+	mh, err := multihash.Encode(h.Sum(nil), multihash.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	link := cid.NewCidV1(codecCar, mh)
+
+	var res struct {
+		Status  string            `json:"status"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+	}
+	if err := w.invoke(ctx, "store/add", map[string]interface{}{"link": link, "size": size}, &res); err != nil {
+		return cid.Undef, err
+	}
+	if res.Status == "done" {
+		// already stored
+		return link, nil
+	}
+	if _, err := carData.Seek(0, io.SeekStart); err != nil {
+		return cid.Undef, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, res.URL, carData)
+	if err != nil {
+		return cid.Undef, err
+	}
+	req.ContentLength = size
+	for name, value := range res.Headers {
+		req.Header.Set(name, value)
+	}
+	client := http.DefaultClient
+	if w.Client != nil {
+		client = w.Client
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return cid.Undef, &HTTPStatusError{resp.StatusCode, string(body)}
+	}
+	return link, nil
+}
+
+// UploadAdd registers the upload of the DAG of root, stored in the shards CARs
+func (w *W3upClient) UploadAdd(ctx context.Context, root cid.Cid, shards []cid.Cid) error {
+	if shards == nil {
+		shards = []cid.Cid{}
+	}
+	return w.invoke(ctx, "upload/add", map[string]interface{}{"root": root, "shards": shards}, nil)
+}
+
+// invoke sends the invocation of the capability on the space, and decodes its
+// result into output
+func (w *W3upClient) invoke(ctx context.Context, can string, nb map[string]interface{}, output interface{}) error {
+	invocation, data, err := w.issue(can, nb)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{invocation}, Version: 1}, &body); err != nil {
+		return err
+	}
+	if err := util.LdWrite(&body, invocation.Bytes(), data); err != nil {
+		return err
+	}
+	for c, block := range w.proofBlocks {
+		if err := util.LdWrite(&body, c.Bytes(), block); err != nil {
+			return err
+		}
+	}
+	respBody, err := w.DoStreamRequest(ctx, Request{
+		Method:      "POST",
+		URL:         "/",
+		Body:        &body,
+		ContentType: "application/car",
+	})
+	if err != nil {
+		return err
+	}
+	defer respBody.Close()
+
+	var results []interface{}
+	if err := cbornode.DecodeReader(bufio.NewReader(respBody), &results); err != nil {
+		return fmt.Errorf("invalid %s response: %w", can, err)
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("invalid %s response: %d results", can, len(results))
+	}
+	result, ok := results[0].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid %s response: unexpected result %v", can, results[0])
+	}
+	// results are either the values or errors flagged with error: true, or
+	// {ok} and {error} with newer services
+	if e, isErr := result["error"]; isErr && e != false {
+		if e, ok := e.(map[string]interface{}); ok {
+			result = e
+		}
+		return fmt.Errorf("%s failed: %v: %v", can, result["name"], result["message"])
+	}
+	var value interface{} = result
+	if ok, found := result["ok"]; found {
+		value = ok
+	}
+	if output == nil {
+		return nil
+	}
+	// the result only holds plain values
+	jsonValue, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonValue, output)
+}
+
+// issue returns the CID and dag-cbor block of the UCAN invoking the capability,
+// signed by the principal
+func (w *W3upClient) issue(can string, nb map[string]interface{}) (cid.Cid, []byte, error) {
+	u := &UCAN{
+		Issuer:       w.did,
+		Audience:     w.serviceDID,
+		Capabilities: []UCANCapability{{With: w.space, Can: can, Nb: nb}},
+		Expiration:   time.Now().Add(ucanTTL).Unix(),
+		Proofs:       []cid.Cid{w.proof},
+	}
+	if err := u.Sign(w.signer); err != nil {
+		return cid.Undef, nil, err
+	}
+	return u.Block()
+}
+
+// UCAN is a UCAN 0.9 token, in the IPLD representation of ucanto
+type UCAN struct {
+	Issuer       string
+	Audience     string
+	Capabilities []UCANCapability
+	// Expiration is the Unix time the UCAN expires at, never when it's 0
+	Expiration int64
+	// NotBefore is the Unix time the UCAN is valid from, when it's set
+	NotBefore int64
+	Nonce     string
+	Facts     []map[string]interface{}
+	Proofs    []cid.Cid
+	Signature []byte
+}
+
+// UCANCapability is the capability can, on the resource with
+type UCANCapability struct {
+	With string
+	Can  string
+	Nb   map[string]interface{}
+}
+
+// SignPayload returns the payload signed by the issuer, the one of the JWT
+// representation of the UCAN
+func (u *UCAN) SignPayload() ([]byte, error) {
+	att := make([]map[string]interface{}, 0, len(u.Capabilities))
+	for _, c := range u.Capabilities {
+		capability := map[string]interface{}{"with": c.With, "can": c.Can}
+		if len(c.Nb) > 0 {
+			capability["nb"] = jsonLinks(c.Nb)
+		}
+		att = append(att, capability)
+	}
+	prf := make([]string, 0, len(u.Proofs))
+	for _, p := range u.Proofs {
+		prf = append(prf, p.String())
+	}
+	header, err := marshalJSON(map[string]interface{}{"alg": "EdDSA", "typ": "JWT", "ucv": ucanVersion})
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{"iss": u.Issuer, "aud": u.Audience, "att": att, "exp": nil, "prf": prf}
+	if u.Expiration != 0 {
+		claims["exp"] = u.Expiration
+	}
+	if u.NotBefore != 0 {
+		claims["nbf"] = u.NotBefore
+	}
+	if u.Nonce != "" {
+		claims["nnc"] = u.Nonce
+	}
+	if len(u.Facts) > 0 {
+		facts := make([]interface{}, 0, len(u.Facts))
+		for _, f := range u.Facts {
+			facts = append(facts, jsonLinks(f))
+		}
+		claims["fct"] = facts
+	}
+	payload, err := marshalJSON(claims)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)), nil
+}
+
+// Sign sets the signature of the UCAN by the ed25519 key of the issuer
+func (u *UCAN) Sign(key ed25519.PrivateKey) error {
+	payload, err := u.SignPayload()
+	if err != nil {
+		return err
+	}
+	signature := ed25519.Sign(key, payload)
+	u.Signature = append(binary.AppendUvarint(binary.AppendUvarint(nil, codecEdDSASig), uint64(len(signature))), signature...)
+	return nil
+}
+
+// Block returns the CID and the dag-cbor block of the UCAN
+func (u *UCAN) Block() (cid.Cid, []byte, error) {
+	iss, err := encodeDID(u.Issuer)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	aud, err := encodeDID(u.Audience)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	att := make([]interface{}, 0, len(u.Capabilities))
+	for _, c := range u.Capabilities {
+		capability := map[string]interface{}{"with": c.With, "can": c.Can}
+		if len(c.Nb) > 0 {
+			capability["nb"] = c.Nb
+		}
+		att = append(att, capability)
+	}
+	prf := u.Proofs
+	if prf == nil {
+		prf = []cid.Cid{}
+	}
+	ucan := map[string]interface{}{
+		"v":   ucanVersion,
+		"iss": iss,
+		"aud": aud,
+		"att": att,
+		"exp": nil,
+		"prf": prf,
+		"s":   u.Signature,
+	}
+	if u.Expiration != 0 {
+		ucan["exp"] = u.Expiration
+	}
+	if u.NotBefore != 0 {
+		ucan["nbf"] = u.NotBefore
+	}
+	if u.Nonce != "" {
+		ucan["nnc"] = u.Nonce
+	}
+	if len(u.Facts) > 0 {
+		ucan["fct"] = u.Facts
+	}
+	data, err := cbornode.DumpObject(ucan)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	c, err := cid.Prefix{Version: 1, Codec: cid.DagCBOR, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+	return c, data, err
+}
+
+// ParseUCAN decodes the UCAN of the dag-cbor block, or of the raw block of its
+// JWT representation. The signature isn't verified.
+func ParseUCAN(c cid.Cid, data []byte) (*UCAN, error) {
+	if data == nil {
+		return nil, fmt.Errorf("block %s not found", c)
+	}
+	u := &UCAN{}
+	if c.Type() == cid.Raw {
+		parts := strings.Split(string(data), ".")
+		if len(parts) != 3 {
+			return nil, errors.New("invalid UCAN JWT")
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		var claims struct {
+			Iss string `json:"iss"`
+			Aud string `json:"aud"`
+			Att []struct {
+				With string `json:"with"`
+				Can  string `json:"can"`
+			} `json:"att"`
+			Exp int64 `json:"exp"`
+		}
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return nil, err
+		}
+		u.Issuer, u.Audience, u.Expiration = claims.Iss, claims.Aud, claims.Exp
+		for _, a := range claims.Att {
+			u.Capabilities = append(u.Capabilities, UCANCapability{With: a.With, Can: a.Can})
+		}
+		return u, nil
+	}
+
+	var m map[string]interface{}
+	if err := cbornode.DecodeInto(data, &m); err != nil {
+		return nil, err
+	}
+	iss, _ := m["iss"].([]byte)
+	aud, _ := m["aud"].([]byte)
+	var err error
+	if u.Issuer, err = decodeDID(iss); err != nil {
+		return nil, err
+	}
+	if u.Audience, err = decodeDID(aud); err != nil {
+		return nil, err
+	}
+	att, _ := m["att"].([]interface{})
+	for _, a := range att {
+		a, _ := a.(map[string]interface{})
+		with, _ := a["with"].(string)
+		can, _ := a["can"].(string)
+		nb, _ := a["nb"].(map[string]interface{})
+		u.Capabilities = append(u.Capabilities, UCANCapability{With: with, Can: can, Nb: nb})
+	}
+	u.Expiration = cborInt(m["exp"])
+	u.NotBefore = cborInt(m["nbf"])
+	u.Nonce, _ = m["nnc"].(string)
+	fct, _ := m["fct"].([]interface{})
+	for _, f := range fct {
+		if f, ok := f.(map[string]interface{}); ok {
+			u.Facts = append(u.Facts, f)
+		}
+	}
+	prf, _ := m["prf"].([]interface{})
+	for _, p := range prf {
+		if p, ok := p.(cid.Cid); ok {
+			u.Proofs = append(u.Proofs, p)
+		}
+	}
+	u.Signature, _ = m["s"].([]byte)
+	return u, nil
+}
+
+// Verify checks the signature of the UCAN issued by a did:key
+func (u *UCAN) Verify() error {
+	key, err := encodeDID(u.Issuer)
+	if err != nil {
+		return err
+	}
+	code, n := binary.Uvarint(key)
+	if n <= 0 || code != codecEd25519Pub || len(key[n:]) != ed25519.PublicKeySize {
+		return fmt.Errorf("unsupported issuer %s", u.Issuer)
+	}
+	pub := ed25519.PublicKey(key[n:])
+	code, n = binary.Uvarint(u.Signature)
+	if n <= 0 || code != codecEdDSASig {
+		return errors.New("unsupported signature")
+	}
+	size, m := binary.Uvarint(u.Signature[n:])
+	if m <= 0 || int(size) != len(u.Signature[n+m:]) {
+		return errors.New("invalid signature")
+	}
+	payload, err := u.SignPayload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, payload, u.Signature[n+m:]) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// cborInt returns the integer decoded from dag-cbor, 0 if it's not one
+func cborInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	}
+	return 0
+}
+
+// encodeDID returns the binary representation of the DID in UCANs, the public
+// key for did:key and the multicodec prefixed DID otherwise
+func encodeDID(did string) ([]byte, error) {
+	if key := strings.TrimPrefix(did, "did:key:"); key != did {
+		_, data, err := multibase.Decode(key)
+		return data, err
+	}
+	if !strings.HasPrefix(did, "did:") {
+		return nil, fmt.Errorf("invalid DID %q", did)
+	}
+	return append(binary.AppendUvarint(nil, codecDIDCore), strings.TrimPrefix(did, "did:")...), nil
+}
+
+func decodeDID(data []byte) (string, error) {
+	code, n := binary.Uvarint(data)
+	if n <= 0 {
+		return "", errors.New("invalid DID")
+	}
+	if code == codecDIDCore {
+		return "did:" + string(data[n:]), nil
+	}
+	key, err := multibase.Encode(multibase.Base58BTC, data)
+	return "did:key:" + key, err
+}
+
+// jsonLinks returns the value with the CIDs in the {"/": cid} form of dag-json
+func jsonLinks(v interface{}) interface{} {
+	switch v := v.(type) {
+	case cid.Cid:
+		return map[string]string{"/": v.String()}
+	case []cid.Cid:
+		if v == nil {
+			return nil
+		}
+		links := make([]interface{}, 0, len(v))
+		for _, c := range v {
+			links = append(links, jsonLinks(c))
+		}
+		return links
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = jsonLinks(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			l = append(l, jsonLinks(e))
+		}
+		return l
+	}
+	return v
+}
+
+// marshalJSON encodes the value with sorted keys and without HTML escaping
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,160 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"github.com/stretchr/testify/require"
+)
+
+// ucantoProof is a delegation exported by ucanto, a CAR without root
+const ucantoProof = "EaJlcm9vdHOAZ3ZlcnNpb24BmgIBcRIguVaNefyQMACKNgi3XA46t5ijCH19S_ndLpkGhZ0kWiOnYXNYRO2hA0CVYBCNOU9IW-u-IUqhZ9gSHPzFMB7tzLYBE0tjOUrg11K3p3bC31kprHJ769ISMQSJDMRvWCGamwks2rsWJA4GYXZlMC45LjFjYXR0gaJjY2FuYSpkd2l0aHg4ZGlkOmtleTp6Nk1rdGdRNGZHOWNFTTdVY3dOTUhuRUJ0a1ZXYmQ2QUJLRFh3VTFKMlpvdVpodnBjYXVkWCLtAeoGmhaC2aAQPNKXr4AK7MOo8OR_9RkLNIZ6_SgZUq2_Y2V4cPZjaXNzWCLtAdNhO-TS5YOYwp4wQuxsFq9Hi2uBoldfmfxUxf3HWuhRY3ByZoDoAgFxEiAdz1OG9whG7Z5aT42jkEMcBiczAba5WgpZ5NO6okLTKKhhc1hE7aEDQJqxaum4RfYm8EF9W2G2SSoI6rI58lC6buIUoSZaThMs0JA3blC7PPrTgL06AqWOaaAnQKN4b9TuBezi3llLnQhhdmUwLjkuMWNhdHSBomNjYW5hKmR3aXRoeDhkaWQ6a2V5Ono2TWt0Z1E0Zkc5Y0VNN1Vjd05NSG5FQnRrVldiZDZBQktEWHdVMUoyWm91Wmh2cGNhdWRYIu0BYFbRZFVNOcB-ZhrKuhujUFU3l9oaQa68-YMRNtYtqDpjZXhw9mNmY3SBoWVzcGFjZaJkbmFtZWR0ZXN0bGlzUmVnaXN0ZXJlZPVjaXNzWCLtAeoGmhaC2aAQPNKXr4AK7MOo8OR_9RkLNIZ6_SgZUq2_Y3ByZoHYKlglAAFxEiC5Vo15_JAwAIo2CLdcDjq3mKMIfX1L-d0umQaFnSRaIw"
+
+func TestUCANUcantoProof(t *testing.T) {
+	require := require.New(t)
+	proof, err := base64.RawURLEncoding.DecodeString(ucantoProof)
+	require.NoError(err)
+
+	// the delegation is the last block, to another principal
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = NewW3upClient(W3upServiceURL, W3upServiceDID, key, proof)
+	require.ErrorContains(err, "UCAN proof delegated to did:key:z6MkkwKy2C9sCgoWcCGgxVCCt1qFyLJzwkoWi9BF3zi5s5jw")
+
+	br := bufio.NewReader(bytes.NewReader(proof))
+	_, err = util.LdRead(br)
+	require.NoError(err)
+	for {
+		c, block, err := util.ReadNode(br)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		u, err := ParseUCAN(c, block)
+		require.NoError(err)
+		require.NoError(u.Verify())
+		require.Equal("did:key:z6MktgQ4fG9cEM7UcwNMHnEBtkVWbd6ABKDXwU1J2ZouZhvp", u.Capabilities[0].With)
+		// the UCANs are encoded like ucanto
+		encoded, encodedBlock, err := u.Block()
+		require.NoError(err)
+		require.Equal(c, encoded)
+		require.Equal(block, encodedBlock)
+	}
+}
+
+func TestUCANSign(t *testing.T) {
+	require := require.New(t)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	link, err := cid.Decode("bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e")
+	require.NoError(err)
+	u := &UCAN{
+		Issuer:       DIDKey(key.Public().(ed25519.PublicKey)),
+		Audience:     W3upServiceDID,
+		Capabilities: []UCANCapability{{With: "did:key:z6MktgQ4fG9cEM7UcwNMHnEBtkVWbd6ABKDXwU1J2ZouZhvp", Can: "store/add", Nb: map[string]interface{}{"link": link, "size": 11}}},
+		Expiration:   time.Now().Add(time.Minute).Unix(),
+		Facts:        []map[string]interface{}{{"origin": "test"}},
+	}
+	require.NoError(u.Sign(key))
+	c, block, err := u.Block()
+	require.NoError(err)
+	parsed, err := ParseUCAN(c, block)
+	require.NoError(err)
+	require.NoError(parsed.Verify())
+	require.Equal(W3upServiceDID, parsed.Audience)
+	require.Equal(link, parsed.Capabilities[0].Nb["link"])
+
+	// altered UCANs aren't valid
+	parsed.Capabilities[0].Can = "store/remove"
+	require.ErrorContains(parsed.Verify(), "invalid signature")
+}
+
+func TestW3upClient(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	_, space, _ := ed25519.GenerateKey(rand.Reader)
+	_, principal, _ := ed25519.GenerateKey(rand.Reader)
+	spaceDID := DIDKey(space.Public().(ed25519.PublicKey))
+	delegation := &UCAN{
+		Issuer:       spaceDID,
+		Audience:     DIDKey(principal.Public().(ed25519.PublicKey)),
+		Capabilities: []UCANCapability{{With: spaceDID, Can: "*"}},
+	}
+	require.NoError(delegation.Sign(space))
+	proofCid, proofBlock, err := delegation.Block()
+	require.NoError(err)
+	var proof bytes.Buffer
+	require.NoError(car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{proofCid}, Version: 1}, &proof))
+	require.NoError(util.LdWrite(&proof, proofCid.Bytes(), proofBlock))
+
+	var result interface{}
+	var invocation *UCAN
+	var stored []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			stored, _ = io.ReadAll(r.Body)
+			return
+		}
+		cr, err := car.NewCarReader(r.Body)
+		require.NoError(err)
+		blocks := map[cid.Cid][]byte{}
+		for {
+			b, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(err)
+			blocks[b.Cid()] = b.RawData()
+		}
+		require.Equal(proofBlock, blocks[proofCid])
+		invocation, err = ParseUCAN(cr.Header.Roots[0], blocks[cr.Header.Roots[0]])
+		require.NoError(err)
+		require.NoError(invocation.Verify())
+		data, err := cbornode.DumpObject([]interface{}{result})
+		require.NoError(err)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	w, err := NewW3upClient(server.URL, W3upServiceDID, principal, proof.Bytes())
+	require.NoError(err)
+	require.Equal(spaceDID, w.Space())
+
+	result = map[string]interface{}{"status": "upload", "url": server.URL + "/put", "headers": map[string]string{}}
+	link, err := w.StoreAdd(ctx, strings.NewReader("car"))
+	require.NoError(err)
+	require.Equal("car", string(stored))
+	require.Equal("store/add", invocation.Capabilities[0].Can)
+	require.Equal(spaceDID, invocation.Capabilities[0].With)
+	require.Equal(link, invocation.Capabilities[0].Nb["link"])
+	require.Equal([]cid.Cid{proofCid}, invocation.Proofs)
+
+	// stored CARs aren't uploaded again
+	stored = nil
+	result = map[string]interface{}{"ok": map[string]interface{}{"status": "done"}}
+	_, err = w.StoreAdd(ctx, strings.NewReader("car"))
+	require.NoError(err)
+	require.Nil(stored)
+
+	result = map[string]interface{}{"root": link}
+	require.NoError(w.UploadAdd(ctx, link, []cid.Cid{link}))
+	require.Equal("upload/add", invocation.Capabilities[0].Can)
+
+	// the errors are flagged, or wrapped by newer services
+	result = map[string]interface{}{"error": true, "name": "UnknownCapability", "message": "not allowed"}
+	require.EqualError(w.UploadAdd(ctx, link, nil), "upload/add failed: UnknownCapability: not allowed")
+	result = map[string]interface{}{"error": map[string]interface{}{"name": "Unauthorized", "message": "expired"}}
+	require.EqualError(w.UploadAdd(ctx, link, nil), "upload/add failed: Unauthorized: expired")
+}
@@ -0,0 +1,690 @@
+// Command ostool runs object storage operations on the OS URLs the Livepeer nodes
+// are configured with, using the same drivers.
+//
+//	ostool [-json] [-timeout 1m] [-profiles file] <command> [flags] <args>
+//
+// Commands:
+//
+//	ls [-r] <url>              list objects
+//	cat [-range bytes=a-b] <url> write object data to stdout
+//	stat <url>                 show object properties
+//	cp [-r] [-progress] [-publish] <src> <dst>
+//	                           copy objects, "-" reads from stdin
+//	rm [-r] <url>              delete objects
+//	presign [-expire 1h] <url> print a presigned URL of the object
+//	publish <url>              publish the storage, e.g. a web3.storage upload
+//	describe                   describe the available drivers
+//
+// URLs ending with "/" are directories. Local paths can be used instead of file:// URLs,
+// and profile://name/path URLs refer to the storage profiles of the -profiles file or
+// the environment.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/livepeer/go-tools/drivers"
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+type cli struct {
+	jsonOut bool
+	timeout time.Duration
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("ostool", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	fs.BoolVar(&c.jsonOut, "json", false, "print the output as JSON")
+	fs.DurationVar(&c.timeout, "timeout", time.Minute, "timeout of every upload")
+	profilesFile := fs.String("profiles", "", "YAML or JSON file with storage profiles")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *profilesFile != "" {
+		profiles, err := drivers.LoadStorageProfiles(*profilesFile)
+		if err != nil {
+			return err
+		}
+		if err := drivers.UseStorageProfiles(profiles); err != nil {
+			return err
+		}
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("command not specified")
+	}
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "ls":
+		return c.ls(ctx, args)
+	case "cat":
+		return c.cat(ctx, args)
+	case "stat":
+		return c.stat(ctx, args)
+	case "cp":
+		return c.cp(ctx, args)
+	case "rm":
+		return c.rm(ctx, args)
+	case "presign":
+		return c.presign(args)
+	case "publish":
+		return c.publish(ctx, args)
+	case "describe":
+		return c.describe()
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// location is an object, or a directory of objects, referenced by an OS URL
+type location struct {
+	driver drivers.OSDriver
+	sess   drivers.OSSession
+	// name of the object within the session, empty when the session key is the object
+	name string
+	// listPrefix lists the contents of the directory
+	listPrefix string
+	isDir      bool
+	// localDir is the directory of relative local locations
+	localDir string
+}
+
+// openLocation opens the session of an OS URL. When relative is set, the names
+// within the session are relative to the directory the URL points to, as needed
+// to copy directories between sessions.
+func openLocation(raw string, relative bool) (*location, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	loc := &location{isDir: relative || strings.HasSuffix(u.Path, "/")}
+	if u.Scheme == "" || u.Scheme == "file" {
+		abs, err := filepath.Abs(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		if relative {
+			// FS sessions read and write relative to the driver base path
+			loc.driver, err = drivers.ParseOSURL(abs, true)
+			loc.localDir = abs
+		} else {
+			loc.driver, err = drivers.ParseOSURL("/", true)
+			loc.name = abs
+			loc.listPrefix = strings.TrimSuffix(abs, "/") + "/"
+		}
+		if err != nil {
+			return nil, err
+		}
+		loc.sess = loc.driver.NewSession("")
+		return loc, nil
+	}
+
+	sessPath := ""
+	switch u.Scheme {
+	case "s3", "s3+http", "s3+https":
+		// session keys must not end with a separator
+		u.Path = strings.TrimSuffix(u.Path, "/")
+	case "gs":
+		sessPath = strings.Trim(u.Path, "/")
+	case "ipfs":
+		loc.name = strings.Trim(u.Path, "/")
+	}
+	prepared, err := drivers.PrepareOSURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if loc.driver, err = drivers.ParseOSURL(prepared, true); err != nil {
+		return nil, err
+	}
+	if loc.sess = loc.driver.NewSession(sessPath); loc.sess == nil {
+		return nil, fmt.Errorf("can't create session for %s", redact(raw))
+	}
+	// sessions opened on the path list it with an empty prefix
+	if sessPath == "" {
+		if info := loc.sess.GetInfo(); info != nil && info.S3Info != nil && info.S3Info.Key != "" {
+			loc.listPrefix = info.S3Info.Key + "/"
+		}
+	}
+	return loc, nil
+}
+
+// redact hides the credentials in URLs printed in errors
+func redact(raw string) string {
+	var osURL drivers.OSURL
+	if err := osURL.Parse(raw); err == nil {
+		return osURL.Redacted()
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = url.User("REDACTED")
+	return u.String()
+}
+
+type lsEntry struct {
+	Name         string    `json:"name"`
+	Size         *int64    `json:"size,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+	Dir          bool      `json:"dir,omitempty"`
+}
+
+func (c *cli) ls(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	recursive := fs.Bool("r", false, "list recursively")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: ls [-r] <url>")
+	}
+	loc, err := openLocation(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	var entries []lsEntry
+	var list func(prefix string) error
+	list = func(prefix string) error {
+		delim := "/"
+		if *recursive {
+			delim = ""
+		}
+		page, err := loc.sess.ListFiles(ctx, prefix, delim)
+		if err != nil {
+			return err
+		}
+		for {
+			for _, dir := range page.Directories() {
+				name := qualify(prefix, dir)
+				if *recursive {
+					// drivers listing a single level return directories even without a delimiter
+					if err := list(strings.TrimSuffix(name, "/") + "/"); err != nil {
+						return err
+					}
+					continue
+				}
+				entries = append(entries, lsEntry{Name: name, Dir: true})
+			}
+			for _, f := range page.Files() {
+				entries = append(entries, lsEntry{Name: qualify(prefix, f.Name), Size: f.Size, ETag: f.ETag, LastModified: f.LastModified})
+			}
+			if !page.HasNextPage() {
+				return nil
+			}
+			if page, err = page.NextPage(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := list(loc.listPrefix); err != nil {
+		return err
+	}
+	if c.jsonOut {
+		return c.printJSON(entries)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, e := range entries {
+		if e.Dir {
+			fmt.Fprintf(tw, "DIR\t\t%s\n", e.Name)
+			continue
+		}
+		size := "-"
+		if e.Size != nil {
+			size = fmt.Sprint(*e.Size)
+		}
+		modified := ""
+		if !e.LastModified.IsZero() {
+			modified = e.LastModified.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", size, modified, e.Name)
+	}
+	return tw.Flush()
+}
+
+// qualify returns the full name of a listed entry, as some drivers list names
+// relative to the listed directory
+func qualify(prefix, name string) string {
+	if prefix == "" || strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return path.Join(prefix, name)
+}
+
+func (c *cli) cat(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	byteRange := fs.String("range", "", "byte range to read, e.g. bytes=0-99")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: cat [-range bytes=a-b] <url>")
+	}
+	loc, err := openLocation(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	var fi *drivers.FileInfoReader
+	if *byteRange != "" {
+		fi, err = loc.sess.ReadDataRange(ctx, loc.name, *byteRange)
+	} else {
+		fi, err = loc.sess.ReadData(ctx, loc.name)
+	}
+	if err != nil {
+		return err
+	}
+	defer fi.Body.Close()
+	_, err = io.Copy(c.stdout, fi.Body)
+	return err
+}
+
+type statOutput struct {
+	Name         string            `json:"name"`
+	Size         *int64            `json:"size,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified time.Time         `json:"lastModified,omitempty"`
+	ContentType  string            `json:"contentType,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Checksums    checksumsOutput   `json:"checksums"`
+
+	CacheControl       string     `json:"cacheControl,omitempty"`
+	ContentEncoding    string     `json:"contentEncoding,omitempty"`
+	ContentDisposition string     `json:"contentDisposition,omitempty"`
+	ContentLanguage    string     `json:"contentLanguage,omitempty"`
+	Expires            *time.Time `json:"expires,omitempty"`
+}
+
+type checksumsOutput struct {
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+func newChecksumsOutput(c drivers.Checksums) checksumsOutput {
+	return checksumsOutput{MD5: fmt.Sprintf("%x", c.MD5), SHA256: fmt.Sprintf("%x", c.SHA256), CRC32C: fmt.Sprintf("%x", c.CRC32C)}
+}
+
+func (c *cli) stat(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: stat <url>")
+	}
+	loc, err := openLocation(args[0], false)
+	if err != nil {
+		return err
+	}
+	fi, err := drivers.Stat(ctx, loc.sess, loc.name)
+	if err != nil {
+		return err
+	}
+	out := statOutput{
+		Name:               fi.Name,
+		Size:               fi.Size,
+		ETag:               fi.ETag,
+		LastModified:       fi.LastModified,
+		ContentType:        fi.ContentType,
+		Metadata:           fi.Metadata,
+		Checksums:          newChecksumsOutput(fi.Checksums),
+		CacheControl:       fi.CacheControl,
+		ContentEncoding:    fi.ContentEncoding,
+		ContentDisposition: fi.ContentDisposition,
+		ContentLanguage:    fi.ContentLanguage,
+	}
+	if !fi.Expires.IsZero() {
+		out.Expires = &fi.Expires
+	}
+	if c.jsonOut {
+		return c.printJSON(out)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", out.Name)
+	if out.Size != nil {
+		fmt.Fprintf(tw, "Size:\t%d\n", *out.Size)
+	}
+	for _, f := range [][2]string{
+		{"ETag", out.ETag},
+		{"Content-Type", out.ContentType},
+		{"Content-Encoding", out.ContentEncoding},
+		{"Content-Disposition", out.ContentDisposition},
+		{"Content-Language", out.ContentLanguage},
+		{"Cache-Control", out.CacheControl},
+		{"MD5", out.Checksums.MD5},
+		{"SHA-256", out.Checksums.SHA256},
+		{"CRC32C", out.Checksums.CRC32C},
+	} {
+		if f[1] != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", f[0], f[1])
+		}
+	}
+	if !out.LastModified.IsZero() {
+		fmt.Fprintf(tw, "Last-Modified:\t%s\n", out.LastModified.UTC().Format(time.RFC3339))
+	}
+	if out.Expires != nil {
+		fmt.Fprintf(tw, "Expires:\t%s\n", out.Expires.UTC().Format(time.RFC3339))
+	}
+	for k, v := range out.Metadata {
+		fmt.Fprintf(tw, "Metadata %s:\t%s\n", k, v)
+	}
+	return tw.Flush()
+}
+
+type cpOutput struct {
+	URL       string          `json:"url"`
+	Key       string          `json:"key,omitempty"`
+	Size      int64           `json:"size"`
+	ETag      string          `json:"etag,omitempty"`
+	VersionID string          `json:"versionId,omitempty"`
+	CarCID    string          `json:"carCid,omitempty"`
+	Checksums checksumsOutput `json:"checksums"`
+}
+
+func (c *cli) cp(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cp", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	recursive := fs.Bool("r", false, "copy directories recursively")
+	progress := fs.Bool("progress", false, "display the progress on stderr")
+	publish := fs.Bool("publish", false, "publish the destination storage after copying")
+	parallelism := fs.Int("parallelism", 4, "number of objects copied concurrently with -r")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: cp [-r] [-progress] [-publish] <src> <dst>")
+	}
+	src, dstURL := fs.Arg(0), fs.Arg(1)
+
+	var dst *location
+	var err error
+	if *recursive {
+		srcLoc, err := openLocation(src, true)
+		if err != nil {
+			return err
+		}
+		if dst, err = openLocation(dstURL, true); err != nil {
+			return err
+		}
+		if dst.localDir != "" {
+			if err := os.MkdirAll(dst.localDir, 0755); err != nil {
+				return err
+			}
+		}
+		opts := drivers.SyncOptions{Parallelism: *parallelism, Timeout: c.timeout}
+		if *progress {
+			opts.OnAction = func(a drivers.SyncAction) {
+				if a.Err != nil {
+					fmt.Fprintf(c.stderr, "%s %s failed: %v\n", a.Type, a.Name, a.Err)
+				} else if a.Type == drivers.SyncCopy {
+					fmt.Fprintf(c.stderr, "copied %s (%d bytes)\n", a.Name, a.Size)
+				}
+			}
+		}
+		res, err := drivers.Sync(ctx, srcLoc.sess, dst.sess, "", opts)
+		if res != nil {
+			if c.jsonOut {
+				c.printJSON(res)
+			} else {
+				fmt.Fprintf(c.stdout, "copied %d objects (%d bytes), %d unchanged\n", res.Copied, res.BytesCopied, res.Skipped)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		var body io.ReadCloser
+		var srcName string
+		var size int64 = -1
+		var fields *drivers.FileProperties
+		if src == "-" {
+			body, srcName = io.NopCloser(c.stdin), "stdin"
+		} else {
+			srcLoc, err := openLocation(src, false)
+			if err != nil {
+				return err
+			}
+			fi, err := srcLoc.sess.ReadData(ctx, srcLoc.name)
+			if err != nil {
+				return err
+			}
+			body = fi.Body
+			if u, err := url.Parse(src); err == nil {
+				srcName = path.Base(u.Path)
+			}
+			if fi.Size != nil {
+				size = *fi.Size
+			}
+			fields = &drivers.FileProperties{Metadata: fi.Metadata, ContentType: fi.ContentType}
+		}
+		defer body.Close()
+		if dst, err = openLocation(dstURL, false); err != nil {
+			return err
+		}
+		name := dst.name
+		if dst.isDir {
+			name = path.Join(name, srcName)
+		}
+		var data io.Reader = body
+		if *progress {
+			pr := newProgressReader(body, srcName, size, c.stderr)
+			defer pr.finish()
+			data = pr
+		}
+		out, err := dst.sess.SaveData(ctx, name, data, fields, c.timeout)
+		if err != nil {
+			return err
+		}
+		res := cpOutput{
+			URL:       out.URL,
+			Key:       out.Key,
+			Size:      out.Size,
+			ETag:      out.ETag,
+			VersionID: out.VersionID,
+			CarCID:    out.CarCID,
+			Checksums: newChecksumsOutput(out.Checksums),
+		}
+		if c.jsonOut {
+			c.printJSON(res)
+		} else {
+			fmt.Fprintln(c.stdout, res.URL)
+		}
+	}
+	if *publish {
+		return c.printPublished(ctx, dst.driver)
+	}
+	return nil
+}
+
+func (c *cli) rm(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	recursive := fs.Bool("r", false, "delete directories recursively")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: rm [-r] <url>")
+	}
+	if !*recursive {
+		loc, err := openLocation(fs.Arg(0), false)
+		if err != nil {
+			return err
+		}
+		return loc.sess.DeleteFile(ctx, loc.name)
+	}
+	loc, err := openLocation(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	// deleting everything is mirroring an empty source
+	res, err := drivers.Sync(ctx, emptySession{loc.sess}, loc.sess, loc.listPrefix, drivers.SyncOptions{Delete: true})
+	if res != nil && !c.jsonOut {
+		fmt.Fprintf(c.stdout, "deleted %d objects\n", res.Deleted)
+	} else if res != nil {
+		c.printJSON(res)
+	}
+	return err
+}
+
+// emptySession lists no objects
+type emptySession struct {
+	drivers.OSSession
+}
+
+func (emptySession) ListFiles(ctx context.Context, prefix, delim string) (drivers.PageInfo, error) {
+	return emptyPage{}, nil
+}
+
+type emptyPage struct{}
+
+func (emptyPage) Files() []drivers.FileInfo { return nil }
+func (emptyPage) Directories() []string     { return nil }
+func (emptyPage) HasNextPage() bool         { return false }
+func (emptyPage) NextPage() (drivers.PageInfo, error) {
+	return nil, drivers.ErrNoNextPage
+}
+
+func (c *cli) presign(args []string) error {
+	fs := flag.NewFlagSet("presign", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	expire := fs.Duration("expire", time.Hour, "validity of the URL")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: presign [-expire 1h] <url>")
+	}
+	loc, err := openLocation(fs.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	signed, err := loc.sess.Presign(loc.name, *expire)
+	if err != nil {
+		return err
+	}
+	return c.printURL(signed)
+}
+
+func (c *cli) publish(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: publish <url>")
+	}
+	loc, err := openLocation(args[0], false)
+	if err != nil {
+		return err
+	}
+	return c.printPublished(ctx, loc.driver)
+}
+
+func (c *cli) printPublished(ctx context.Context, driver drivers.OSDriver) error {
+	published, err := driver.Publish(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printURL(published)
+}
+
+func (c *cli) printURL(u string) error {
+	if c.jsonOut {
+		return c.printJSON(map[string]string{"url": u})
+	}
+	_, err := fmt.Fprintln(c.stdout, u)
+	return err
+}
+
+func (c *cli) describe() error {
+	if c.jsonOut {
+		_, err := fmt.Fprintln(c.stdout, string(drivers.DescribeDriversJson()))
+		return err
+	}
+	var descr struct {
+		Drivers []drivers.OSDriverDescr `json:"storage_drivers"`
+	}
+	if err := json.Unmarshal(drivers.DescribeDriversJson(), &descr); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, d := range descr.Drivers {
+		fmt.Fprintf(tw, "%s\t%s\n", strings.Join(d.UriSchemes, ", "), d.Description)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// progressReader periodically prints the number of bytes read through it
+type progressReader struct {
+	r     io.Reader
+	name  string
+	total int64
+	read  int64
+	out   io.Writer
+	done  chan struct{}
+}
+
+func newProgressReader(r io.Reader, name string, total int64, out io.Writer) *progressReader {
+	pr := &progressReader{r: r, name: name, total: total, out: out, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pr.done:
+				return
+			case <-ticker.C:
+				pr.print("\r")
+			}
+		}
+	}()
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	atomic.AddInt64(&pr.read, int64(n))
+	return n, err
+}
+
+func (pr *progressReader) print(prefix string) {
+	read := atomic.LoadInt64(&pr.read)
+	if pr.total > 0 {
+		fmt.Fprintf(pr.out, "%s%s: %d/%d bytes (%d%%)", prefix, pr.name, read, pr.total, read*100/pr.total)
+	} else {
+		fmt.Fprintf(pr.out, "%s%s: %d bytes", prefix, pr.name, read)
+	}
+}
+
+func (pr *progressReader) finish() {
+	close(pr.done)
+	pr.print("\r")
+	fmt.Fprintln(pr.out)
+}
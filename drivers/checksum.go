@@ -0,0 +1,173 @@
+package drivers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksums of the data of an object. Checksums that are not known are left empty.
+type Checksums struct {
+	MD5    []byte
+	SHA256 []byte
+	// CRC32C is the big-endian encoded CRC32 checksum using the Castagnoli polynomial
+	CRC32C []byte
+}
+
+func (c Checksums) IsEmpty() bool {
+	return len(c.MD5) == 0 && len(c.SHA256) == 0 && len(c.CRC32C) == 0
+}
+
+// Verify compares the checksums known by both c and actual and returns an error
+// wrapping ErrChecksumMismatch if any of them differ
+func (c Checksums) Verify(actual Checksums) error {
+	check := func(algo string, expected, got []byte) error {
+		if len(expected) == 0 || len(got) == 0 || bytes.Equal(expected, got) {
+			return nil
+		}
+		return fmt.Errorf("%w: expected %s %s got %s", ErrChecksumMismatch, algo, hex.EncodeToString(expected), hex.EncodeToString(got))
+	}
+	if err := check("MD5", c.MD5, actual.MD5); err != nil {
+		return err
+	}
+	if err := check("SHA-256", c.SHA256, actual.SHA256); err != nil {
+		return err
+	}
+	return check("CRC32C", c.CRC32C, actual.CRC32C)
+}
+
+func (c Checksums) crc32c() uint32 {
+	if len(c.CRC32C) != crc32.Size {
+		return 0
+	}
+	return binary.BigEndian.Uint32(c.CRC32C)
+}
+
+func crc32cBytes(crc uint32) []byte {
+	b := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(b, crc)
+	return b
+}
+
+// decodeBase64Checksum decodes checksums in the base64 form used by S3 and GCS.
+// Checksums of multipart objects (with a part count suffix) are not checksums of
+// the object data, so they are ignored.
+func decodeBase64Checksum(s string, size int) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != size {
+		return nil
+	}
+	return b
+}
+
+// checksumReader computes the checksums and the size of the data read through it
+type checksumReader struct {
+	r      io.Reader
+	size   int64
+	md5    hash.Hash
+	sha256 hash.Hash
+	crc32c hash.Hash32
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{
+		r:      r,
+		md5:    md5.New(),
+		sha256: sha256.New(),
+		crc32c: crc32.New(crc32cTable),
+	}
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.size += int64(n)
+	if n > 0 {
+		cr.md5.Write(p[:n])
+		cr.sha256.Write(p[:n])
+		cr.crc32c.Write(p[:n])
+	}
+	return n, err
+}
+
+// Sum returns the checksums of the data read so far
+func (cr *checksumReader) Sum() Checksums {
+	return Checksums{
+		MD5:    cr.md5.Sum(nil),
+		SHA256: cr.sha256.Sum(nil),
+		CRC32C: cr.crc32c.Sum(nil),
+	}
+}
+
+// ComputeChecksums reads r to the end and returns the checksums of its data
+func ComputeChecksums(r io.Reader) (Checksums, error) {
+	cr := newChecksumReader(r)
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return Checksums{}, err
+	}
+	return cr.Sum(), nil
+}
+
+// precomputeChecksums computes the checksums of seekable data, so they can be sent
+// to backends verifying them before the upload, and rewinds the data. Returns nil
+// when data is not seekable.
+func precomputeChecksums(data io.Reader) (*Checksums, error) {
+	rs, ok := data.(io.ReadSeeker)
+	if !ok {
+		return nil, nil
+	}
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil
+	}
+	sums, err := ComputeChecksums(rs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rs.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &sums, nil
+}
+
+type verifyingReader struct {
+	*checksumReader
+	closer   io.Closer
+	expected Checksums
+}
+
+// NewVerifyingReader returns a reader failing with an error wrapping
+// ErrChecksumMismatch instead of io.EOF when the data read from body does not
+// match the expected checksums
+func NewVerifyingReader(body io.ReadCloser, expected Checksums) io.ReadCloser {
+	return &verifyingReader{
+		checksumReader: newChecksumReader(body),
+		closer:         body,
+		expected:       expected,
+	}
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.checksumReader.Read(p)
+	if err == io.EOF {
+		if verr := vr.expected.Verify(vr.Sum()); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+func (vr *verifyingReader) Close() error {
+	return vr.closer.Close()
+}
@@ -0,0 +1,68 @@
+package drivers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeChecksums(t *testing.T) {
+	require := require.New(t)
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	sums, err := ComputeChecksums(bytes.NewReader(data))
+	require.NoError(err)
+	md5Sum, shaSum := md5.Sum(data), sha256.Sum256(data)
+	require.Equal(md5Sum[:], sums.MD5)
+	require.Equal(shaSum[:], sums.SHA256)
+	require.Equal(crc32cBytes(crc32.Checksum(data, crc32cTable)), sums.CRC32C)
+	require.Equal("22620404", hex.EncodeToString(sums.CRC32C))
+
+	// seekable data is rewound to where it was
+	r := bytes.NewReader(data)
+	r.Seek(4, io.SeekStart)
+	pre, err := precomputeChecksums(r)
+	require.NoError(err)
+	rest, _ := ioutil.ReadAll(r)
+	require.Equal(data[4:], rest)
+	expected, _ := ComputeChecksums(bytes.NewReader(data[4:]))
+	require.Equal(expected, *pre)
+
+	pre, err = precomputeChecksums(&onceReader{bytes.NewReader(data)})
+	require.NoError(err)
+	require.Nil(pre)
+}
+
+func TestVerifyingReader(t *testing.T) {
+	require := require.New(t)
+	data := "segment data"
+	sums, _ := ComputeChecksums(strings.NewReader(data))
+
+	got, err := ioutil.ReadAll(NewVerifyingReader(ioutil.NopCloser(strings.NewReader(data)), sums))
+	require.NoError(err)
+	require.Equal(data, string(got))
+
+	// only the known checksums are verified
+	_, err = ioutil.ReadAll(NewVerifyingReader(ioutil.NopCloser(strings.NewReader(data)), Checksums{CRC32C: sums.CRC32C}))
+	require.NoError(err)
+
+	_, err = ioutil.ReadAll(NewVerifyingReader(ioutil.NopCloser(strings.NewReader("segment dat")), sums))
+	require.ErrorIs(err, ErrChecksumMismatch)
+	require.ErrorContains(err, "MD5")
+}
+
+func TestEtagMD5(t *testing.T) {
+	require := require.New(t)
+	sum := md5.Sum([]byte("data"))
+	require.Equal(sum[:], etagMD5(`"`+hex.EncodeToString(sum[:])+`"`))
+	require.Nil(etagMD5(`"` + hex.EncodeToString(sum[:]) + `-3"`))
+	require.Nil(decodeBase64Checksum("ABCD/A==-2", crc32.Size))
+	require.Equal([]byte{0, 16, 131, 252}, decodeBase64Checksum("ABCD/A==", crc32.Size))
+}
@@ -0,0 +1,297 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+const (
+	// coalesceDefaultMaxBuffered is the default amount of data buffered on behalf
+	// of the slowest reader before the backend read is paused.
+	coalesceDefaultMaxBuffered = 4 * 1024 * 1024
+	coalesceChunkSize          = 32 * 1024
+)
+
+var errCoalescedReaderClosed = errors.New("coalesced reader closed")
+
+var _ OSSession = (*CoalescingSession)(nil)
+
+// CoalescingSession wraps an OSSession and collapses concurrent ReadData calls for
+// the same name into a single backend request. The response body is fanned out to
+// all the waiters. Data read from the backend is kept only until the slowest reader
+// consumes it, and the backend read is paused once maxBuffered bytes are pending.
+//
+// A caller joins an in-flight read only while the flight still holds the beginning
+// of the body, otherwise a new backend request is made. Cancelling the context of
+// one caller detaches only that caller; the backend request is cancelled once no
+// readers are left.
+type CoalescingSession struct {
+	OSSession
+	maxBuffered int
+
+	mu      sync.Mutex
+	flights map[string]*readFlight
+}
+
+type readFlight struct {
+	cs     *CoalescingSession
+	name   string
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  chan struct{}
+
+	// set before ready is closed
+	info    *FileInfoReader
+	readErr error
+
+	mu       sync.Mutex
+	changed  chan struct{}
+	readers  map[*coalescedReader]struct{}
+	buf      []byte
+	base     int64
+	err      error
+	joinable bool
+}
+
+type coalescedReader struct {
+	f      *readFlight
+	ctx    context.Context
+	pos    int64
+	closed bool
+}
+
+// NewCoalescingSession returns a session collapsing concurrent reads of sess. If
+// maxBuffered is not positive, coalesceDefaultMaxBuffered is used.
+func NewCoalescingSession(sess OSSession, maxBuffered int) *CoalescingSession {
+	if maxBuffered <= 0 {
+		maxBuffered = coalesceDefaultMaxBuffered
+	}
+	return &CoalescingSession{
+		OSSession:   sess,
+		maxBuffered: maxBuffered,
+		flights:     make(map[string]*readFlight),
+	}
+}
+
+func (cs *CoalescingSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	cs.mu.Lock()
+	f, ok := cs.flights[name]
+	var r *coalescedReader
+	if ok {
+		r = f.join(ctx)
+	}
+	if r == nil {
+		f = cs.newFlight(name)
+		r = f.join(ctx)
+		cs.flights[name] = f
+		go f.run()
+	}
+	cs.mu.Unlock()
+
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		r.Close()
+		return nil, ctx.Err()
+	}
+	if f.readErr != nil {
+		r.Close()
+		return nil, f.readErr
+	}
+	res := *f.info
+	res.Body = r
+	return &res, nil
+}
+
+func (cs *CoalescingSession) newFlight(name string) *readFlight {
+	// the backend request must outlive the caller that happened to start it
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readFlight{
+		cs:       cs,
+		name:     name,
+		ctx:      ctx,
+		cancel:   cancel,
+		ready:    make(chan struct{}),
+		changed:  make(chan struct{}),
+		readers:  make(map[*coalescedReader]struct{}),
+		joinable: true,
+	}
+}
+
+func (cs *CoalescingSession) forget(f *readFlight) {
+	cs.mu.Lock()
+	if cs.flights[f.name] == f {
+		delete(cs.flights, f.name)
+	}
+	cs.mu.Unlock()
+}
+
+func (f *readFlight) join(ctx context.Context) *coalescedReader {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.joinable {
+		return nil
+	}
+	r := &coalescedReader{f: f, ctx: ctx}
+	f.readers[r] = struct{}{}
+	return r
+}
+
+func (f *readFlight) run() {
+	info, err := f.cs.OSSession.ReadData(f.ctx, f.name)
+	if err == nil && info == nil {
+		err = errors.New("empty response")
+	}
+	f.info, f.readErr = info, err
+	close(f.ready)
+	if err != nil {
+		f.finish(err)
+		return
+	}
+	defer info.Body.Close()
+
+	chunk := make([]byte, coalesceChunkSize)
+	for {
+		if !f.waitForSpace() {
+			return
+		}
+		n, err := info.Body.Read(chunk)
+		f.mu.Lock()
+		if n > 0 {
+			f.buf = append(f.buf, chunk[:n]...)
+			f.broadcast()
+		}
+		f.mu.Unlock()
+		if err != nil {
+			f.finish(err)
+			return
+		}
+	}
+}
+
+// waitForSpace blocks until the slowest reader is less than maxBuffered bytes
+// behind. It returns false if the flight got abandoned in the meantime.
+func (f *readFlight) waitForSpace() bool {
+	for {
+		f.mu.Lock()
+		if f.ctx.Err() != nil {
+			f.mu.Unlock()
+			return false
+		}
+		if len(f.buf) < f.cs.maxBuffered {
+			f.mu.Unlock()
+			return true
+		}
+		ch := f.changed
+		f.mu.Unlock()
+		select {
+		case <-ch:
+		case <-f.ctx.Done():
+		}
+	}
+}
+
+func (f *readFlight) finish(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.joinable = false
+	f.broadcast()
+	f.mu.Unlock()
+	f.cs.forget(f)
+}
+
+// broadcast wakes up everyone waiting on the flight state. Must be called with f.mu held.
+func (f *readFlight) broadcast() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// trim drops the data consumed by all the readers. Must be called with f.mu held.
+// It returns true if the flight stopped accepting new readers.
+func (f *readFlight) trim() bool {
+	if len(f.readers) == 0 {
+		return false
+	}
+	min := int64(-1)
+	for r := range f.readers {
+		if min == -1 || r.pos < min {
+			min = r.pos
+		}
+	}
+	if min <= f.base {
+		return false
+	}
+	f.buf = f.buf[min-f.base:]
+	f.base = min
+	f.broadcast()
+	if f.joinable {
+		f.joinable = false
+		return true
+	}
+	return false
+}
+
+func (r *coalescedReader) Read(p []byte) (int, error) {
+	f := r.f
+	for {
+		if err := r.ctx.Err(); err != nil {
+			r.Close()
+			return 0, err
+		}
+		f.mu.Lock()
+		if r.closed {
+			f.mu.Unlock()
+			return 0, errCoalescedReaderClosed
+		}
+		if off := r.pos - f.base; off < int64(len(f.buf)) {
+			n := copy(p, f.buf[off:])
+			r.pos += int64(n)
+			stopped := f.trim()
+			f.mu.Unlock()
+			if stopped {
+				f.cs.forget(f)
+			}
+			return n, nil
+		}
+		if f.err != nil {
+			err := f.err
+			f.mu.Unlock()
+			return 0, err
+		}
+		ch := f.changed
+		f.mu.Unlock()
+		select {
+		case <-ch:
+		case <-r.ctx.Done():
+			r.Close()
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// Close detaches the reader from the flight, cancelling the backend request if
+// it was the last one.
+func (r *coalescedReader) Close() error {
+	f := r.f
+	f.mu.Lock()
+	if r.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	delete(f.readers, r)
+	abandoned := len(f.readers) == 0
+	if abandoned {
+		f.joinable = false
+	} else {
+		f.trim()
+	}
+	f.broadcast()
+	f.mu.Unlock()
+	if abandoned {
+		f.cancel()
+		f.cs.forget(f)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingReadSession struct {
+	MockOSSession
+	data    []byte
+	calls   int32
+	release chan struct{}
+	closed  int32
+}
+
+type countingBody struct {
+	io.Reader
+	sess *countingReadSession
+}
+
+func (b *countingBody) Close() error {
+	atomic.AddInt32(&b.sess.closed, 1)
+	return nil
+}
+
+func (s *countingReadSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	size := int64(len(s.data))
+	return &FileInfoReader{
+		FileInfo: FileInfo{Name: name, Size: &size},
+		Body:     &countingBody{Reader: bytes.NewReader(s.data), sess: s},
+	}, nil
+}
+
+func TestCoalescingSessionCollapsesConcurrentReads(t *testing.T) {
+	require := require.New(t)
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+	backend := &countingReadSession{data: data, release: make(chan struct{})}
+	cs := NewCoalescingSession(backend, 64*1024)
+
+	const readers = 20
+	var wg sync.WaitGroup
+	results := make([][]byte, readers)
+	errs := make([]error, readers)
+	started := make(chan struct{}, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started <- struct{}{}
+			fi, err := cs.ReadData(context.Background(), "playlist.m3u8")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer fi.Body.Close()
+			results[i], errs[i] = ioutil.ReadAll(fi.Body)
+		}(i)
+	}
+	for i := 0; i < readers; i++ {
+		<-started
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	require.Equal(int32(1), atomic.LoadInt32(&backend.calls))
+	for i := 0; i < readers; i++ {
+		require.NoError(errs[i])
+		require.Equal(data, results[i])
+	}
+
+	// the flight is gone once completed, so the next read hits the backend again
+	fi, err := cs.ReadData(context.Background(), "playlist.m3u8")
+	require.NoError(err)
+	got, err := ioutil.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal(data, got)
+	require.Equal(int32(2), atomic.LoadInt32(&backend.calls))
+}
+
+func TestCoalescingSessionPerCallerCancellation(t *testing.T) {
+	require := require.New(t)
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+	backend := &countingReadSession{data: data}
+	cs := NewCoalescingSession(backend, 16*1024)
+
+	slowCtx, cancelSlow := context.WithCancel(context.Background())
+	slow, err := cs.ReadData(slowCtx, "seg.ts")
+	require.NoError(err)
+	fast, err := cs.ReadData(context.Background(), "seg.ts")
+	require.NoError(err)
+	require.Equal(int32(1), atomic.LoadInt32(&backend.calls))
+
+	// the fast reader is blocked by the slow one once the buffer limit is reached
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(fast.Body)
+		done <- b
+	}()
+	select {
+	case <-done:
+		t.Fatal("fast reader should be held back by the buffer limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// cancelling the slow reader releases the fast one
+	cancelSlow()
+	_, err = slow.Body.Read(make([]byte, 1))
+	require.ErrorIs(err, context.Canceled)
+	select {
+	case b := <-done:
+		require.Equal(data, b)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast reader did not complete")
+	}
+}
+
+func TestCoalescingSessionAbandonedFlight(t *testing.T) {
+	require := require.New(t)
+	data := make([]byte, 100*1024)
+	backend := &countingReadSession{data: data}
+	cs := NewCoalescingSession(backend, 8*1024)
+
+	fi, err := cs.ReadData(context.Background(), "seg.ts")
+	require.NoError(err)
+	_, err = fi.Body.Read(make([]byte, 10))
+	require.NoError(err)
+	require.NoError(fi.Body.Close())
+
+	require.Eventually(func() bool {
+		return atomic.LoadInt32(&backend.closed) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	cs.mu.Lock()
+	require.Empty(cs.flights)
+	cs.mu.Unlock()
+}
@@ -0,0 +1,302 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	// metaCompression metadata key holds the encoding the object was compressed with
+	metaCompression = "compression"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	errCompressionAborted = errors.New("compressed upload aborted")
+)
+
+// incompressibleTypes are content types (or top-level types when ending with "/")
+// whose data is already compressed, so they are never compressed again
+var incompressibleTypes = []string{
+	"video/",
+	"audio/",
+	"image/",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+}
+
+// CompressionPolicy decides which objects get compressed based on their content type
+type CompressionPolicy struct {
+	// Encoding is either CompressionGzip or CompressionZstd
+	Encoding string
+	// ContentTypes are the compressed content types. Entries ending with "/" match
+	// the whole top-level type, e.g. "text/". Empty list compresses all content
+	// types except the already compressed ones.
+	ContentTypes []string
+}
+
+// DefaultCompressionPolicy gzips text, JSON, XML and HLS playlists
+var DefaultCompressionPolicy = CompressionPolicy{
+	Encoding: CompressionGzip,
+	ContentTypes: []string{
+		"text/",
+		"application/json",
+		"application/x-ndjson",
+		"application/xml",
+		"application/javascript",
+		"application/x-mpegurl",
+		"application/vnd.apple.mpegurl",
+	},
+}
+
+func (p CompressionPolicy) encodingFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	if mediaType == "image/svg+xml" {
+		// the only image type that is text
+		return p.encodingIfListed(mediaType)
+	}
+	if matchContentType(incompressibleTypes, mediaType) {
+		return ""
+	}
+	return p.encodingIfListed(mediaType)
+}
+
+func (p CompressionPolicy) encodingIfListed(mediaType string) string {
+	if len(p.ContentTypes) == 0 || matchContentType(p.ContentTypes, mediaType) {
+		return p.Encoding
+	}
+	return ""
+}
+
+func matchContentType(types []string, mediaType string) bool {
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+var _ OSSession = (*CompressedSession)(nil)
+
+// CompressedSession compresses the objects selected by its CompressionPolicy
+// before they are handed over to the wrapped session, and decompresses them
+// transparently on reads. The encoding is stored both as the Content-Encoding of
+// the object and in its Metadata, so the wrapped session must persist the latter.
+// Objects saved with a Content-Encoding already set are stored as they are.
+//
+// Sizes reported by ListFiles are the sizes of the compressed objects, and
+// ReadData does not report a size for compressed objects.
+type CompressedSession struct {
+	OSSession
+	policy CompressionPolicy
+}
+
+// NewCompressedSession returns a session compressing data saved to sess according to policy
+func NewCompressedSession(sess OSSession, policy CompressionPolicy) (*CompressedSession, error) {
+	if policy.Encoding != CompressionGzip && policy.Encoding != CompressionZstd {
+		return nil, fmt.Errorf("unsupported compression encoding %q", policy.Encoding)
+	}
+	return &CompressedSession{OSSession: sess, policy: policy}, nil
+}
+
+func (cs *CompressedSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	if fields != nil && fields.ContentEncoding != "" {
+		return cs.OSSession.SaveData(ctx, name, data, fields, timeout)
+	}
+	contentType := ""
+	if fields != nil {
+		contentType = fields.ContentType
+	}
+	if contentType == "" {
+		var err error
+		// the wrapped session can't sniff the content type of compressed data
+		data, contentType, err = peekContentType(name, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	encoding := cs.policy.encodingFor(contentType)
+	if encoding == "" {
+		return cs.OSSession.SaveData(ctx, name, data, fields, timeout)
+	}
+
+	compFields := &FileProperties{}
+	if fields != nil {
+		*compFields = *fields
+	}
+	compFields.Metadata = make(map[string]string)
+	if fields != nil {
+		for k, v := range fields.Metadata {
+			compFields.Metadata[k] = v
+		}
+	}
+	compFields.Metadata[metaCompression] = encoding
+	compFields.ContentEncoding = encoding
+	compFields.ContentType = contentType
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(compress(encoding, pw, data))
+	}()
+	out, err := cs.OSSession.SaveData(ctx, name, pr, compFields, timeout)
+	// unblocks the compressor if the wrapped session did not consume all the data
+	pr.CloseWithError(errCompressionAborted)
+	return out, err
+}
+
+func compress(encoding string, dst io.Writer, src io.Reader) error {
+	var enc io.WriteCloser
+	switch encoding {
+	case CompressionGzip:
+		enc = gzip.NewWriter(dst)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+		enc = zw
+	default:
+		return fmt.Errorf("unsupported compression encoding %q", encoding)
+	}
+	if _, err := io.Copy(enc, src); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+func (cs *CompressedSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	fi, err := cs.OSSession.ReadData(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := decompressBody(fi); err != nil {
+		fi.Body.Close()
+		return nil, err
+	}
+	return fi, nil
+}
+
+// ReadDataRange reads byteRange of the object. Ranges of compressed objects can't
+// be read directly, so the whole object is decompressed and the preceding data is
+// skipped. Suffix ranges of compressed objects are not supported.
+func (cs *CompressedSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	if byteRange == "" {
+		return cs.ReadData(ctx, name)
+	}
+	start, end, err := parseByteRange(byteRange)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := cs.OSSession.ReadDataRange(ctx, name, byteRange)
+	if err != nil && !errors.Is(err, ErrNotSupported) {
+		return nil, err
+	}
+	if err == nil {
+		if metadataValue(fi.Metadata, metaCompression) == "" {
+			return fi, nil
+		}
+		fi.Body.Close()
+	}
+	if start < 0 {
+		return nil, ErrNotSupported
+	}
+
+	fi, err = cs.ReadData(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = &skipReader{r: fi.Body, skip: start}
+	fi.ContentRange = ""
+	if end >= 0 {
+		body = io.LimitReader(body, rangeLen(start, end))
+		// total size of decompressed data is not known upfront
+		fi.ContentRange = fmt.Sprintf("bytes %d-%d/*", start, end)
+	}
+	fi.Body = &rangeReadCloser{Reader: body, Closer: fi.Body}
+	fi.Size = nil
+	return fi, nil
+}
+
+// decompressBody replaces the body of a compressed object with a decompressing
+// reader. Objects whose data was already decoded in transit (e.g. by the GCS
+// decompressive transcoding) are detected by their missing magic number.
+func decompressBody(fi *FileInfoReader) error {
+	encoding := metadataValue(fi.Metadata, metaCompression)
+	if encoding == "" {
+		return nil
+	}
+	fi.Metadata = stripCompressionMetadata(fi.Metadata)
+	fi.Size = nil
+	fi.ContentEncoding = ""
+
+	br := bufio.NewReader(fi.Body)
+	magic, _ := br.Peek(len(zstdMagic))
+	var dec io.ReadCloser
+	switch {
+	case encoding == CompressionGzip && bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("error decompressing %s: %w", fi.Name, err)
+		}
+		dec = zr
+	case encoding == CompressionZstd && bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("error decompressing %s: %w", fi.Name, err)
+		}
+		dec = zr.IOReadCloser()
+	case encoding != CompressionGzip && encoding != CompressionZstd:
+		return fmt.Errorf("unsupported compression encoding %q of %s", encoding, fi.Name)
+	default:
+		fi.Body = &rangeReadCloser{Reader: br, Closer: fi.Body}
+		return nil
+	}
+	fi.Body = &decompressReader{ReadCloser: dec, src: fi.Body}
+	return nil
+}
+
+type decompressReader struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (dr *decompressReader) Close() error {
+	dr.ReadCloser.Close()
+	return dr.src.Close()
+}
+
+func stripCompressionMetadata(metadata map[string]string) map[string]string {
+	res := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if !strings.EqualFold(k, metaCompression) {
+			res[k] = v
+		}
+	}
+	return res
+}
@@ -0,0 +1,112 @@
+package drivers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedSessionRoundTrip(t *testing.T) {
+	require := require.New(t)
+	manifest := strings.Repeat(`{"segment":"1.ts","duration":2.0},`, 500)
+
+	for _, encoding := range []string{CompressionGzip, CompressionZstd} {
+		backend := newFakeSession()
+		cs, err := NewCompressedSession(backend, CompressionPolicy{Encoding: encoding})
+		require.NoError(err)
+
+		_, err = cs.SaveData(context.Background(), "manifest.json", strings.NewReader(manifest), &FileProperties{Metadata: map[string]string{"stream": "abc"}}, 0)
+		require.NoError(err)
+		obj := backend.objects["manifest.json"]
+		require.Less(len(obj.data), len(manifest)/10)
+		require.Equal(encoding, obj.fields.ContentEncoding)
+		require.Equal(encoding, obj.fields.Metadata[metaCompression])
+		require.Equal("application/json", obj.fields.ContentType)
+
+		fi, err := cs.ReadData(context.Background(), "manifest.json")
+		require.NoError(err)
+		require.Nil(fi.Size)
+		require.Equal(map[string]string{"stream": "abc"}, fi.Metadata)
+		got, err := ioutil.ReadAll(fi.Body)
+		require.NoError(err)
+		require.NoError(fi.Body.Close())
+		require.Equal(manifest, string(got))
+
+		fi, err = cs.ReadDataRange(context.Background(), "manifest.json", "bytes=2-8")
+		require.NoError(err)
+		got, err = ioutil.ReadAll(fi.Body)
+		require.NoError(err)
+		require.Equal(manifest[2:9], string(got))
+		require.Equal("bytes 2-8/*", fi.ContentRange)
+	}
+}
+
+func TestCompressedSessionSkipsMedia(t *testing.T) {
+	require := require.New(t)
+	backend := newFakeSession()
+	cs, err := NewCompressedSession(backend, CompressionPolicy{Encoding: CompressionGzip})
+	require.NoError(err)
+
+	segment := bytes.Repeat([]byte{0x47}, 1000)
+	for _, name := range []string{"1.ts", "1.mp4"} {
+		_, err := cs.SaveData(context.Background(), name, bytes.NewReader(segment), nil, 0)
+		require.NoError(err)
+		require.Equal(segment, backend.get(name))
+		require.Empty(backend.objects[name].fields.Metadata[metaCompression])
+	}
+	// already encoded data is stored as it is
+	_, err = cs.SaveData(context.Background(), "log.txt", strings.NewReader("raw"), &FileProperties{ContentEncoding: "br"}, 0)
+	require.NoError(err)
+	require.Equal("raw", string(backend.get("log.txt")))
+
+	fi, err := cs.ReadDataRange(context.Background(), "1.ts", "bytes=10-19")
+	require.NoError(err)
+	require.Equal("bytes 10-19/1000", fi.ContentRange)
+}
+
+func TestCompressedSessionDefaultPolicy(t *testing.T) {
+	require := require.New(t)
+	p := DefaultCompressionPolicy
+	require.Equal(CompressionGzip, p.encodingFor("application/json; charset=utf-8"))
+	require.Equal(CompressionGzip, p.encodingFor("text/plain"))
+	require.Equal(CompressionGzip, p.encodingFor("application/vnd.apple.mpegurl"))
+	require.Equal("", p.encodingFor("video/mp2t"))
+	require.Equal("", p.encodingFor("video/mp4"))
+	require.Equal("", p.encodingFor("application/octet-stream"))
+
+	_, err := NewCompressedSession(newFakeSession(), CompressionPolicy{Encoding: "br"})
+	require.Error(err)
+}
+
+func TestCompressedSessionAlreadyDecoded(t *testing.T) {
+	require := require.New(t)
+	backend := newFakeSession()
+	cs, err := NewCompressedSession(backend, DefaultCompressionPolicy)
+	require.NoError(err)
+
+	// GCS transcoding returns the decompressed data of gzipped objects
+	backend.put("log.txt", []byte("plain text"))
+	backend.objects["log.txt"].fields.Metadata = map[string]string{"Compression": CompressionGzip}
+	fi, err := cs.ReadData(context.Background(), "log.txt")
+	require.NoError(err)
+	got, err := ioutil.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("plain text", string(got))
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("gzipped text"))
+	zw.Close()
+	backend.put("log2.txt", buf.Bytes())
+	backend.objects["log2.txt"].fields.Metadata = map[string]string{"Compression": CompressionGzip}
+	fi, err = cs.ReadData(context.Background(), "log2.txt")
+	require.NoError(err)
+	got, err = ioutil.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("gzipped text", string(got))
+}
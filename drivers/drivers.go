@@ -4,9 +4,7 @@ package drivers
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -52,6 +52,8 @@ type OSDriver interface {
 	Description() string
 	UriSchemes() []string
 	Publish(ctx context.Context) (string, error)
+	// Config returns the OS URL the driver is configured with
+	Config() *OSURL
 }
 
 type FileInfo struct {
@@ -67,25 +69,73 @@ type FileInfoReader struct {
 	Body         io.ReadCloser
 	ContentType  string
 	ContentRange string
+	// Checksums stored by the backend, when known
+	Checksums Checksums
+
+	// Headers the object is served with, as set by FileProperties
+	CacheControl       string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	Expires            time.Time
 }
 
 type FileProperties struct {
-	Metadata     map[string]string
-	CacheControl string
-	ContentType  string
+	Metadata        map[string]string
+	CacheControl    string
+	ContentType     string
+	ContentEncoding string
+	// ContentDisposition is e.g. `attachment; filename="video.mp4"`
+	ContentDisposition string
+	ContentLanguage    string
+	// Expires is the date after which the object is considered stale by caches
+	Expires time.Time
+
+	// The following are only used by S3, and override the defaults set in the
+	// query of the OS URL
+
+	// ACL is the canned ACL, e.g. "private" or "public-read"
+	ACL string
+	// StorageClass is e.g. "STANDARD_IA", "INTELLIGENT_TIERING" or "GLACIER_IR"
+	StorageClass string
+	// ServerSideEncryption is "AES256" for SSE-S3 or "aws:kms" for SSE-KMS
+	ServerSideEncryption string
+	// SSEKMSKeyID is the KMS key used with "aws:kms", the AWS managed key if empty
+	SSEKMSKeyID string
+	// SSECustomerKey is the 256-bit key of SSE-C. Objects are read with the key
+	// set in the OS URL.
+	SSECustomerKey []byte
 }
 
 type SaveDataOutput struct {
 	URL                     string
 	UploaderResponseHeaders http.Header
+	// Key is the final key (path) of the object in the storage
+	Key string
+	// Size is the number of bytes written, or the size of the pinned DAG for IPFS
+	Size        int64
+	ETag        string
+	ContentType string
+	// VersionID is the S3 version ID or the GCS generation of the object, when
+	// the storage keeps versions
+	VersionID string
+	// Checksums of the data computed while it was uploaded
+	Checksums Checksums
+	// CarCID is the CID of the CAR with the root of the data, the last one it was
+	// stored in, for web3.storage
+	CarCID string
 }
 
 var AvailableDrivers = []OSDriver{
+	&AzureOS{},
 	&FSOS{},
 	&GsOS{},
+	&HTTPOS{},
 	&IpfsOS{},
+	&KuboOS{},
 	&MemoryOS{},
 	&S3OS{},
+	&SFTPOS{},
 	&W3sOS{},
 }
 
@@ -111,6 +161,16 @@ type S3OSInfo struct {
 	Signature string `protobuf:"bytes,4,opt,name=signature,proto3" json:"signature,omitempty"`
 	// Needed for POST policy.
 	Credential string `protobuf:"bytes,5,opt,name=credential,proto3" json:"credential,omitempty"`
+	// Session token of the temporary credentials the POST policy is signed with.
+	SecurityToken string `json:"securityToken,omitempty"`
+	// SAS token giving write access to the Azure Blob Storage container.
+	SAS string `json:"sas,omitempty"`
+	// Canned ACL, storage class and server-side encryption required by the POST
+	// policy. POST policies aren't given with SSE-C, which would expose the key.
+	ACL                  string `json:"acl,omitempty"`
+	StorageClass         string `json:"storageClass,omitempty"`
+	ServerSideEncryption string `json:"serverSideEncryption,omitempty"`
+	SSEKMSKeyID          string `json:"sseKmsKeyId,omitempty"`
 	// Needed for POST policy.
 	XAmzDate             string   `protobuf:"bytes,6,opt,name=xAmzDate,proto3" json:"xAmzDate,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -133,8 +193,31 @@ const (
 	OSInfo_DIRECT OSInfo_StorageType = 0
 	OSInfo_S3     OSInfo_StorageType = 1
 	OSInfo_GOOGLE OSInfo_StorageType = 2
+	OSInfo_AZURE  OSInfo_StorageType = 3
 )
 
+// Stater is implemented by the sessions able to return the properties of an
+// object without reading its data
+type Stater interface {
+	// Stat returns the properties of the object, without Body
+	Stat(ctx context.Context, name string) (*FileInfoReader, error)
+}
+
+// Stat returns the properties of the object name, without Body. The data of the
+// object is read and discarded if sess is not a Stater.
+func Stat(ctx context.Context, sess OSSession, name string) (*FileInfoReader, error) {
+	if stater, ok := sess.(Stater); ok {
+		return stater.Stat(ctx, name)
+	}
+	fi, err := sess.ReadData(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	fi.Body.Close()
+	fi.Body = nil
+	return fi, nil
+}
+
 type OSSession interface {
 	OS() OSDriver
 
@@ -190,6 +273,16 @@ func TypeByExtension(ext string) (string, error) {
 	return m, nil
 }
 
+// propertiesContentType returns the content type set in fields, or the one derived
+// from the extension of name if not set
+func propertiesContentType(name string, fields *FileProperties) string {
+	if fields != nil && fields.ContentType != "" {
+		return fields.ContentType
+	}
+	ct, _ := TypeByExtension(path.Ext(name))
+	return ct
+}
+
 // NewSession returns new session based on OSInfo received from the network
 func NewSession(info *OSInfo) OSSession {
 	if info == nil {
@@ -200,6 +293,8 @@ func NewSession(info *OSInfo) OSSession {
 		return newS3Session(info.S3Info)
 	case OSInfo_GOOGLE:
 		return newGSSession(info.S3Info)
+	case OSInfo_AZURE:
+		return newAzureSession(info.S3Info)
 	}
 	return nil
 }
@@ -233,70 +328,64 @@ func PrepareOSURL(input string) (string, error) {
 
 // ParseOSURL returns the correct OS for a given OS url
 func ParseOSURL(input string, useFullAPI bool) (OSDriver, error) {
-	u, err := url.Parse(input)
-	if err != nil {
+	var u OSURL
+	if err := u.Parse(input); err != nil {
 		return nil, err
 	}
-	isAws := u.Scheme == "s3"
-	isS3 := u.Scheme == "s3+http" || u.Scheme == "s3+https"
-	isSSL := strings.Contains(u.Scheme, "https")
-	if isAws || isS3 {
-		pw, ok := u.User.Password()
-		if !ok {
-			return nil, fmt.Errorf("password is required with s3:// OS")
-		}
-		// bucket immediately follows domain name, the rest is key
-		splits := splitNonEmpty(u.Path, '/')
-		if len(splits) == 0 {
-			return nil, errors.New("S3 bucket not found in URL path")
-		}
-		bucket := splits[0]
-		// need to get first sep position, ignoring leading sep
-		sepIndex := strings.Index(u.Path[1:], "/")
-		keyPrefix := ""
-		if sepIndex != -1 {
-			keyPrefix = u.Path[sepIndex+2:]
+	return newOSDriver(&u, useFullAPI)
+}
+
+func newOSDriver(u *OSURL, useFullAPI bool) (OSDriver, error) {
+	switch u.Scheme {
+	case "profile":
+		profile, err := lookupStorageProfile(u.Host)
+		if err != nil {
+			return nil, err
 		}
-		if isAws {
-			return NewS3Driver(u.Host, bucket, u.User.Username(), pw, keyPrefix, useFullAPI)
-		} else {
-			return NewCustomS3Driver(u.Host, bucket, u.User.Username(), pw, keyPrefix, useFullAPI, isSSL)
+		osURL, err := profile.OSURL(u.Path)
+		if err != nil {
+			return nil, err
 		}
-	}
-	if u.Scheme == "ipfs" {
-		// make it explicit that it's Pinata API, not IPFS node
-		if u.Host == "pinata.cloud" {
-			password, _ := u.User.Password()
-			return NewIpfsDriver(u.User.Username(), password), nil
-		} else {
-			return nil, fmt.Errorf("unsupported IPFS provider: %s", u.Host)
+		return ParseOSURL(osURL, useFullAPI)
+	case "s3":
+		return newS3Driver(u, useFullAPI)
+	case "s3+http", "s3+https":
+		return newCustomS3Driver(u, useFullAPI)
+	case "ipfs":
+		return newIpfsDriver(u)
+	case "ipfs+http", "ipfs+https":
+		return newKuboDriver(u)
+	case "azblob":
+		return newAzureDriver(u)
+	case "http", "https", "webdav", "webdav+http":
+		return newHTTPDriver(u)
+	case "sftp":
+		return newSFTPDriver(u)
+	case "gs":
+		// without key the Application Default Credentials are used, and signing
+		// is done through IAM as the serviceAccount or the one of the GCE instance
+		return newGoogleDriver(u, useFullAPI)
+	case "memory":
+		if !Testing {
+			break
 		}
-	}
-	if u.Scheme == "gs" {
-		file := u.User.Username()
-		return NewGoogleDriver(u.Host, file, useFullAPI)
-	}
-	if u.Scheme == "memory" && Testing {
 		testMemoryStoragesLock.Lock()
+		defer testMemoryStoragesLock.Unlock()
 		if TestMemoryStorages == nil {
 			TestMemoryStorages = make(map[string]*MemoryOS)
 		}
 		os, ok := TestMemoryStorages[u.Host]
 		if !ok {
 			os = NewMemoryDriver(nil)
+			os.config = u.clone()
 			TestMemoryStorages[u.Host] = os
 		}
-		testMemoryStoragesLock.Unlock()
 		return os, nil
-	}
-	if u.Scheme == "" {
-		return NewFSDriver(u), nil
-	}
-	if u.Scheme == "file" {
-		u.Scheme = ""
-		return NewFSDriver(u), nil
-	}
-	if u.Scheme == "w3s" {
+	case "", "file":
+		os := NewFSDriver(&url.URL{Path: u.Path})
+		os.config = u.clone()
+		return os, nil
+	case "w3s":
 		_, present := os.LookupEnv("W3_PRINCIPAL_KEY")
 		if !present {
 			return nil, fmt.Errorf("env variable 'W3_PRINCIPAL_KEY' is not defined")
@@ -305,14 +394,28 @@ func ParseOSURL(input string, useFullAPI bool) (OSDriver, error) {
 		// W3S URL format: 'w3s://proof@pubId/path'
 		// Proof is base64url-encoded
 		// pubId must be a unique value used until Publish() is called
-		w3sUcanProof := u.User.Username()
-		pubId := u.Hostname()
-		filePath := u.Path
-		return NewW3sDriver(w3sUcanProof, filePath, pubId), nil
+		// The files are read from the gateway query parameter, and their
+		// blocks verified with verify=true
+		os := NewW3sDriver(u.User, u.Path, u.Host)
+		if gateway := u.Query.Get("gateway"); gateway != "" {
+			os.gateway = strings.TrimSuffix(gateway, "/") + "/"
+		}
+		os.verify = u.Query.Get("verify") == "true"
+		os.config = u.clone()
+		return os, nil
 	}
 	return nil, fmt.Errorf("unrecognized OS scheme: %s", u.Scheme)
 }
 
+// escapeObjectPath escapes the segments of the object name for URL paths
+func escapeObjectPath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
 // SaveRetried tries to SaveData specified number of times
 func SaveRetried(ctx context.Context, sess OSSession, name string, data []byte, fields *FileProperties, retryCount int) (*SaveDataOutput, error) {
 	if retryCount < 1 {
@@ -329,9 +432,51 @@ func SaveRetried(ctx context.Context, sess OSSession, name string, data []byte,
 	return out, err
 }
 
-var httpc = &http.Client{
-	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
-	Timeout:   1,
+// parseByteRange parses a single HTTP byte range, as passed to ReadDataRange, e.g.
+// "bytes=0-99" or "bytes=100-". For open ranges the returned end is -1. Suffix
+// ranges, e.g. "bytes=-100", are returned with a negative start and end -1.
+func parseByteRange(byteRange string) (start, end int64, err error) {
+	spec := strings.TrimSpace(byteRange)
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	from, to, found := strings.Cut(strings.TrimPrefix(spec, "bytes="), "-")
+	if !found || (from == "" && to == "") {
+		return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	if from == "" {
+		suffix, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+		}
+		return -suffix, -1, nil
+	}
+	start, err = strconv.ParseInt(from, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	end = -1
+	if to != "" {
+		end, err = strconv.ParseInt(to, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+		}
+	}
+	return start, end, nil
+}
+
+// contentRangeTotal returns the complete length from a Content-Range value such as
+// "bytes 0-99/1000", or -1 if it is unknown.
+func contentRangeTotal(contentRange string) int64 {
+	i := strings.LastIndex(contentRange, "/")
+	if i == -1 {
+		return -1
+	}
+	total, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
 }
 
 func splitNonEmpty(str string, sep rune) []string {
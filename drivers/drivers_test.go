@@ -172,6 +172,13 @@ func TestW3sURL(t *testing.T) {
 	assert.Equal(proof, w3s.ucanProof)
 	assert.Equal(pubId, w3s.pubId)
 	assert.Equal(path, w3s.dirPath)
+	assert.Equal("https://w3s.link/ipfs/", w3s.gateway)
+	assert.False(w3s.verify)
+
+	os, err = ParseOSURL(fmt.Sprintf("w3s://%s@%s%s?gateway=https://ipfs.io/ipfs&verify=true", proof, pubId, path), false)
+	assert.NoError(err)
+	assert.Equal("https://ipfs.io/ipfs/", os.(*W3sOS).gateway)
+	assert.True(os.(*W3sOS).verify)
 }
 
 func TestDescribeDriversJson(t *testing.T) {
@@ -206,3 +213,32 @@ func TestItChoosesTheCorrectContentTypes(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "application/json", extType)
 }
+
+func TestParseByteRange(t *testing.T) {
+	require := require.New(t)
+	cases := []struct {
+		in         string
+		start, end int64
+		err        bool
+	}{
+		{in: "bytes=0-99", start: 0, end: 99},
+		{in: "bytes=100-", start: 100, end: -1},
+		{in: "bytes=-100", start: -100, end: -1},
+		{in: "bytes=10-5", err: true},
+		{in: "bytes=0-1,5-6", err: true},
+		{in: "0-99", err: true},
+		{in: "bytes=-", err: true},
+	}
+	for _, c := range cases {
+		start, end, err := parseByteRange(c.in)
+		if c.err {
+			require.Error(err, c.in)
+			continue
+		}
+		require.NoError(err, c.in)
+		require.Equal(c.start, start, c.in)
+		require.Equal(c.end, end, c.in)
+	}
+	require.Equal(int64(1000), contentRangeTotal("bytes 0-99/1000"))
+	require.Equal(int64(-1), contentRangeTotal("bytes 0-99/*"))
+}
@@ -0,0 +1,564 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// encryptionChunkSize is the size of the plaintext chunks sealed separately, so
+	// that byte ranges can be decrypted without reading the whole object.
+	encryptionChunkSize = 64 * 1024
+	encryptionAlgorithm = "AES256-GCM-CHUNKED"
+	// encryptionNoncePrefixSize random bytes start the nonce of every chunk, the
+	// remaining 8 bytes are the chunk index.
+	encryptionNoncePrefixSize = 4
+	dataKeySize               = 32
+	gcmTagSize                = 16
+
+	// metadata keys describing how the object was encrypted
+	metaEncryptionAlgorithm = "encryption-algorithm"
+	metaEncryptionKeyID     = "encryption-key-id"
+	metaEncryptionKey       = "encryption-key"
+	metaEncryptionNonce     = "encryption-nonce"
+	metaEncryptionChunkSize = "encryption-chunk-size"
+)
+
+var ErrNotEncrypted = errors.New("object is not encrypted")
+
+// KeyProvider wraps and unwraps the per-object data keys with key encryption keys.
+// New data keys are wrapped with the current key, and the ID of the key is stored
+// along the object, so previous keys can still be unwrapped after a rotation.
+type KeyProvider interface {
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider holding 256-bit key encryption keys in memory
+type StaticKeyProvider struct {
+	mu        sync.RWMutex
+	currentID string
+	keys      map[string][]byte
+}
+
+var _ KeyProvider = (*StaticKeyProvider)(nil)
+
+// NewStaticKeyProvider returns a key provider wrapping data keys with the key identified by currentID
+func NewStaticKeyProvider(currentID string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	kp := &StaticKeyProvider{keys: make(map[string][]byte)}
+	for id, key := range keys {
+		if err := kp.AddKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := kp.Rotate(currentID); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// AddKey makes the key available for unwrapping
+func (kp *StaticKeyProvider) AddKey(id string, key []byte) error {
+	if len(key) != dataKeySize {
+		return fmt.Errorf("key %s must be %d bytes long", id, dataKeySize)
+	}
+	kp.mu.Lock()
+	kp.keys[id] = key
+	kp.mu.Unlock()
+	return nil
+}
+
+// Rotate makes the key identified by id the one new data keys are wrapped with
+func (kp *StaticKeyProvider) Rotate(id string) error {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if _, ok := kp.keys[id]; !ok {
+		return fmt.Errorf("unknown key %s", id)
+	}
+	kp.currentID = id
+	return nil
+}
+
+func (kp *StaticKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	kp.mu.RLock()
+	id, kek := kp.currentID, kp.keys[kp.currentID]
+	kp.mu.RUnlock()
+	aead, err := newGCM(kek)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return id, aead.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+func (kp *StaticKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	kp.mu.RLock()
+	kek, ok := kp.keys[keyID]
+	kp.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var _ OSSession = (*EncryptedSession)(nil)
+
+// EncryptedSession encrypts the data before it is handed over to the wrapped
+// session and decrypts it transparently on reads. Every object is encrypted with
+// its own data key, in chunks of encryptionChunkSize sealed with AES-GCM. The data
+// key, wrapped by the KeyProvider, is stored in the object Metadata, so the
+// wrapped session must persist it.
+//
+// Sizes reported by ListFiles are the sizes of the encrypted objects.
+type EncryptedSession struct {
+	OSSession
+	keys KeyProvider
+}
+
+// NewEncryptedSession returns a session encrypting everything saved to sess
+func NewEncryptedSession(sess OSSession, keys KeyProvider) *EncryptedSession {
+	return &EncryptedSession{OSSession: sess, keys: keys}
+}
+
+func (es *EncryptedSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	noncePrefix := make([]byte, encryptionNoncePrefixSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := es.keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encFields := &FileProperties{}
+	if fields != nil {
+		*encFields = *fields
+	}
+	encFields.Metadata = make(map[string]string)
+	if fields != nil {
+		for k, v := range fields.Metadata {
+			encFields.Metadata[k] = v
+		}
+	}
+	encFields.Metadata[metaEncryptionAlgorithm] = encryptionAlgorithm
+	encFields.Metadata[metaEncryptionKeyID] = keyID
+	encFields.Metadata[metaEncryptionKey] = base64.StdEncoding.EncodeToString(wrapped)
+	encFields.Metadata[metaEncryptionNonce] = base64.StdEncoding.EncodeToString(noncePrefix)
+	encFields.Metadata[metaEncryptionChunkSize] = strconv.Itoa(encryptionChunkSize)
+	if encFields.ContentType == "" {
+		// the wrapped session can't sniff the content type of encrypted data
+		encFields.ContentType = "application/octet-stream"
+		if ct, err := TypeByExtension(path.Ext(name)); err == nil {
+			encFields.ContentType = ct
+		}
+	}
+
+	enc := &encryptReader{
+		src:         data,
+		aead:        aead,
+		noncePrefix: noncePrefix,
+		chunkSize:   encryptionChunkSize,
+	}
+	return es.OSSession.SaveData(ctx, name, enc, encFields, timeout)
+}
+
+func (es *EncryptedSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	fi, err := es.OSSession.ReadData(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	params, err := es.objectParams(ctx, fi.Metadata)
+	if err != nil {
+		fi.Body.Close()
+		return nil, err
+	}
+	if fi.Size != nil {
+		size := params.plainSize(*fi.Size)
+		fi.Size = &size
+	}
+	fi.Metadata = stripEncryptionMetadata(fi.Metadata)
+	fi.Body = &decryptReader{src: fi.Body, params: params, strictEnd: true}
+	return fi, nil
+}
+
+// ReadDataRange reads and decrypts only the chunks covering byteRange. Suffix
+// ranges are not supported. If the wrapped session does not support ranges, the
+// whole object is read and the preceding chunks are skipped.
+func (es *EncryptedSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	if byteRange == "" {
+		return es.ReadData(ctx, name)
+	}
+	start, end, err := parseByteRange(byteRange)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return nil, ErrNotSupported
+	}
+	// chunk size is not known before reading the metadata, assume the default one
+	// and verify it matches once the response arrives
+	sealedChunk := int64(encryptionChunkSize + gcmTagSize)
+	firstChunk := start / encryptionChunkSize
+	encRange := fmt.Sprintf("bytes=%d-", firstChunk*sealedChunk)
+	if end >= 0 {
+		lastChunk := end / encryptionChunkSize
+		encRange += strconv.FormatInt((lastChunk+1)*sealedChunk-1, 10)
+	}
+	fi, err := es.OSSession.ReadDataRange(ctx, name, encRange)
+	fullRead := false
+	if err == ErrNotSupported {
+		fi, err = es.OSSession.ReadData(ctx, name)
+		fullRead = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	params, err := es.objectParams(ctx, fi.Metadata)
+	if err == nil && params.chunkSize != encryptionChunkSize {
+		err = fmt.Errorf("ranges are not supported for objects encrypted with chunk size %d", params.chunkSize)
+	}
+	if err != nil {
+		fi.Body.Close()
+		return nil, err
+	}
+	if fullRead {
+		if _, err := io.CopyN(io.Discard, fi.Body, firstChunk*sealedChunk); err != nil {
+			fi.Body.Close()
+			return nil, err
+		}
+	}
+
+	total := int64(-1)
+	if fi.ContentRange != "" {
+		if encTotal := contentRangeTotal(fi.ContentRange); encTotal >= 0 {
+			total = params.plainSize(encTotal)
+		}
+	} else if fullRead && fi.Size != nil {
+		total = params.plainSize(*fi.Size)
+	}
+	if total >= 0 && (end < 0 || end >= total) {
+		end = total - 1
+	}
+	dec := &decryptReader{
+		src:    fi.Body,
+		params: params,
+		index:  uint64(firstChunk),
+		// the read ends before the end of the object only for bounded ranges
+		strictEnd: total >= 0 && end == total-1,
+	}
+	res := &FileInfoReader{
+		FileInfo:    fi.FileInfo,
+		Metadata:    stripEncryptionMetadata(fi.Metadata),
+		ContentType: fi.ContentType,
+	}
+	res.Body = &rangeReadCloser{
+		Reader: io.LimitReader(&skipReader{r: dec, skip: start - firstChunk*encryptionChunkSize}, rangeLen(start, end)),
+		Closer: fi.Body,
+	}
+	if end >= 0 {
+		size := end - start + 1
+		res.Size = &size
+	} else {
+		res.Size = nil
+	}
+	if total >= 0 {
+		res.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, total)
+	}
+	return res, nil
+}
+
+func rangeLen(start, end int64) int64 {
+	if end < 0 {
+		return 1<<63 - 1
+	}
+	return end - start + 1
+}
+
+type rangeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type skipReader struct {
+	r    io.Reader
+	skip int64
+}
+
+func (s *skipReader) Read(p []byte) (int, error) {
+	if s.skip > 0 {
+		if _, err := io.CopyN(io.Discard, s.r, s.skip); err != nil {
+			return 0, err
+		}
+		s.skip = 0
+	}
+	return s.r.Read(p)
+}
+
+type encryptionParams struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	chunkSize   int
+}
+
+// plainSize returns the size of the plaintext encrypted into encSize bytes
+func (p *encryptionParams) plainSize(encSize int64) int64 {
+	sealed := int64(p.chunkSize + gcmTagSize)
+	chunks := (encSize + sealed - 1) / sealed
+	if chunks == 0 {
+		return 0
+	}
+	return encSize - chunks*gcmTagSize
+}
+
+func (es *EncryptedSession) objectParams(ctx context.Context, metadata map[string]string) (*encryptionParams, error) {
+	alg := metadataValue(metadata, metaEncryptionAlgorithm)
+	if alg == "" {
+		return nil, ErrNotEncrypted
+	}
+	if alg != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", alg)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadataValue(metadata, metaEncryptionKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+	noncePrefix, err := base64.StdEncoding.DecodeString(metadataValue(metadata, metaEncryptionNonce))
+	if err != nil || len(noncePrefix) != encryptionNoncePrefixSize {
+		return nil, errors.New("invalid encryption nonce")
+	}
+	chunkSize, err := strconv.Atoi(metadataValue(metadata, metaEncryptionChunkSize))
+	if err != nil || chunkSize <= 0 {
+		return nil, errors.New("invalid encryption chunk size")
+	}
+	dataKey, err := es.keys.UnwrapKey(ctx, metadataValue(metadata, metaEncryptionKeyID), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionParams{aead: aead, noncePrefix: noncePrefix, chunkSize: chunkSize}, nil
+}
+
+// metadataValue looks up a metadata key case-insensitively, as some storages
+// change the case of the keys
+func metadataValue(metadata map[string]string, key string) string {
+	if v, ok := metadata[key]; ok {
+		return v
+	}
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+func stripEncryptionMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return metadata
+	}
+	res := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if !strings.HasPrefix(strings.ToLower(k), "encryption-") {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func chunkNonce(prefix []byte, index uint64) []byte {
+	nonce := make([]byte, encryptionNoncePrefixSize+8)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint64(nonce[encryptionNoncePrefixSize:], index)
+	return nonce
+}
+
+// chunkAAD binds the chunk position and whether it is the last one, so chunks
+// can't be reordered and the object can't be truncated unnoticed
+func chunkAAD(index uint64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, index)
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+type encryptReader struct {
+	src         io.Reader
+	aead        cipher.AEAD
+	noncePrefix []byte
+	chunkSize   int
+	index       uint64
+	pending     []byte
+	out         bytes.Buffer
+	done        bool
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for er.out.Len() == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	return er.out.Read(p)
+}
+
+// sealNext encrypts the next chunk. One byte over the chunk size is read ahead to
+// find out whether the chunk is the final one.
+func (er *encryptReader) sealNext() error {
+	want := er.chunkSize + 1
+	if cap(er.pending) < want {
+		pending := make([]byte, len(er.pending), want)
+		copy(pending, er.pending)
+		er.pending = pending
+	}
+	n, err := io.ReadFull(er.src, er.pending[len(er.pending):want])
+	er.pending = er.pending[:len(er.pending)+n]
+	final := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		final = true
+	} else if err != nil {
+		return err
+	}
+	chunk := er.pending
+	if !final {
+		chunk = er.pending[:er.chunkSize]
+	}
+	sealed := er.aead.Seal(nil, chunkNonce(er.noncePrefix, er.index), chunk, chunkAAD(er.index, final))
+	er.out.Write(sealed)
+	er.index++
+	if final {
+		er.done = true
+		er.pending = er.pending[:0]
+	} else {
+		rest := copy(er.pending, er.pending[er.chunkSize:])
+		er.pending = er.pending[:rest]
+	}
+	return nil
+}
+
+type decryptReader struct {
+	src    io.ReadCloser
+	params *encryptionParams
+	index  uint64
+	// strictEnd requires the last chunk read to be the final chunk of the object
+	strictEnd bool
+	pending   []byte
+	out       bytes.Buffer
+	done      bool
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for dr.out.Len() == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	return dr.out.Read(p)
+}
+
+func (dr *decryptReader) openNext() error {
+	sealedSize := dr.params.chunkSize + gcmTagSize
+	want := sealedSize + 1
+	if cap(dr.pending) < want {
+		pending := make([]byte, len(dr.pending), want)
+		copy(pending, dr.pending)
+		dr.pending = pending
+	}
+	n, err := io.ReadFull(dr.src, dr.pending[len(dr.pending):want])
+	dr.pending = dr.pending[:len(dr.pending)+n]
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+	if last && len(dr.pending) == 0 {
+		if dr.strictEnd {
+			return io.ErrUnexpectedEOF
+		}
+		dr.done = true
+		return nil
+	}
+	chunk := dr.pending
+	if !last {
+		chunk = dr.pending[:sealedSize]
+	}
+	nonce := chunkNonce(dr.params.noncePrefix, dr.index)
+	var plain []byte
+	if last {
+		plain, err = dr.params.aead.Open(nil, nonce, chunk, chunkAAD(dr.index, true))
+		if err != nil && !dr.strictEnd {
+			// a bounded range may end on any chunk
+			plain, err = dr.params.aead.Open(nil, nonce, chunk, chunkAAD(dr.index, false))
+		}
+	} else {
+		plain, err = dr.params.aead.Open(nil, nonce, chunk, chunkAAD(dr.index, false))
+	}
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %d: %w", dr.index, err)
+	}
+	dr.out.Write(plain)
+	dr.index++
+	if last {
+		dr.done = true
+		dr.pending = dr.pending[:0]
+	} else {
+		rest := copy(dr.pending, dr.pending[sealedSize:])
+		dr.pending = dr.pending[:rest]
+	}
+	return nil
+}
+
+func (dr *decryptReader) Close() error {
+	return dr.src.Close()
+}
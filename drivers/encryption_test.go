@@ -0,0 +1,135 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyProvider(t *testing.T) *StaticKeyProvider {
+	key1, key2 := make([]byte, 32), make([]byte, 32)
+	rand.Read(key1)
+	rand.Read(key2)
+	kp, err := NewStaticKeyProvider("k1", map[string][]byte{"k1": key1, "k2": key2})
+	require.NoError(t, err)
+	return kp
+}
+
+func TestEncryptedSessionRoundTrip(t *testing.T) {
+	require := require.New(t)
+	backend := newFakeSession()
+	es := NewEncryptedSession(backend, testKeyProvider(t))
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, 3*encryptionChunkSize + 17} {
+		name := fmt.Sprintf("rec/%d.ts", size)
+		data := make([]byte, size)
+		rand.Read(data)
+		_, err := es.SaveData(context.Background(), name, bytes.NewReader(data), &FileProperties{Metadata: map[string]string{"stream": "abc"}}, 0)
+		require.NoError(err)
+
+		stored := backend.get(name)
+		if size >= 16 {
+			require.False(bytes.Contains(stored, data))
+		}
+		chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+		require.Equal(size+chunks*gcmTagSize, len(stored))
+		require.Equal("video/mp2t", backend.objects[name].fields.ContentType)
+
+		fi, err := es.ReadData(context.Background(), name)
+		require.NoError(err)
+		require.Equal(int64(size), *fi.Size)
+		require.Equal(map[string]string{"stream": "abc"}, fi.Metadata)
+		got, err := ioutil.ReadAll(fi.Body)
+		require.NoError(err)
+		require.Equal(data, got)
+	}
+}
+
+func TestEncryptedSessionRanges(t *testing.T) {
+	require := require.New(t)
+	backend := newFakeSession()
+	es := NewEncryptedSession(backend, testKeyProvider(t))
+	data := make([]byte, 3*encryptionChunkSize+100)
+	rand.Read(data)
+	_, err := es.SaveData(context.Background(), "big.mp4", bytes.NewReader(data), nil, 0)
+	require.NoError(err)
+
+	total := int64(len(data))
+	cases := []struct{ start, end int64 }{
+		{0, 9},
+		{10, encryptionChunkSize + 5},
+		{encryptionChunkSize, 2*encryptionChunkSize - 1},
+		{2*encryptionChunkSize + 3, total - 1},
+		{total - 10, -1},
+	}
+	for _, noRanges := range []bool{false, true} {
+		backend.noRanges = noRanges
+		for _, c := range cases {
+			byteRange := fmt.Sprintf("bytes=%d-", c.start)
+			end := c.end
+			if c.end >= 0 {
+				byteRange += fmt.Sprint(c.end)
+			} else {
+				end = total - 1
+			}
+			fi, err := es.ReadDataRange(context.Background(), "big.mp4", byteRange)
+			require.NoError(err, byteRange)
+			got, err := ioutil.ReadAll(fi.Body)
+			require.NoError(err, byteRange)
+			require.Equal(data[c.start:end+1], got, byteRange)
+			require.Equal(fmt.Sprintf("bytes %d-%d/%d", c.start, end, total), fi.ContentRange)
+		}
+	}
+}
+
+func TestEncryptedSessionKeyRotation(t *testing.T) {
+	require := require.New(t)
+	backend := newFakeSession()
+	kp := testKeyProvider(t)
+	es := NewEncryptedSession(backend, kp)
+
+	_, err := es.SaveData(context.Background(), "old.json", bytes.NewReader([]byte("old")), nil, 0)
+	require.NoError(err)
+	require.NoError(kp.Rotate("k2"))
+	_, err = es.SaveData(context.Background(), "new.json", bytes.NewReader([]byte("new")), nil, 0)
+	require.NoError(err)
+	require.Equal("k1", backend.objects["old.json"].fields.Metadata[metaEncryptionKeyID])
+	require.Equal("k2", backend.objects["new.json"].fields.Metadata[metaEncryptionKeyID])
+
+	for name, expected := range map[string]string{"old.json": "old", "new.json": "new"} {
+		fi, err := es.ReadData(context.Background(), name)
+		require.NoError(err)
+		got, err := ioutil.ReadAll(fi.Body)
+		require.NoError(err)
+		require.Equal(expected, string(got))
+	}
+}
+
+func TestEncryptedSessionDetectsTampering(t *testing.T) {
+	require := require.New(t)
+	backend := newFakeSession()
+	es := NewEncryptedSession(backend, testKeyProvider(t))
+	data := make([]byte, 2*encryptionChunkSize)
+	_, err := es.SaveData(context.Background(), "a.ts", bytes.NewReader(data), nil, 0)
+	require.NoError(err)
+
+	// truncating the object at a chunk boundary must be detected
+	obj := backend.objects["a.ts"]
+	obj.data = obj.data[:encryptionChunkSize+gcmTagSize]
+	fi, err := es.ReadData(context.Background(), "a.ts")
+	require.NoError(err)
+	_, err = ioutil.ReadAll(fi.Body)
+	require.ErrorContains(err, "error decrypting chunk 0")
+
+	backend.put("plain.ts", data)
+	_, err = es.ReadData(context.Background(), "plain.ts")
+	require.ErrorIs(err, ErrNotEncrypted)
+}
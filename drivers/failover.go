@@ -0,0 +1,440 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/livepeer/go-tools/clients"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// failoverMaxReplayBuffer is the amount of non-seekable SaveData input kept in
+	// memory so the upload can be replayed to the next backend.
+	failoverMaxReplayBuffer = 64 * 1024 * 1024
+	// circuitFailureThreshold consecutive failures open the circuit of a backend
+	circuitFailureThreshold = 3
+	// circuitCooldown is how long an open circuit rejects calls before a trial call is let through
+	circuitCooldown = 30 * time.Second
+)
+
+var errReplayBufferExceeded = errors.New("upload too large to be replayed on another backend")
+
+var _ OSSession = (*FailoverSession)(nil)
+
+// FailoverSession writes to the primary backend and falls back to the secondary
+// ones when a write fails with a retryable error. The backend each object landed
+// on is recorded, so reads try the known location first and the others after it.
+// Every backend is guarded by a circuit breaker, so a backend in an outage is
+// skipped until its cooldown passes.
+type FailoverSession struct {
+	backends []*failoverBackend
+
+	mu        sync.RWMutex
+	locations map[string]int
+}
+
+type failoverBackend struct {
+	sess    OSSession
+	breaker *circuitBreaker
+}
+
+// NewFailoverSession returns a session using primary and failing over to the
+// secondary sessions, in order.
+func NewFailoverSession(primary OSSession, secondaries ...OSSession) *FailoverSession {
+	fs := &FailoverSession{locations: make(map[string]int)}
+	for _, sess := range append([]OSSession{primary}, secondaries...) {
+		fs.backends = append(fs.backends, &failoverBackend{
+			sess:    sess,
+			breaker: newCircuitBreaker(circuitFailureThreshold, circuitCooldown),
+		})
+	}
+	return fs
+}
+
+// Location returns the index of the backend the object was written to, 0 being the primary
+func (fs *FailoverSession) Location(name string) (int, bool) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	idx, ok := fs.locations[name]
+	return idx, ok
+}
+
+// Healthy returns whether the circuit of each backend is currently closed
+func (fs *FailoverSession) Healthy() []bool {
+	res := make([]bool, len(fs.backends))
+	for i, b := range fs.backends {
+		res[i] = b.breaker.State() == circuitClosed
+	}
+	return res
+}
+
+func (fs *FailoverSession) OS() OSDriver {
+	return fs.backends[0].sess.OS()
+}
+
+func (fs *FailoverSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	replay := newReplayReader(data)
+	var (
+		out     *SaveDataOutput
+		lastErr error
+	)
+	fs.attempt(-1, func(idx int) bool {
+		b := fs.backends[idx]
+		if lastErr != nil {
+			if err := replay.rewind(); err != nil {
+				lastErr = fmt.Errorf("%v, failover failed: %w", lastErr, err)
+				return true
+			}
+		}
+		res, err := b.sess.SaveData(ctx, name, replay, fields, timeout)
+		if err == nil {
+			b.breaker.Success()
+			fs.mu.Lock()
+			fs.locations[name] = idx
+			fs.mu.Unlock()
+			out, lastErr = res, nil
+			return true
+		}
+		lastErr = err
+		if !IsRetryableError(err) || ctx.Err() != nil {
+			return true
+		}
+		b.breaker.Failure()
+		return false
+	})
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return out, nil
+}
+
+// attempt calls try with the backends, starting with the preferred one, until it
+// returns true. The circuit of a backend is only checked right before it's tried,
+// so the trial call of a half-open circuit isn't used up by a backend that's never
+// called. Backends with an open circuit are skipped, unless no other backend is
+// available.
+func (fs *FailoverSession) attempt(preferred int, try func(idx int) bool) {
+	order := make([]int, 0, len(fs.backends))
+	if preferred >= 0 && preferred < len(fs.backends) {
+		order = append(order, preferred)
+	}
+	for idx := range fs.backends {
+		if idx != preferred {
+			order = append(order, idx)
+		}
+	}
+	tried := false
+	for _, idx := range order {
+		if !fs.backends[idx].breaker.Allow() {
+			continue
+		}
+		tried = true
+		if try(idx) {
+			return
+		}
+	}
+	if tried {
+		return
+	}
+	for _, idx := range order {
+		if try(idx) {
+			return
+		}
+	}
+}
+
+func (fs *FailoverSession) EndSession() {
+	for _, b := range fs.backends {
+		b.sess.EndSession()
+	}
+}
+
+func (fs *FailoverSession) GetInfo() *OSInfo {
+	return fs.backends[0].sess.GetInfo()
+}
+
+func (fs *FailoverSession) sessionKey() string {
+	if ks, ok := fs.backends[0].sess.(keyedSession); ok {
+		return ks.sessionKey()
+	}
+	return ""
+}
+
+func (fs *FailoverSession) IsExternal() bool {
+	return fs.backends[0].sess.IsExternal()
+}
+
+func (fs *FailoverSession) IsOwn(url string) bool {
+	for _, b := range fs.backends {
+		if b.sess.IsOwn(url) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FailoverSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	var (
+		pi      PageInfo
+		lastErr error
+	)
+	fs.attempt(0, func(idx int) bool {
+		pi, lastErr = fs.backends[idx].sess.ListFiles(ctx, prefix, delim)
+		if lastErr == nil || !IsRetryableError(lastErr) {
+			return true
+		}
+		fs.backends[idx].breaker.Failure()
+		return false
+	})
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return pi, nil
+}
+
+// DeleteFile deletes the object from the backend it is known to be stored on, or
+// from the primary if its location is unknown.
+func (fs *FailoverSession) DeleteFile(ctx context.Context, name string) error {
+	idx, ok := fs.Location(name)
+	if !ok {
+		idx = 0
+	}
+	if err := fs.backends[idx].sess.DeleteFile(ctx, name); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	delete(fs.locations, name)
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *FailoverSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return fs.read(ctx, name, func(sess OSSession) (*FileInfoReader, error) {
+		return sess.ReadData(ctx, name)
+	})
+}
+
+func (fs *FailoverSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	return fs.read(ctx, name, func(sess OSSession) (*FileInfoReader, error) {
+		return sess.ReadDataRange(ctx, name, byteRange)
+	})
+}
+
+// read tries the known location of the object first, then the other backends
+func (fs *FailoverSession) read(ctx context.Context, name string, readFn func(OSSession) (*FileInfoReader, error)) (*FileInfoReader, error) {
+	preferred, ok := fs.Location(name)
+	if !ok {
+		preferred = 0
+	}
+	var (
+		fi       *FileInfoReader
+		firstErr error
+	)
+	fs.attempt(preferred, func(idx int) bool {
+		b := fs.backends[idx]
+		res, err := readFn(b.sess)
+		if err == nil {
+			b.breaker.Success()
+			fi = res
+			return true
+		}
+		if firstErr == nil {
+			// error from the most likely location is the most meaningful one
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			return true
+		}
+		if IsRetryableError(err) {
+			b.breaker.Failure()
+		}
+		return false
+	})
+	if fi != nil {
+		return fi, nil
+	}
+	return nil, firstErr
+}
+
+func (fs *FailoverSession) Presign(name string, expire time.Duration) (string, error) {
+	idx, ok := fs.Location(name)
+	if !ok {
+		idx = 0
+	}
+	return fs.backends[idx].sess.Presign(name, expire)
+}
+
+// IsRetryableError returns whether the operation failing with err may succeed
+// when repeated or sent to another backend. Network errors, timeouts and server
+// side (5xx) errors are retryable, client errors are not.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var httpErr *clients.HTTPStatusError
+	if errors.As(err, &httpErr) {
+		return isRetryableStatus(httpErr.Status)
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return isRetryableStatus(gErr.Code)
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return isRetryableStatus(reqErr.StatusCode())
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		// request errors without status, e.g. failed connection
+		return awsErr.Code() == "RequestError" || awsErr.Code() == "RequestTimeout" || awsErr.Code() == "RequestCanceled"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isRetryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+// replayReader allows re-reading SaveData input for another attempt. Seekable
+// input is rewound, otherwise up to failoverMaxReplayBuffer bytes are buffered.
+type replayReader struct {
+	src      io.Reader
+	seeker   io.Seeker
+	start    int64
+	buf      bytes.Buffer
+	replay   *bytes.Reader
+	overflow bool
+}
+
+func newReplayReader(src io.Reader) *replayReader {
+	rr := &replayReader{src: src}
+	if seeker, ok := src.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			rr.seeker = seeker
+			rr.start = start
+		}
+	}
+	return rr
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	if rr.replay != nil && rr.replay.Len() > 0 {
+		return rr.replay.Read(p)
+	}
+	n, err := rr.src.Read(p)
+	if rr.seeker == nil && n > 0 && !rr.overflow {
+		if rr.buf.Len()+n > failoverMaxReplayBuffer {
+			rr.overflow = true
+			rr.buf = bytes.Buffer{}
+		} else {
+			rr.buf.Write(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (rr *replayReader) rewind() error {
+	if rr.seeker != nil {
+		_, err := rr.seeker.Seek(rr.start, io.SeekStart)
+		return err
+	}
+	if rr.overflow {
+		return errReplayBufferExceeded
+	}
+	rr.replay = bytes.NewReader(rr.buf.Bytes())
+	return nil
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker opens after threshold consecutive failures. Once cooldown passes
+// a single trial call is allowed; its result closes or re-opens the circuit. A
+// trial which never reported its result is given up on after another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trialAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (cb *circuitBreaker) state() circuitState {
+	if cb.failures < cb.threshold {
+		return circuitClosed
+	}
+	if time.Since(cb.openedAt) < cb.cooldown {
+		return circuitOpen
+	}
+	return circuitHalfOpen
+}
+
+func (cb *circuitBreaker) State() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state()
+}
+
+// Allow returns whether a call may be made
+func (cb *circuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state() {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		if !cb.trialAt.IsZero() && time.Since(cb.trialAt) < cb.cooldown {
+			return false
+		}
+		cb.trialAt = time.Now()
+		return true
+	}
+	return false
+}
+
+func (cb *circuitBreaker) Success() {
+	cb.mu.Lock()
+	cb.failures = 0
+	cb.trialAt = time.Time{}
+	cb.mu.Unlock()
+}
+
+func (cb *circuitBreaker) Failure() {
+	cb.mu.Lock()
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openedAt = time.Now()
+	}
+	cb.trialAt = time.Time{}
+	cb.mu.Unlock()
+}
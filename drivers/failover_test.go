@@ -0,0 +1,122 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/livepeer/go-tools/clients"
+	"github.com/stretchr/testify/require"
+)
+
+// onceReader hides the Seeker of the underlying reader so the data can't be rewound
+type onceReader struct {
+	r io.Reader
+}
+
+func (o *onceReader) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+func TestFailoverSessionWritesToSecondary(t *testing.T) {
+	require := require.New(t)
+	primary, secondary := newFakeSession(), newFakeSession()
+	primary.setSaveErr(&clients.HTTPStatusError{Status: http.StatusServiceUnavailable})
+	primary.failAfterRead = true
+	fs := NewFailoverSession(primary, secondary)
+
+	inputs := map[string]io.Reader{
+		"seekable.ts":     strings.NewReader("segment"),
+		"non-seekable.ts": &onceReader{strings.NewReader("segment")},
+	}
+	for name, data := range inputs {
+		out, err := fs.SaveData(context.Background(), name, data, nil, 0)
+		require.NoError(err)
+		require.Equal("fake://"+name, out.URL)
+		require.Equal("segment", string(secondary.get(name)))
+		loc, ok := fs.Location(name)
+		require.True(ok)
+		require.Equal(1, loc)
+	}
+
+	// reads go to the known location first
+	fi, err := fs.ReadData(context.Background(), "seekable.ts")
+	require.NoError(err)
+	got, _ := ioutil.ReadAll(fi.Body)
+	require.Equal("segment", string(got))
+	require.Equal(0, primary.reads)
+	require.Equal(1, secondary.reads)
+}
+
+func TestFailoverSessionDoesNotRetryClientErrors(t *testing.T) {
+	require := require.New(t)
+	primary, secondary := newFakeSession(), newFakeSession()
+	primary.setSaveErr(&clients.HTTPStatusError{Status: http.StatusForbidden})
+	fs := NewFailoverSession(primary, secondary)
+
+	_, err := fs.SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.Error(err)
+	require.Equal(0, secondary.saves)
+}
+
+func TestFailoverSessionCircuitBreaker(t *testing.T) {
+	require := require.New(t)
+	primary, secondary := newFakeSession(), newFakeSession()
+	primary.setSaveErr(fmt.Errorf("upload: %w", context.DeadlineExceeded))
+	fs := NewFailoverSession(primary, secondary)
+
+	for i := 0; i < circuitFailureThreshold+2; i++ {
+		_, err := fs.SaveData(context.Background(), fmt.Sprintf("%d.ts", i), strings.NewReader("data"), nil, 0)
+		require.NoError(err)
+	}
+	// the primary is no longer hammered once its circuit opens
+	require.Equal(circuitFailureThreshold, primary.saves)
+	require.Equal([]bool{false, true}, fs.Healthy())
+
+	// after the cooldown a trial call closes the circuit again
+	fs.backends[0].breaker.openedAt = time.Now().Add(-circuitCooldown)
+	primary.setSaveErr(nil)
+	_, err := fs.SaveData(context.Background(), "next.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	require.Equal([]bool{true, true}, fs.Healthy())
+	require.Equal("data", string(primary.get("next.ts")))
+}
+
+func TestFailoverSessionKeepsTrialCall(t *testing.T) {
+	require := require.New(t)
+	primary, secondary := newFakeSession(), newFakeSession()
+	fs := NewFailoverSession(primary, secondary)
+	for i := 0; i < circuitFailureThreshold; i++ {
+		fs.backends[1].breaker.Failure()
+	}
+	fs.backends[1].breaker.openedAt = time.Now().Add(-circuitCooldown)
+
+	// the half-open secondary isn't tried while the primary works
+	_, err := fs.SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	require.Equal(0, secondary.saves)
+
+	// so its trial call is still available when the primary fails
+	primary.setSaveErr(&clients.HTTPStatusError{Status: http.StatusServiceUnavailable})
+	_, err = fs.SaveData(context.Background(), "2.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	require.Equal("data", string(secondary.get("2.ts")))
+	require.Equal([]bool{true, true}, fs.Healthy())
+}
+
+func TestIsRetryableError(t *testing.T) {
+	require := require.New(t)
+	require.False(IsRetryableError(nil))
+	require.False(IsRetryableError(errors.New("bad key")))
+	require.False(IsRetryableError(context.Canceled))
+	require.False(IsRetryableError(&clients.HTTPStatusError{Status: http.StatusNotFound}))
+	require.True(IsRetryableError(&clients.HTTPStatusError{Status: http.StatusBadGateway}))
+	require.True(IsRetryableError(&clients.HTTPStatusError{Status: http.StatusTooManyRequests}))
+	require.True(IsRetryableError(fmt.Errorf("wrapped: %w", context.DeadlineExceeded)))
+}
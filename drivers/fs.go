@@ -2,6 +2,8 @@ package drivers
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
@@ -17,6 +19,7 @@ type FSOS struct {
 	baseURI  *url.URL
 	sessions map[string]*FSSession
 	lock     sync.RWMutex
+	config   *OSURL
 }
 
 var _ OSSession = (*FSSession)(nil)
@@ -30,10 +33,15 @@ type FSSession struct {
 }
 
 func NewFSDriver(baseURI *url.URL) *FSOS {
+	config := &OSURL{Scheme: "file"}
+	if baseURI != nil {
+		config.Path = baseURI.Path
+	}
 	return &FSOS{
 		baseURI:  baseURI,
 		sessions: make(map[string]*FSSession),
 		lock:     sync.RWMutex{},
+		config:   config,
 	}
 }
 
@@ -62,6 +70,10 @@ func (ostore *FSOS) GetSession(path string) *FSSession {
 	return nil
 }
 
+func (ostore *FSOS) Config() *OSURL {
+	return ostore.config.clone()
+}
+
 func (ostore *FSOS) UriSchemes() []string {
 	return []string{""}
 }
@@ -113,6 +125,9 @@ func (ostore *FSSession) ListFiles(ctx context.Context, dir, delim string) (Page
 	}
 	// create metadata
 	for _, f := range files {
+		if isFSPropertiesFile(f.Name()) {
+			continue
+		}
 		if f.IsDir() {
 			pi.directories = append(pi.directories, f.Name())
 		} else {
@@ -129,7 +144,14 @@ func (ostore *FSSession) ListFiles(ctx context.Context, dir, delim string) (Page
 }
 
 func (ostore *FSSession) DeleteFile(ctx context.Context, name string) error {
-	return os.Remove(filepath.Join(ostore.path, name))
+	fullPath := filepath.Join(ostore.path, name)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	if err := os.Remove(fsPropertiesPath(fullPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func (ostore *FSSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
@@ -143,13 +165,53 @@ func (ostore *FSSession) ReadData(ctx context.Context, name string) (*FileInfoRe
 		return nil, err
 	}
 	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	res, err := fsFileInfo(name, fullPath, stat)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	res.Body = file
+	return res, nil
+}
+
+func (ostore *FSSession) Stat(ctx context.Context, name string) (*FileInfoReader, error) {
+	prefix := ""
+	if ostore.os.baseURI != nil {
+		prefix += ostore.os.baseURI.String()
+	}
+	fullPath := path.Join(prefix, name)
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo(name, fullPath, stat)
+}
+
+func fsFileInfo(name, fullPath string, stat os.FileInfo) (*FileInfoReader, error) {
 	size := stat.Size()
 	res := &FileInfoReader{
 		FileInfo: FileInfo{
-			Name: name,
-			Size: &size,
+			Name:         name,
+			Size:         &size,
+			LastModified: stat.ModTime(),
 		},
-		Body: file,
+	}
+	props, err := readFSProperties(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if props != nil {
+		res.Metadata = props.Metadata
+		res.ContentType = props.ContentType
+		res.CacheControl = props.CacheControl
+		res.ContentEncoding = props.ContentEncoding
+		res.ContentDisposition = props.ContentDisposition
+		res.ContentLanguage = props.ContentLanguage
+		res.Expires = props.Expires
 	}
 	return res, nil
 }
@@ -175,6 +237,7 @@ func (ostore *FSSession) GetInfo() *OSInfo {
 }
 
 func (ostore *FSSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	key := name
 	fullPath := ostore.getAbsoluteURI(name)
 	dir, name := path.Split(fullPath)
 	err := os.MkdirAll(dir, os.ModePerm)
@@ -185,24 +248,43 @@ func (ostore *FSSession) SaveData(ctx context.Context, name string, data io.Read
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 128*1024)
 	defer file.Close()
+	cr := newChecksumReader(data)
+	if err := copyWithContext(ctx, file, cr); err != nil {
+		// the properties of the previous version don't apply to the truncated file
+		os.Remove(fsPropertiesPath(fullPath))
+		return nil, err
+	}
+	if err := writeFSProperties(fullPath, fields); err != nil {
+		return nil, err
+	}
+	return &SaveDataOutput{
+		URL:         fullPath,
+		Key:         ostore.getAbsolutePath(key),
+		Size:        cr.size,
+		ContentType: propertiesContentType(fullPath, fields),
+		Checksums:   cr.Sum(),
+	}, nil
+}
+
+// copyWithContext copies data to w until data is exhausted or ctx is done
+func copyWithContext(ctx context.Context, w io.Writer, data io.Reader) error {
+	buf := make([]byte, 128*1024)
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return ctx.Err()
 		default:
 			read, err := data.Read(buf)
 			if err != nil && err != io.EOF {
-				return nil, err
+				return err
 			}
 			if read > 0 {
-				_, err = file.Write(buf[:read])
-				if err != nil {
-					return nil, err
+				if _, err := w.Write(buf[:read]); err != nil {
+					return err
 				}
 			} else {
-				return &SaveDataOutput{URL: fullPath}, nil
+				return nil
 			}
 		}
 	}
@@ -228,3 +310,70 @@ func (ostore *FSSession) getAbsoluteURI(name string) string {
 		return ostore.getAbsolutePath(name)
 	}
 }
+
+// fsProperties are the FileProperties stored next to the files, in hidden
+// files named after them
+type fsProperties struct {
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	ContentType        string            `json:"contentType,omitempty"`
+	CacheControl       string            `json:"cacheControl,omitempty"`
+	ContentEncoding    string            `json:"contentEncoding,omitempty"`
+	ContentDisposition string            `json:"contentDisposition,omitempty"`
+	ContentLanguage    string            `json:"contentLanguage,omitempty"`
+	Expires            time.Time         `json:"expires,omitempty"`
+}
+
+// fsPropertiesSuffix is namespaced so that hidden files of users aren't taken
+// for properties
+const fsPropertiesSuffix = ".livepeer-properties"
+
+func fsPropertiesPath(fullPath string) string {
+	dir, file := filepath.Split(fullPath)
+	return filepath.Join(dir, "."+file+fsPropertiesSuffix)
+}
+
+func isFSPropertiesFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, fsPropertiesSuffix)
+}
+
+// writeFSProperties stores the properties of the file at fullPath, removing the
+// ones of a previous version of the file if there are none
+func writeFSProperties(fullPath string, fields *FileProperties) error {
+	propsPath := fsPropertiesPath(fullPath)
+	if fields == nil || (len(fields.Metadata) == 0 && fields.ContentType == "" && fields.CacheControl == "" &&
+		fields.ContentEncoding == "" && fields.ContentDisposition == "" && fields.ContentLanguage == "" && fields.Expires.IsZero()) {
+		if err := os.Remove(propsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(fsProperties{
+		Metadata:           fields.Metadata,
+		ContentType:        fields.ContentType,
+		CacheControl:       fields.CacheControl,
+		ContentEncoding:    fields.ContentEncoding,
+		ContentDisposition: fields.ContentDisposition,
+		ContentLanguage:    fields.ContentLanguage,
+		Expires:            fields.Expires,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(propsPath, data, 0644)
+}
+
+// readFSProperties returns the stored properties of the file, or nil if there are none
+func readFSProperties(fullPath string) (*fsProperties, error) {
+	data, err := ioutil.ReadFile(fsPropertiesPath(fullPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var props fsProperties
+	if err := json.Unmarshal(data, &props); err != nil {
+		return nil, fmt.Errorf("error parsing properties of %s: %w", fullPath, err)
+	}
+	return &props, nil
+}
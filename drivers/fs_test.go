@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -37,6 +40,12 @@ func TestFsOS(t *testing.T) {
 	path := out.URL
 	defer os.Remove(path)
 	assert.Equal("/tmp/driver-test/name1/1.ts", path)
+	sums, err := ComputeChecksums(bytes.NewReader(rndData))
+	assert.NoError(err)
+	assert.Equal(sums, out.Checksums)
+	assert.Equal(int64(len(rndData)), out.Size)
+	assert.Equal("driver-test/name1/1.ts", out.Key)
+	assert.Equal("video/mp2t", out.ContentType)
 	data := readFile(sess, "driver-test/name1/1.ts")
 	assert.Equal(rndData, data)
 	// check file contents
@@ -93,3 +102,68 @@ func TestDeleteFile(t *testing.T) {
 	_, err = os.Stat(file.Name())
 	require.ErrorContains(t, err, "no such file or directory")
 }
+
+func TestFsProperties(t *testing.T) {
+	require := require.New(t)
+	dir := filepath.Join(t.TempDir(), "props")
+	sess := NewFSDriver(nil).NewSession(dir).(*FSSession)
+	file := filepath.Join(dir, "video.mp4")
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, err := sess.SaveData(context.Background(), "video.mp4", bytes.NewReader([]byte("data")), &FileProperties{
+		Metadata:           map[string]string{"a": "b"},
+		ContentType:        "video/mp4",
+		CacheControl:       "max-age=60",
+		ContentDisposition: `attachment; filename="video.mp4"`,
+		ContentLanguage:    "en",
+		Expires:            expires,
+	}, 0)
+	require.NoError(err)
+
+	fi, err := Stat(context.Background(), sess, file)
+	require.NoError(err)
+	require.Nil(fi.Body)
+	require.Equal(int64(4), *fi.Size)
+	require.Equal(map[string]string{"a": "b"}, fi.Metadata)
+	require.Equal("video/mp4", fi.ContentType)
+	require.Equal("max-age=60", fi.CacheControl)
+	require.Equal(`attachment; filename="video.mp4"`, fi.ContentDisposition)
+	require.Equal("en", fi.ContentLanguage)
+	require.True(expires.Equal(fi.Expires))
+
+	fi, err = sess.ReadData(context.Background(), file)
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal("en", fi.ContentLanguage)
+
+	// the stored properties are hidden, unlike the hidden files of users
+	_, err = sess.SaveData(context.Background(), ".notes.properties", bytes.NewReader([]byte("a=b")), nil, 0)
+	require.NoError(err)
+	files, err := sess.ListFiles(context.Background(), "", "")
+	require.NoError(err)
+	require.Len(files.Files(), 2)
+	require.Equal(".notes.properties", files.Files()[0].Name)
+	require.Equal("video.mp4", files.Files()[1].Name)
+	require.NoError(sess.DeleteFile(context.Background(), ".notes.properties"))
+
+	// the properties aren't kept when the data can't be saved
+	data := io.MultiReader(bytes.NewReader([]byte("da")), iotest.ErrReader(errors.New("source gone")))
+	_, err = sess.SaveData(context.Background(), "video.mp4", data, &FileProperties{ContentLanguage: "de"}, 0)
+	require.EqualError(err, "source gone")
+	fi, err = Stat(context.Background(), sess, file)
+	require.NoError(err)
+	require.Equal("", fi.ContentLanguage)
+
+	// and replaced with the file
+	_, err = sess.SaveData(context.Background(), "video.mp4", bytes.NewReader([]byte("data")), nil, 0)
+	require.NoError(err)
+	fi, err = Stat(context.Background(), sess, file)
+	require.NoError(err)
+	require.Equal("", fi.ContentLanguage)
+
+	_, err = sess.SaveData(context.Background(), "video.mp4", bytes.NewReader([]byte("data")), &FileProperties{ContentLanguage: "fr"}, 0)
+	require.NoError(err)
+	require.NoError(sess.DeleteFile(context.Background(), "video.mp4"))
+	entries, err := os.ReadDir(dir)
+	require.NoError(err)
+	require.Empty(entries)
+}
@@ -13,15 +13,25 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iamcredentials/v1"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 var _ OSSession = (*gsSession)(nil)
 
+// gsMetaExpires is the metadata key storing the Expires date, GCS objects
+// having no such header
+const gsMetaExpires = "expires"
+
 type (
 	gsKeyJSON struct {
 		Type                    string `json:"type,omitempty"`
@@ -36,9 +46,18 @@ type (
 		ClientX509CertURL       string `json:"client_x509_cert_url,omitempty"`
 	}
 
+	// gsSigner signs with the private key of the service account key when there
+	// is one, and through the IAM signBlob API otherwise
 	gsSigner struct {
 		jsKey     *gsKeyJSON
 		parsedKey *rsa.PrivateKey
+		// serviceAccount signing through IAM, looked up in the metadata server if empty
+		serviceAccount string
+		// iamOpts are the options of the IAM credentials client, which uses the
+		// Application Default Credentials unless overridden
+		iamOpts []option.ClientOption
+		iam     *iamcredentials.Service
+		lock    sync.Mutex
 	}
 
 	GsOS struct {
@@ -86,15 +105,30 @@ func (ostore *GsOS) Description() string {
 	return "Google Cloud Storage"
 }
 
+// NewGoogleDriver creates a driver using the JSON service account key in keyData or,
+// when empty, the Application Default Credentials, e.g. from the workload
+// identity on GKE.
 func NewGoogleDriver(bucket, keyData string, useFullAPI bool) (OSDriver, error) {
+	return newGoogleDriver(&OSURL{Scheme: "gs", User: keyData, Host: bucket}, useFullAPI)
+}
+
+// newGoogleDriver creates a driver signing as the serviceAccount of the query
+// through IAM when the URL has no key
+func newGoogleDriver(u *OSURL, useFullAPI bool) (OSDriver, error) {
+	bucket, keyData := u.Host, u.User
 	os := &GsOS{
 		S3OS: S3OS{
 			host:       gsHost(bucket),
 			bucket:     bucket,
 			useFullAPI: useFullAPI,
+			config:     u.clone(),
 		},
 		keyData: []byte(keyData),
 	}
+	if keyData == "" {
+		os.gsSigner = &gsSigner{serviceAccount: u.Query.Get("serviceAccount")}
+		return os, nil
+	}
 
 	var gsKey gsKeyJSON
 	if err := json.Unmarshal([]byte(keyData), &gsKey); err != nil {
@@ -112,23 +146,32 @@ func NewGoogleDriver(bucket, keyData string, useFullAPI bool) (OSDriver, error)
 }
 
 func (os *GsOS) NewSession(path string) OSSession {
-	var policy, signature = gsCreatePolicy(os.gsSigner, os.bucket, os.region, path)
-	sess := &s3Session{
-		host:        gsHost(os.bucket),
-		bucket:      os.bucket,
-		key:         path,
-		policy:      policy,
-		signature:   signature,
-		credential:  os.gsSigner.clientEmail(),
-		storageType: OSInfo_GOOGLE,
-	}
-	sess.fields = gsGetFields(sess)
 	gs := &gsSession{
-		s3Session:  *sess,
+		s3Session: s3Session{
+			host:        gsHost(os.bucket),
+			bucket:      os.bucket,
+			key:         path,
+			storageType: OSInfo_GOOGLE,
+		},
 		gos:        os,
 		useFullAPI: os.useFullAPI,
 		keyData:    os.keyData,
 	}
+	// without signature the POST policy is rejected by GCS, only the full API can
+	// be used if signing fails
+	gs.sign = func(ctx context.Context, ps *s3Session, headers []string) error {
+		credential, err := os.gsSigner.clientEmail()
+		if err != nil {
+			return err
+		}
+		policy, signature, err := gsCreatePolicy(ctx, os.gsSigner, os.bucket, os.region, path, headers)
+		if err != nil {
+			return err
+		}
+		ps.policy, ps.signature, ps.credential = policy, signature, credential
+		ps.fields = gsGetFields(ps)
+		return nil
+	}
 	return gs
 }
 
@@ -154,7 +197,11 @@ func (os *gsSession) OS() OSDriver {
 }
 
 func (os *gsSession) createClient() error {
-	client, err := storage.NewClient(context.Background(), option.WithCredentialsJSON(os.keyData))
+	var opts []option.ClientOption
+	if len(os.keyData) > 0 {
+		opts = append(opts, option.WithCredentialsJSON(os.keyData))
+	}
+	client, err := storage.NewClient(context.Background(), opts...)
 	if err != nil {
 		return fmt.Errorf("Error creating GCP client err=%w", err)
 	}
@@ -172,7 +219,7 @@ func (os *gsSession) DeleteFile(ctx context.Context, name string) error {
 		}
 	}
 	return os.client.Bucket(os.bucket).
-		Object(os.key + "/" + name).
+		Object(os.objectKey(name)).
 		Delete(ctx)
 }
 
@@ -183,7 +230,7 @@ func (os *gsSession) SaveData(ctx context.Context, name string, data io.Reader,
 				return nil, err
 			}
 		}
-		keyname := os.key + "/" + name
+		keyname := os.objectKey(name)
 		objh := os.client.Bucket(os.bucket).Object(keyname)
 		if timeout == 0 {
 			timeout = defaultSaveTimeout
@@ -199,12 +246,35 @@ func (os *gsSession) SaveData(ctx context.Context, name string, data io.Reader,
 				wr.Metadata[k] = v
 			}
 		}
+		precomputed, err := precomputeChecksums(data)
+		if err != nil {
+			return nil, err
+		}
+		if precomputed != nil {
+			// GCS rejects the upload if the data does not match
+			wr.MD5 = precomputed.MD5
+			wr.CRC32C = precomputed.crc32c()
+			wr.SendCRC32C = true
+		}
 		data, contentType, err := os.peekContentType(name, data)
 		if err != nil {
 			return nil, err
 		}
 		wr.ContentType = contentType
-		_, err = io.Copy(wr, data)
+		if fields != nil {
+			wr.CacheControl = fields.CacheControl
+			wr.ContentEncoding = fields.ContentEncoding
+			wr.ContentDisposition = fields.ContentDisposition
+			wr.ContentLanguage = fields.ContentLanguage
+			if !fields.Expires.IsZero() {
+				if wr.Metadata == nil {
+					wr.Metadata = make(map[string]string, 1)
+				}
+				wr.Metadata[gsMetaExpires] = fields.Expires.UTC().Format(http.TimeFormat)
+			}
+		}
+		cr := newChecksumReader(data)
+		_, err = io.Copy(wr, cr)
 		err2 := wr.Close()
 		if err != nil {
 			return nil, err
@@ -212,8 +282,21 @@ func (os *gsSession) SaveData(ctx context.Context, name string, data io.Reader,
 		if err2 != nil {
 			return nil, err2
 		}
+		sums := cr.Sum()
+		attrs := wr.Attrs()
+		if err := sums.Verify(gsChecksums(attrs)); err != nil {
+			return nil, fmt.Errorf("error verifying upload of %s: %w", keyname, err)
+		}
 		uri := os.getAbsURL(keyname)
-		return &SaveDataOutput{URL: uri}, err
+		return &SaveDataOutput{
+			URL:         uri,
+			Key:         keyname,
+			Size:        attrs.Size,
+			ETag:        attrs.Etag,
+			ContentType: attrs.ContentType,
+			VersionID:   strconv.FormatInt(attrs.Generation, 10),
+			Checksums:   sums,
+		}, err
 	}
 	return os.s3Session.SaveData(ctx, name, data, fields, timeout)
 }
@@ -288,6 +371,10 @@ func (os *gsSession) ListFiles(ctx context.Context, prefix, delim string) (PageI
 			return nil, err
 		}
 	}
+	// TODO: Remove this compat once legacy clients stop sending the full path for listing
+	if os.key != "" && !strings.HasPrefix(prefix, os.key+"/") {
+		prefix = os.key + "/" + prefix
+	}
 	query := &storage.Query{
 		Prefix:    prefix,
 		Delimiter: delim,
@@ -323,29 +410,96 @@ func (os *gsSession) ReadData(ctx context.Context, name string) (*FileInfoReader
 		}
 	}
 
+	name = os.readKey(name)
 	objh := os.client.Bucket(os.bucket).Object(name)
 	attrs, err := objh.Attrs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	res := &FileInfoReader{}
+	res := gsFileInfo(name, attrs)
+	rc, err := objh.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = rc
+	if attrs.ContentEncoding != "gzip" {
+		// gzipped objects are decompressed in transit, so their checksums don't
+		// match the delivered data
+		res.Body = NewVerifyingReader(rc, res.Checksums)
+	}
+	return res, nil
+}
+
+// Stat returns the attributes of the object
+func (os *gsSession) Stat(ctx context.Context, name string) (*FileInfoReader, error) {
+	if !os.useFullAPI {
+		return nil, errors.New("Not implemented")
+	}
+	if os.client == nil {
+		if err := os.createClient(); err != nil {
+			return nil, err
+		}
+	}
+	name = os.readKey(name)
+	attrs, err := os.client.Bucket(os.bucket).Object(name).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gsFileInfo(name, attrs), nil
+}
+
+func gsFileInfo(name string, attrs *storage.ObjectAttrs) *FileInfoReader {
+	res := &FileInfoReader{
+		CacheControl:       attrs.CacheControl,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentLanguage:    attrs.ContentLanguage,
+	}
 	res.Name = name
 	res.Size = &attrs.Size
 	res.ETag = attrs.Etag
 	res.LastModified = attrs.Updated
 	res.ContentType = attrs.ContentType
-	if len(attrs.Metadata) > 0 {
-		for k, v := range attrs.Metadata {
+	for k, v := range attrs.Metadata {
+		if k == gsMetaExpires {
+			res.Expires, _ = http.ParseTime(v)
+			continue
+		}
+		if res.Metadata == nil {
 			res.Metadata = make(map[string]string, len(attrs.Metadata))
-			res.Metadata[k] = v
 		}
+		res.Metadata[k] = v
 	}
-	rc, err := objh.NewReader(ctx)
-	if err != nil {
-		return nil, err
+	res.Checksums = gsChecksums(attrs)
+	return res
+}
+
+// objectKey returns the key of the object name within the session
+func (os *gsSession) objectKey(name string) string {
+	if os.key == "" {
+		return name
 	}
-	res.Body = rc
-	return res, nil
+	if name == "" {
+		return os.key
+	}
+	return os.key + "/" + name
+}
+
+// readKey returns the key of the object name read within the session
+func (os *gsSession) readKey(name string) string {
+	// TODO: Remove this compat once legacy clients stop sending the full path for reading
+	if os.key != "" && strings.HasPrefix(name, os.key+"/") {
+		return name
+	}
+	return os.objectKey(name)
+}
+
+func gsChecksums(attrs *storage.ObjectAttrs) Checksums {
+	if attrs == nil {
+		return Checksums{}
+	}
+	// composite objects have no MD5, every object has a CRC32C
+	return Checksums{MD5: attrs.MD5, CRC32C: crc32cBytes(attrs.CRC32C)}
 }
 
 func (os *gsSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
@@ -353,7 +507,21 @@ func (os *gsSession) ReadDataRange(ctx context.Context, name, byteRange string)
 }
 
 func (os *gsSession) Presign(name string, expire time.Duration) (string, error) {
-	return "", ErrNotSupported
+	email, err := os.gos.gsSigner.clientEmail()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), policySignTimeout)
+	defer cancel()
+	return storage.SignedURL(os.bucket, os.objectKey(name), &storage.SignedURLOptions{
+		GoogleAccessID: email,
+		SignBytes: func(b []byte) ([]byte, error) {
+			return os.gos.gsSigner.signBytes(ctx, b)
+		},
+		Method:  "GET",
+		Expires: time.Now().Add(expire),
+		Scheme:  storage.SigningSchemeV4,
+	})
 }
 
 func gsGetFields(sess *s3Session) map[string]string {
@@ -363,8 +531,9 @@ func gsGetFields(sess *s3Session) map[string]string {
 	}
 }
 
-// gsCreatePolicy returns policy, signature
-func gsCreatePolicy(signer *gsSigner, bucket, region, path string) (string, string) {
+// gsCreatePolicy returns policy, signature, with any value allowed for the
+// object headers
+func gsCreatePolicy(ctx context.Context, signer *gsSigner, bucket, region, path string, headers []string) (string, string, error) {
 	const timeFormat = "2006-01-02T15:04:05.999Z"
 
 	expireAt := time.Now().Add(S3_POLICY_EXPIRE_IN_HOURS * time.Hour)
@@ -373,27 +542,75 @@ func gsCreatePolicy(signer *gsSigner, bucket, region, path string) (string, stri
 	"conditions": [
 		{"bucket": "%s"},
 		{"acl": "public-read"},
-		["starts-with", "$Content-Type", ""],
+		["starts-with", "$Content-Type", ""],%s
 		["starts-with", "$key", "%s"]
-	]}`, expireFmt, bucket, path)
+	]}`, expireFmt, bucket, postHeaderConditions(headers), path)
 	policy := base64.StdEncoding.EncodeToString([]byte(src))
-	sign := signer.sign(policy)
-	return policy, sign
+	sign, err := signer.sign(ctx, policy)
+	return policy, sign, err
 }
 
-func (s *gsSigner) sign(mes string) string {
+func (s *gsSigner) sign(ctx context.Context, mes string) (string, error) {
+	signature, err := s.signBytes(ctx, []byte(mes))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// signBytes returns the RSA SHA-256 signature of b
+func (s *gsSigner) signBytes(ctx context.Context, b []byte) ([]byte, error) {
+	if s.parsedKey == nil {
+		return s.signBlob(ctx, b)
+	}
 	h := sha256.New()
-	h.Write([]byte(mes))
+	h.Write(b)
 	d := h.Sum(nil)
+	return rsa.SignPKCS1v15(rand.Reader, s.parsedKey, crypto.SHA256, d)
+}
 
-	signature, err := rsa.SignPKCS1v15(rand.Reader, s.parsedKey, crypto.SHA256, d)
+// signBlob signs b as the service account with the IAM signBlob API, which
+// requires the roles/iam.serviceAccountTokenCreator role on it
+func (s *gsSigner) signBlob(ctx context.Context, b []byte) ([]byte, error) {
+	email, err := s.clientEmail()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	return base64.StdEncoding.EncodeToString(signature)
+	s.lock.Lock()
+	if s.iam == nil {
+		s.iam, err = iamcredentials.NewService(context.Background(), s.iamOpts...)
+	}
+	iam := s.iam
+	s.lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error creating IAM credentials client: %w", err)
+	}
+	name := "projects/-/serviceAccounts/" + email
+	resp, err := iam.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+		Payload: base64.StdEncoding.EncodeToString(b),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error signing as %s: %w", email, err)
+	}
+	return base64.StdEncoding.DecodeString(resp.SignedBlob)
 }
 
-func (s *gsSigner) clientEmail() string {
-	return s.jsKey.ClientEmail
+// clientEmail returns the email of the service account signing
+func (s *gsSigner) clientEmail() (string, error) {
+	if s.jsKey != nil {
+		return s.jsKey.ClientEmail, nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.serviceAccount == "" {
+		if !metadata.OnGCE() {
+			return "", errors.New("service account required to sign without key outside of Google Cloud")
+		}
+		email, err := metadata.Email("default")
+		if err != nil {
+			return "", fmt.Errorf("error getting service account from metadata server: %w", err)
+		}
+		s.serviceAccount = email
+	}
+	return s.serviceAccount, nil
 }
@@ -0,0 +1,147 @@
+package drivers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+func TestGoogleDriverWithKey(t *testing.T) {
+	require := require.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyData, err := json.Marshal(gsKeyJSON{Type: "service_account", PrivateKey: string(keyPEM), ClientEmail: "writer@project.iam.gserviceaccount.com"})
+	require.NoError(err)
+
+	os, err := NewGoogleDriver("bucket", string(keyData), false)
+	require.NoError(err)
+	info := os.NewSession("stream").GetInfo().S3Info
+	require.Equal("writer@project.iam.gserviceaccount.com", info.Credential)
+	signature, err := base64.StdEncoding.DecodeString(info.Signature)
+	require.NoError(err)
+	digest := sha256.Sum256([]byte(info.Policy))
+	require.NoError(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+}
+
+func TestGoogleDriverIAMSigning(t *testing.T) {
+	require := require.New(t)
+	const serviceAccount = "writer@project.iam.gserviceaccount.com"
+	var payloads []string
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal("/v1/projects/-/serviceAccounts/"+serviceAccount+":signBlob", r.URL.Path)
+		var req struct {
+			Payload string `json:"payload"`
+		}
+		require.NoError(json.NewDecoder(r.Body).Decode(&req))
+		payloads = append(payloads, req.Payload)
+		json.NewEncoder(w).Encode(map[string]string{
+			"keyId":      "key-id",
+			"signedBlob": base64.StdEncoding.EncodeToString([]byte("signed")),
+		})
+	}))
+	defer iam.Close()
+
+	os, err := ParseOSURL("gs://bucket?serviceAccount="+url.QueryEscape(serviceAccount), true)
+	require.NoError(err)
+	gs := os.(*GsOS)
+	require.Empty(gs.keyData)
+	gs.gsSigner.iamOpts = []option.ClientOption{option.WithEndpoint(iam.URL + "/"), option.WithoutAuthentication()}
+
+	// the policy is only signed once it's needed
+	sess := os.NewSession("stream")
+	require.Empty(payloads)
+	info := sess.GetInfo().S3Info
+	require.Equal(info, sess.GetInfo().S3Info)
+	require.Equal(serviceAccount, info.Credential)
+	require.Equal(base64.StdEncoding.EncodeToString([]byte("signed")), info.Signature)
+	require.Len(payloads, 1)
+	payload, err := base64.StdEncoding.DecodeString(payloads[0])
+	require.NoError(err)
+	require.Equal(info.Policy, string(payload))
+	policy, err := base64.StdEncoding.DecodeString(info.Policy)
+	require.NoError(err)
+	require.NotContains(string(policy), "Cache-Control")
+
+	// the uploads with object headers are signed with a policy conditioning them
+	ps, err := sess.(*gsSession).headersPolicy(context.Background(), []string{"Cache-Control"})
+	require.NoError(err)
+	policy, err = base64.StdEncoding.DecodeString(ps.policy)
+	require.NoError(err)
+	require.Contains(string(policy), `["starts-with", "$Cache-Control", ""]`)
+	require.Equal(serviceAccount, ps.fields["GoogleAccessId"])
+	require.Len(payloads, 2)
+
+	presigned, err := sess.Presign("1.ts", time.Hour)
+	require.NoError(err)
+	u, err := url.Parse(presigned)
+	require.NoError(err)
+	require.True(strings.HasSuffix(u.Path, "/bucket/stream/1.ts"))
+	require.Equal(hex.EncodeToString([]byte("signed")), u.Query().Get("X-Goog-Signature"))
+	require.True(strings.HasPrefix(u.Query().Get("X-Goog-Credential"), serviceAccount+"/"))
+	require.Len(payloads, 3)
+}
+
+func TestGoogleDriverIAMSigningFailure(t *testing.T) {
+	require := require.New(t)
+	iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": 403, "message": "not allowed"}})
+	}))
+	defer iam.Close()
+
+	os, err := ParseOSURL("gs://bucket?serviceAccount=writer@project.iam.gserviceaccount.com", false)
+	require.NoError(err)
+	os.(*GsOS).gsSigner.iamOpts = []option.ClientOption{option.WithEndpoint(iam.URL + "/"), option.WithoutAuthentication()}
+
+	sess := os.NewSession("stream")
+	require.Empty(sess.GetInfo().S3Info.Signature)
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "error signing POST policy: error signing as writer@project.iam.gserviceaccount.com")
+	require.ErrorContains(err, "not allowed")
+}
+
+func TestGoogleFileInfo(t *testing.T) {
+	require := require.New(t)
+	fi := gsFileInfo("stream/1.ts", &storage.ObjectAttrs{
+		Size:               4,
+		CacheControl:       "max-age=60",
+		ContentDisposition: "inline",
+		ContentLanguage:    "en",
+		Metadata:           map[string]string{"a": "b", gsMetaExpires: "Wed, 02 Jan 2030 03:04:05 GMT"},
+	})
+	require.Equal("max-age=60", fi.CacheControl)
+	require.Equal("inline", fi.ContentDisposition)
+	require.Equal("en", fi.ContentLanguage)
+	require.Equal(map[string]string{"a": "b"}, fi.Metadata)
+	require.True(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC).Equal(fi.Expires))
+}
+
+func TestGoogleReadKey(t *testing.T) {
+	require := require.New(t)
+	sess := &gsSession{}
+	sess.key = "stream"
+	require.Equal("stream/1.ts", sess.readKey("1.ts"))
+	// full object keys are still accepted
+	require.Equal("stream/1.ts", sess.readKey("stream/1.ts"))
+	require.Equal("stream/stream2/1.ts", sess.readKey("stream2/1.ts"))
+	require.Equal("stream", sess.readKey(""))
+	require.Equal("1.ts", (&gsSession{}).readKey("1.ts"))
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
-	"net/http"
 	"net/url"
 	"os"
 	"strconv"
@@ -46,15 +45,16 @@ func SaveFile2GS(inpFileName, targetFileName string) (string, error) {
 	var data []byte
 	purl, err := url.Parse(inpFileName)
 	if err == nil && purl.Scheme != "" {
-		resp, err := httpc.Get(inpFileName)
+		source, err := NewHTTPSourceDriver(inpFileName)
 		if err != nil {
 			return "", err
 		}
-		if resp.StatusCode != http.StatusOK {
+		fi, err := source.NewSession("").ReadData(context.Background(), "")
+		if err != nil {
 			return "", fmt.Errorf("Error reading from url=%s, err=%v", inpFileName, err)
 		}
-		data, err = ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+		data, err = ioutil.ReadAll(fi.Body)
+		fi.Body.Close()
 		if err != nil {
 			return "", err
 		}
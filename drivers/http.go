@@ -0,0 +1,601 @@
+package drivers
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/livepeer/go-tools/clients"
+)
+
+// httpPropfindBody requests the properties of the resources listed by PROPFIND
+const httpPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/></d:prop></d:propfind>`
+
+// ErrReadOnly is returned by the writes to read-only storages
+var ErrReadOnly = fmt.Errorf("%w: read-only storage", ErrNotSupported)
+
+// ErrObjectChanged is returned when an object read by a read-only HTTP session
+// changed since it was first read
+var ErrObjectChanged = errors.New("object changed since first read")
+
+// httpDriverParams are the query parameters of the OS URL that configure the
+// driver, the other ones are sent with the requests
+var httpDriverParams = []string{"bearerToken", "header", "writable"}
+
+var _ OSSession = (*httpSession)(nil)
+
+// HTTPOS saves the objects with PUT requests to an HTTP origin or a WebDAV
+// server, reads them with GET, deletes them with DELETE and lists them with
+// PROPFIND. The requests are authorized with the basic auth credentials of the
+// URL, the bearer token or the custom headers set in its query.
+//
+// Plain http(s) URLs are read-only sources, e.g. public or presigned URLs of
+// videos to ingest, unless the writable query parameter is set.
+type HTTPOS struct {
+	// baseURL is the scheme and host the objects are requested from
+	baseURL  string
+	basePath string
+	// query is sent with the requests
+	query string
+	// sourceURL is the URL of the object of source drivers, requested as given
+	// so that e.g. the signature of a presigned URL stays valid
+	sourceURL string
+	// webdav enables the creation of the missing collections
+	webdav   bool
+	readOnly bool
+	header   http.Header
+	client   *http.Client
+	config   *OSURL
+
+	// collections are the WebDAV collections known to exist
+	collections     map[string]bool
+	collectionsLock sync.Mutex
+}
+
+type httpSession struct {
+	os  *HTTPOS
+	key string
+
+	// validators are the ETag and Last-Modified of the objects read by read-only
+	// sessions, required to match by the next reads
+	validators     map[string]httpValidators
+	validatorsLock sync.Mutex
+}
+
+type httpValidators struct {
+	etag         string
+	lastModified string
+}
+
+// NewHTTPDriver creates a driver for the objects under baseURL, e.g.
+// https://origin.example.com/videos, sending the header with each request
+func NewHTTPDriver(baseURL string, header http.Header) (OSDriver, error) {
+	var u OSURL
+	if err := u.Parse(baseURL); err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported HTTP driver scheme: %s", u.Scheme)
+	}
+	os, err := newHTTPDriver(&u)
+	if err != nil {
+		return nil, err
+	}
+	os.readOnly = false
+	for k, v := range header {
+		os.header[k] = v
+	}
+	return os, nil
+}
+
+// NewHTTPSourceDriver creates a read-only driver for the object at rawURL, read
+// by the sessions with ReadData(ctx, "")
+func NewHTTPSourceDriver(rawURL string) (OSDriver, error) {
+	var u OSURL
+	if err := u.Parse(rawURL); err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported HTTP driver scheme: %s", u.Scheme)
+	}
+	os, err := newHTTPOS(&u)
+	if err != nil {
+		return nil, err
+	}
+	source, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	// the query parameters are the ones of the source, not of the driver
+	source.User = nil
+	os.sourceURL = source.String()
+	os.query = source.RawQuery
+	os.readOnly = true
+	return os, nil
+}
+
+// newHTTPDriver creates a driver from an http(s)://user:password@host/path or
+// webdav(+http)://user:password@host/path URL. The bearerToken query parameter
+// sets the bearer token, and each header one, e.g. header=X-Api-Key:secret, a
+// header sent with the requests.
+func newHTTPDriver(u *OSURL) (*HTTPOS, error) {
+	os, err := newHTTPOS(u)
+	if err != nil {
+		return nil, err
+	}
+	os.readOnly = !os.webdav && u.Query.Get("writable") != "true"
+	if token := u.Query.Get("bearerToken"); token != "" {
+		os.header.Set("Authorization", "Bearer "+token)
+	}
+	for _, h := range u.Query["header"] {
+		name, value, found := strings.Cut(h, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name:Value", h)
+		}
+		os.header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	query := url.Values{}
+	for k, v := range u.Query {
+		query[k] = v
+	}
+	for _, param := range httpDriverParams {
+		query.Del(param)
+	}
+	os.query = query.Encode()
+	return os, nil
+}
+
+// newHTTPOS creates a driver for the host and path of the URL, authorized with
+// its basic auth credentials
+func newHTTPOS(u *OSURL) (*HTTPOS, error) {
+	if u.Host == "" {
+		return nil, errors.New("host not found in URL")
+	}
+	scheme := u.Scheme
+	switch u.Scheme {
+	case "webdav":
+		scheme = "https"
+	case "webdav+http":
+		scheme = "http"
+	}
+	os := &HTTPOS{
+		baseURL:     scheme + "://" + u.Host,
+		basePath:    strings.Trim(u.Path, "/"),
+		webdav:      strings.HasPrefix(u.Scheme, "webdav"),
+		header:      http.Header{},
+		client:      &http.Client{},
+		config:      u.clone(),
+		collections: map[string]bool{},
+	}
+	if u.User != "" || u.Password != "" {
+		os.header.Set("Authorization", "Basic "+basicAuth(u.User, u.Password))
+	}
+	return os, nil
+}
+
+func basicAuth(user, password string) string {
+	req := &http.Request{Header: http.Header{}}
+	req.SetBasicAuth(user, password)
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Basic ")
+}
+
+func (os *HTTPOS) NewSession(path string) OSSession {
+	return &httpSession{
+		os:         os,
+		key:        strings.Trim(os.basePath+"/"+path, "/"),
+		validators: map[string]httpValidators{},
+	}
+}
+
+func (ostore *HTTPOS) Config() *OSURL {
+	return ostore.config.clone()
+}
+
+func (ostore *HTTPOS) UriSchemes() []string {
+	return []string{"http", "https", "webdav", "webdav+http"}
+}
+
+func (ostore *HTTPOS) Description() string {
+	return "HTTP source, HTTP origin accepting PUT uploads or WebDAV server."
+}
+
+func (ostore *HTTPOS) Publish(ctx context.Context) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (os *httpSession) OS() OSDriver {
+	return os.os
+}
+
+func (os *httpSession) IsExternal() bool {
+	return true
+}
+
+func (os *httpSession) EndSession() {
+}
+
+func (os *httpSession) GetInfo() *OSInfo {
+	return nil
+}
+
+func (os *httpSession) IsOwn(url string) bool {
+	return strings.HasPrefix(url, os.os.baseURL+"/"+os.key)
+}
+
+func (os *httpSession) Presign(name string, expire time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (os *httpSession) objectURL(name string) string {
+	if os.os.sourceURL != "" && name == os.os.basePath {
+		return os.os.sourceURL
+	}
+	u := os.os.baseURL + "/" + escapeObjectPath(name)
+	if os.os.query != "" {
+		u += "?" + os.os.query
+	}
+	return u
+}
+
+// objectName returns the path of the object, relative to the session key
+func (os *httpSession) objectName(name string) string {
+	return path.Join(os.key, name)
+}
+
+// do sends the request for the object name, and returns an error for non-2xx
+// responses. contentLength is -1 when unknown.
+func (os *httpSession) do(ctx context.Context, method, name string, header http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, os.objectURL(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+	if clients.UserAgent != "" {
+		req.Header.Set("User-Agent", clients.UserAgent)
+	}
+	for k, v := range os.os.header {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := os.os.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &clients.HTTPStatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	return resp, nil
+}
+
+// SaveData uploads the data with a PUT request. The metadata isn't saved, as
+// there are no standard headers for it.
+func (os *httpSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	if os.os.readOnly {
+		return nil, ErrReadOnly
+	}
+	key := path.Join(os.key, name)
+	contentLength := int64(-1)
+	if sized, ok := data.(interface{ Len() int }); ok {
+		contentLength = int64(sized.Len())
+	}
+	data, contentType, err := peekContentType(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if fields != nil && fields.ContentType != "" {
+		contentType = fields.ContentType
+	}
+	if timeout == 0 {
+		timeout = defaultSaveTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	if fields != nil {
+		if fields.CacheControl != "" {
+			header.Set("Cache-Control", fields.CacheControl)
+		}
+		if fields.ContentEncoding != "" {
+			header.Set("Content-Encoding", fields.ContentEncoding)
+		}
+		if fields.ContentDisposition != "" {
+			header.Set("Content-Disposition", fields.ContentDisposition)
+		}
+		if fields.ContentLanguage != "" {
+			header.Set("Content-Language", fields.ContentLanguage)
+		}
+		if !fields.Expires.IsZero() {
+			header.Set("Expires", fields.Expires.UTC().Format(http.TimeFormat))
+		}
+	}
+	if os.os.webdav {
+		// WebDAV servers reject the uploads to missing collections
+		if err := os.makeCollections(ctx, path.Dir(key)); err != nil {
+			return nil, err
+		}
+	}
+	cr := newChecksumReader(data)
+	resp, err := os.do(ctx, http.MethodPut, key, header, cr, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &SaveDataOutput{
+		URL:                     os.objectURL(key),
+		UploaderResponseHeaders: resp.Header,
+		Key:                     key,
+		Size:                    cr.size,
+		ETag:                    resp.Header.Get("ETag"),
+		ContentType:             contentType,
+		Checksums:               cr.Sum(),
+	}, nil
+}
+
+// makeCollections creates the collection dir and its parents with MKCOL, unless
+// already created by the driver
+func (os *httpSession) makeCollections(ctx context.Context, dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	os.os.collectionsLock.Lock()
+	exists := os.os.collections[dir]
+	os.os.collectionsLock.Unlock()
+	if exists {
+		return nil
+	}
+	if err := os.makeCollections(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	resp, err := os.do(ctx, "MKCOL", dir+"/", nil, nil, 0)
+	var httpErr *clients.HTTPStatusError
+	if errors.As(err, &httpErr) && httpErr.Status == http.StatusMethodNotAllowed {
+		// the collection already exists
+		err = nil
+	} else if err == nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	os.os.collectionsLock.Lock()
+	os.os.collections[dir] = true
+	os.os.collectionsLock.Unlock()
+	return nil
+}
+
+// httpFileInfo returns the properties of an object in the headers of a GET or
+// HEAD response
+func httpFileInfo(name string, header http.Header) *FileInfoReader {
+	res := &FileInfoReader{
+		FileInfo: FileInfo{
+			Name: name,
+			ETag: header.Get("ETag"),
+		},
+		ContentType:        header.Get("Content-Type"),
+		ContentRange:       header.Get("Content-Range"),
+		CacheControl:       header.Get("Cache-Control"),
+		ContentEncoding:    header.Get("Content-Encoding"),
+		ContentDisposition: header.Get("Content-Disposition"),
+		ContentLanguage:    header.Get("Content-Language"),
+	}
+	res.LastModified, _ = http.ParseTime(header.Get("Last-Modified"))
+	// invalid dates are allowed, and mean already expired
+	res.Expires, _ = http.ParseTime(header.Get("Expires"))
+	if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		res.Size = &size
+	}
+	return res
+}
+
+func (os *httpSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return os.ReadDataRange(ctx, name, "")
+}
+
+func (os *httpSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	name = os.objectName(name)
+	header := http.Header{}
+	if byteRange != "" {
+		header.Set("Range", byteRange)
+	}
+	resp, err := os.read(ctx, http.MethodGet, name, header)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("range requests not supported by %s", os.os.baseURL)
+	}
+	res := httpFileInfo(name, resp.Header)
+	res.Body = resp.Body
+	return res, nil
+}
+
+// Stat returns the properties of the object with a HEAD request
+func (os *httpSession) Stat(ctx context.Context, name string) (*FileInfoReader, error) {
+	name = os.objectName(name)
+	resp, err := os.read(ctx, http.MethodHead, name, http.Header{})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return httpFileInfo(name, resp.Header), nil
+}
+
+// read sends a GET or HEAD request for the object name. The objects read by
+// read-only sessions are required to keep the ETag or, without it, the
+// Last-Modified date of the first response.
+func (os *httpSession) read(ctx context.Context, method, name string, header http.Header) (*http.Response, error) {
+	if !os.os.readOnly {
+		return os.do(ctx, method, name, header, nil, 0)
+	}
+	os.validatorsLock.Lock()
+	validators, known := os.validators[name]
+	os.validatorsLock.Unlock()
+	if validators.etag != "" && !strings.HasPrefix(validators.etag, "W/") {
+		header.Set("If-Match", validators.etag)
+	} else if validators.lastModified != "" {
+		header.Set("If-Unmodified-Since", validators.lastModified)
+	}
+	resp, err := os.do(ctx, method, name, header, nil, 0)
+	var httpErr *clients.HTTPStatusError
+	if errors.As(err, &httpErr) && httpErr.Status == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("error reading %s: %w", name, ErrObjectChanged)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		os.validatorsLock.Lock()
+		os.validators[name] = httpValidators{
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+		}
+		os.validatorsLock.Unlock()
+	}
+	return resp, nil
+}
+
+func (os *httpSession) DeleteFile(ctx context.Context, name string) error {
+	if os.os.readOnly {
+		return ErrReadOnly
+	}
+	resp, err := os.do(ctx, http.MethodDelete, os.objectName(name), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type httpMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ETag          string `xml:"getetag"`
+			} `xml:"prop"`
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// propfind lists the collection dir, and returns its files and collections
+func (os *httpSession) propfind(ctx context.Context, dir string) ([]FileInfo, []string, error) {
+	header := http.Header{}
+	header.Set("Depth", "1")
+	header.Set("Content-Type", "application/xml")
+	resp, err := os.do(ctx, "PROPFIND", dir, header, strings.NewReader(httpPropfindBody), int64(len(httpPropfindBody)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	var ms httpMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, nil, err
+	}
+	var (
+		files []FileInfo
+		dirs  []string
+	)
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := strings.TrimPrefix(href.Path, "/")
+		if strings.TrimSuffix(name, "/") == strings.TrimSuffix(dir, "/") {
+			// the listed collection itself
+			continue
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				dirs = append(dirs, strings.TrimSuffix(name, "/")+"/")
+				continue
+			}
+			size := ps.Prop.ContentLength
+			fi := FileInfo{
+				Name: name,
+				ETag: ps.Prop.ETag,
+				Size: &size,
+			}
+			fi.LastModified, _ = http.ParseTime(ps.Prop.LastModified)
+			files = append(files, fi)
+		}
+	}
+	return files, dirs, nil
+}
+
+// ListFiles lists the objects starting with prefix with PROPFIND requests. The
+// collections are returned as directories when delim is set, and listed
+// otherwise.
+func (os *httpSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	if os.os.readOnly {
+		// plain HTTP servers can't list
+		return nil, ErrNotSupported
+	}
+	if os.key != "" {
+		prefix = os.key + "/" + prefix
+	}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		dir = prefix[:i+1]
+	}
+	pi := &singlePageInfo{
+		files:       []FileInfo{},
+		directories: []string{},
+	}
+	for pending := []string{dir}; len(pending) > 0; {
+		files, dirs, err := os.propfind(ctx, pending[0])
+		if err != nil {
+			return nil, err
+		}
+		pending = pending[1:]
+		for _, f := range files {
+			if strings.HasPrefix(f.Name, prefix) {
+				pi.files = append(pi.files, f)
+			}
+		}
+		for _, d := range dirs {
+			if !strings.HasPrefix(d, prefix) {
+				continue
+			}
+			if delim != "" {
+				pi.directories = append(pi.directories, d)
+			} else {
+				pending = append(pending, d)
+			}
+		}
+	}
+	return pi, nil
+}
@@ -0,0 +1,230 @@
+package drivers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/livepeer/go-tools/clients"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAVDriver(t *testing.T) {
+	require := require.New(t)
+	dav := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ctx := context.Background()
+
+	_, err := ParseOSURL("webdav+http://user:wrong@"+host+"/videos", true)
+	require.NoError(err)
+	os, err := ParseOSURL("webdav+http://user:wrong@"+host+"/videos", true)
+	require.NoError(err)
+	_, err = os.NewSession("stream").SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	var httpErr *clients.HTTPStatusError
+	require.ErrorAs(err, &httpErr)
+	require.Equal(http.StatusUnauthorized, httpErr.Status)
+
+	os, err = ParseOSURL("webdav+http://user:secret@"+host+"/videos", true)
+	require.NoError(err)
+	sess := os.NewSession("stream")
+	// the missing collections are created
+	out, err := sess.SaveData(ctx, "source/1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal("videos/stream/source/1.ts", out.Key)
+	require.Equal(server.URL+"/videos/stream/source/1.ts", out.URL)
+	require.Equal(int64(7), out.Size)
+	require.True(sess.IsOwn(out.URL))
+	for _, name := range []string{"1.ts", "2.ts", "source/2.ts"} {
+		_, err = sess.SaveData(ctx, name, strings.NewReader(name), nil, 0)
+		require.NoError(err)
+	}
+
+	fi, err := sess.ReadData(ctx, "source/1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal(int64(7), *fi.Size)
+	require.NotEmpty(fi.ETag)
+	require.False(fi.LastModified.IsZero())
+
+	fi, err = sess.ReadDataRange(ctx, "source/1.ts", "bytes=2-4")
+	require.NoError(err)
+	data, err = io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("gme", string(data))
+	require.Equal("bytes 2-4/7", fi.ContentRange)
+
+	fi, err = Stat(ctx, sess, "1.ts")
+	require.NoError(err)
+	require.Nil(fi.Body)
+	require.Equal(int64(4), *fi.Size)
+
+	pi, err := sess.ListFiles(ctx, "", "/")
+	require.NoError(err)
+	require.False(pi.HasNextPage())
+	var names []string
+	for _, f := range pi.Files() {
+		names = append(names, f.Name)
+	}
+	require.ElementsMatch([]string{"videos/stream/1.ts", "videos/stream/2.ts"}, names)
+	require.Equal([]string{"videos/stream/source/"}, pi.Directories())
+
+	pi, err = sess.ListFiles(ctx, "", "")
+	require.NoError(err)
+	names = nil
+	for _, f := range pi.Files() {
+		names = append(names, f.Name)
+	}
+	require.ElementsMatch([]string{"videos/stream/1.ts", "videos/stream/2.ts", "videos/stream/source/1.ts", "videos/stream/source/2.ts"}, names)
+	require.Empty(pi.Directories())
+
+	require.NoError(sess.DeleteFile(ctx, "source/1.ts"))
+	_, err = sess.ReadData(ctx, "source/1.ts")
+	require.ErrorAs(err, &httpErr)
+	require.Equal(http.StatusNotFound, httpErr.Status)
+}
+
+func TestHTTPDriverHeaders(t *testing.T) {
+	require := require.New(t)
+	var (
+		lock    sync.Mutex
+		headers []http.Header
+		objects = map[string]string{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		headers = append(headers, r.Header.Clone())
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(data)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet:
+			// ranges are ignored
+			w.Write([]byte(objects[r.URL.Path]))
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	os, err := ParseOSURL(server.URL+"/origin?bearerToken=token&header=X-Api-Key:key&writable=true", true)
+	require.NoError(err)
+	require.Equal(server.URL+"/origin?bearerToken=xxxxx&header=xxxxx&writable=true", os.Config().Redacted())
+	sess := os.NewSession("")
+	_, err = sess.SaveData(ctx, "video.mp4", strings.NewReader("data"), &FileProperties{CacheControl: "max-age=60"}, 0)
+	require.NoError(err)
+	require.Equal("data", objects["/origin/video.mp4"])
+	require.Equal("Bearer token", headers[0].Get("Authorization"))
+	require.Equal("key", headers[0].Get("X-Api-Key"))
+	require.Equal("video/mp4", headers[0].Get("Content-Type"))
+	require.Equal("max-age=60", headers[0].Get("Cache-Control"))
+	require.Equal("4", headers[0].Get("Content-Length"))
+
+	_, err = sess.ReadDataRange(ctx, "video.mp4", "bytes=0-1")
+	require.ErrorContains(err, "range requests not supported")
+	_, err = sess.Presign("video.mp4", 0)
+	require.ErrorIs(err, ErrNotSupported)
+
+	os, err = NewHTTPDriver(server.URL, http.Header{"X-Custom": {"value"}})
+	require.NoError(err)
+	_, err = os.NewSession("").SaveData(ctx, "video.mp4", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	require.Equal("value", headers[2].Get("X-Custom"))
+
+	_, err = ParseOSURL(server.URL+"?header=invalid", true)
+	require.EqualError(err, `invalid header "invalid", expected Name:Value`)
+
+	profile := &StorageProfile{Type: "https", Endpoint: "origin.example.com", Prefix: "videos", Secret: "token"}
+	u, err := profile.OSURL("stream")
+	require.NoError(err)
+	require.Equal("https://origin.example.com/videos/stream?bearerToken=token", u)
+}
+
+func TestHTTPSourceDriver(t *testing.T) {
+	require := require.New(t)
+	var (
+		lock    sync.Mutex
+		content = "source video"
+		etag    = `"v1"`
+		queries []string
+	)
+	modified := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		require.Equal("/videos/source.mp4", r.URL.Path)
+		queries = append(queries, r.URL.RawQuery)
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "source.mp4", modified, strings.NewReader(content))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	os, err := ParseOSURL(server.URL+"/videos/source.mp4?token=abc", true)
+	require.NoError(err)
+	sess := os.NewSession("")
+	fi, err := Stat(ctx, sess, "")
+	require.NoError(err)
+	require.Equal(int64(len(content)), *fi.Size)
+	require.Equal(`"v1"`, fi.ETag)
+	require.True(modified.Equal(fi.LastModified))
+	require.Equal("video/mp4", fi.ContentType)
+
+	fi, err = sess.ReadData(ctx, "")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal(content, string(data))
+	fi, err = sess.ReadDataRange(ctx, "", "bytes=0-5")
+	require.NoError(err)
+	data, err = io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("source", string(data))
+	require.Equal([]string{"token=abc", "token=abc", "token=abc"}, queries)
+
+	// the source must not change between reads
+	lock.Lock()
+	content, etag = "other video!", `"v2"`
+	lock.Unlock()
+	_, err = sess.ReadDataRange(ctx, "", "bytes=6-")
+	require.ErrorIs(err, ErrObjectChanged)
+
+	_, err = sess.SaveData(ctx, "video.mp4", strings.NewReader("data"), nil, 0)
+	require.ErrorIs(err, ErrReadOnly)
+	require.ErrorIs(err, ErrNotSupported)
+	require.ErrorIs(sess.DeleteFile(ctx, ""), ErrReadOnly)
+	_, err = sess.ListFiles(ctx, "", "")
+	require.ErrorIs(err, ErrNotSupported)
+
+	os, err = NewHTTPSourceDriver(server.URL + "/videos/source.mp4")
+	require.NoError(err)
+	fi, err = os.NewSession("").ReadData(ctx, "")
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal(`"v2"`, fi.ETag)
+
+	// the query of source URLs, e.g. presigned ones, is sent as given
+	presigned := "X-Amz-Signature=abc%2Bdef&header=x&writable=true&bearerToken=t&b=a+b"
+	os, err = NewHTTPSourceDriver(server.URL + "/videos/source.mp4?" + presigned)
+	require.NoError(err)
+	fi, err = os.NewSession("").ReadData(ctx, "")
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal(presigned, queries[len(queries)-1])
+}
@@ -4,12 +4,22 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
-	"github.com/google/uuid"
-	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/livepeer/go-tools/clients"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIpfsOS(t *testing.T) {
@@ -45,3 +55,185 @@ func TestIpfsOS(t *testing.T) {
 	ipfsData.ReadFrom(ipfsInfo.Body)
 	assert.Equal(rndData, ipfsData.Bytes())
 }
+
+// fakePinningService is a stand-in of an IPFS Pinning Service API, with the pins
+// queued until their status is read twice, or for good when stuck is set
+type fakePinningService struct {
+	lock     sync.Mutex
+	statuses []*clients.PinStatus
+	reads    map[string]int
+	fail     bool
+	stuck    bool
+}
+
+func (s *fakePinningService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	requestID := strings.TrimPrefix(r.URL.Path, "/psa/pins/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/psa/pins":
+		var pin clients.Pin
+		json.NewDecoder(r.Body).Decode(&pin)
+		status := &clients.PinStatus{
+			RequestID: fmt.Sprintf("req-%d", len(s.statuses)),
+			Status:    clients.PinStatusQueued,
+			Created:   time.Date(2023, 1, 1, 0, 0, len(s.statuses), 0, time.UTC),
+			Pin:       pin,
+			Delegates: []string{"/dnsaddr/delegate.example.com"},
+		}
+		s.statuses = append(s.statuses, status)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+	case r.Method == http.MethodGet && r.URL.Path == "/psa/pins":
+		q := r.URL.Query()
+		before, _ := time.Parse(time.RFC3339Nano, q.Get("before"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		res := clients.PinResults{Results: []clients.PinStatus{}}
+		// most recent first
+		for i := len(s.statuses) - 1; i >= 0; i-- {
+			status := s.statuses[i]
+			if (q.Get("cid") != "" && q.Get("cid") != status.Pin.CID) || !strings.Contains(q.Get("status"), status.Status) ||
+				(!before.IsZero() && !status.Created.Before(before)) {
+				continue
+			}
+			res.Count++
+			if len(res.Results) < limit {
+				res.Results = append(res.Results, *status)
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodGet:
+		for _, status := range s.statuses {
+			if status.RequestID == requestID {
+				s.reads[requestID]++
+				switch {
+				case s.stuck:
+				case s.reads[requestID] == 1:
+					status.Status = clients.PinStatusPinning
+				case s.fail:
+					status.Status = clients.PinStatusFailed
+					status.Info = map[string]string{"reason": "unreachable"}
+				default:
+					status.Status = clients.PinStatusPinned
+				}
+				json.NewEncoder(w).Encode(status)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodDelete:
+		for i, status := range s.statuses {
+			if status.RequestID == requestID {
+				s.statuses = append(s.statuses[:i], s.statuses[i+1:]...)
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestIpfsPinningService(t *testing.T) {
+	require := require.New(t)
+	psa := &fakePinningService{reads: map[string]int{}}
+	psaServer := httptest.NewServer(psa)
+	defer psaServer.Close()
+	kubo := newFakeKubo()
+	kubo.auth = "Basic " + basicAuth("user", "password")
+	kuboServer := httptest.NewServer(kubo)
+	defer kuboServer.Close()
+	nodeURL := "http://user:password@" + strings.TrimPrefix(kuboServer.URL, "http://")
+	ctx := context.Background()
+
+	_, err := ParseOSURL("ipfs://"+strings.TrimPrefix(psaServer.URL, "http://")+"/psa", true)
+	require.EqualError(err, "IPFS pinning service token not found in URL")
+	_, err = ParseOSURL("ipfs://:token@"+strings.TrimPrefix(psaServer.URL, "http://")+"/psa", true)
+	require.EqualError(err, "IPFS node adding the content pinned by the service not found in URL")
+	os, err := ParseOSURL("ipfs://:token@"+strings.TrimPrefix(psaServer.URL, "http://")+"/psa?scheme=http&node="+
+		url.QueryEscape(nodeURL)+"&origin=/ip4/10.0.0.1/tcp/4001", true)
+	require.NoError(err)
+	// the credentials of the node are redacted too
+	require.NotContains(os.Config().Redacted(), "password")
+	client := os.(*IpfsOS).client.(*clients.PinningServiceClient)
+	client.PollInterval = time.Millisecond
+	sess := os.NewSession("")
+	out, err := sess.SaveData(ctx, "video.mp4", strings.NewReader("video"), nil, 0)
+	require.NoError(err)
+	fileCid := rawCid([]byte("video"))
+	require.Equal(fileCid, out.URL)
+	require.Equal("video/mp4", out.ContentType)
+	// the content is added to the node, the origin of the pin, connected to the delegates
+	require.Equal([]byte("video"), kubo.blocks[fileCid])
+	require.Equal([]string{"/ip4/10.0.0.1/tcp/4001"}, psa.statuses[0].Pin.Origins)
+	require.Equal("/video.mp4", psa.statuses[0].Pin.Name)
+	require.Equal([]string{"/dnsaddr/delegate.example.com"}, kubo.peers)
+	require.Equal(clients.PinStatusPinned, psa.statuses[0].Status)
+
+	files, err := sess.ListFiles(ctx, fileCid, "")
+	require.NoError(err)
+	require.Len(files.Files(), 1)
+	require.Equal("/video.mp4", files.Files()[0].Name)
+	require.Equal(fileCid, files.Files()[0].ETag)
+
+	for _, name := range []string{"1.ts", "2.ts"} {
+		_, err = sess.SaveData(ctx, name, strings.NewReader(name), nil, 0)
+		require.NoError(err)
+	}
+	pl, next, err := client.List(ctx, 1, 1, "")
+	require.NoError(err)
+	require.Equal(2, next)
+	require.Equal(int64(3), pl.Count)
+	require.Len(pl.Pins, 1)
+	require.Equal("/1.ts", pl.Pins[0].Metadata.Name)
+	pl, next, err = client.List(ctx, 2, 2, "")
+	require.NoError(err)
+	require.Equal(-1, next)
+	require.Len(pl.Pins, 1)
+	require.Equal("/video.mp4", pl.Pins[0].Metadata.Name)
+
+	// the content is unpinned from the node too
+	require.Contains(kubo.pins, fileCid)
+	require.NoError(client.Unpin(ctx, fileCid))
+	files, err = sess.ListFiles(ctx, fileCid, "")
+	require.NoError(err)
+	require.Empty(files.Files())
+	require.NotContains(kubo.pins, fileCid)
+	require.NoError(client.Unpin(ctx, fileCid))
+
+	psa.fail = true
+	_, err = sess.SaveData(ctx, "3.ts", strings.NewReader("3.ts"), nil, 0)
+	require.ErrorContains(err, "failed")
+
+	// pins left queued don't block the saves
+	psa.fail, psa.stuck = false, true
+	_, err = sess.SaveData(ctx, "4.ts", strings.NewReader("4.ts"), nil, 50*time.Millisecond)
+	require.ErrorIs(err, context.DeadlineExceeded)
+
+	// the node is authenticated like with ipfs+http URLs
+	psa.stuck = false
+	kubo.auth = "Bearer node-token"
+	os, err = ParseOSURL("ipfs://:token@"+strings.TrimPrefix(psaServer.URL, "http://")+"/psa?scheme=http&node="+
+		url.QueryEscape("ipfs+"+kuboServer.URL+"?bearerToken=node-token"), true)
+	require.NoError(err)
+	os.(*IpfsOS).client.(*clients.PinningServiceClient).PollInterval = time.Millisecond
+	_, err = os.NewSession("").SaveData(ctx, "5.ts", strings.NewReader("5.ts"), nil, 0)
+	require.NoError(err)
+	require.NotContains(os.Config().Redacted(), "node-token")
+	kubo.auth = "Bearer other"
+	_, err = os.NewSession("").SaveData(ctx, "6.ts", strings.NewReader("6.ts"), nil, 0)
+	require.ErrorContains(err, "401")
+
+	profile := &StorageProfile{Type: "ipfs", Endpoint: "api.filebase.io", Prefix: "v1/ipfs", Secret: "token", Options: map[string]string{"node": "http://localhost:5001"}}
+	u, err := profile.OSURL("")
+	require.NoError(err)
+	require.Equal("ipfs://:token@api.filebase.io/v1/ipfs?node=http%3A%2F%2Flocalhost%3A5001", u)
+	os, err = ParseOSURL(u, true)
+	require.NoError(err)
+	require.Equal("ipfs://:xxxxx@api.filebase.io/v1/ipfs?node=http%3A%2F%2Flocalhost%3A5001", os.Config().Redacted())
+}
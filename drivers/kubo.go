@@ -0,0 +1,301 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/livepeer/go-tools/clients"
+)
+
+var _ OSSession = (*kuboSession)(nil)
+
+// KuboOS is the driver of a Kubo (go-ipfs) node, through its HTTP RPC API. The
+// files are added as CIDv1 with raw leaves and pinned, and copied to the MFS
+// (Mutable File System) of the node to keep the directory structure.
+type KuboOS struct {
+	client   *clients.KuboClient
+	basePath string
+	config   *OSURL
+}
+
+type kuboSession struct {
+	os  *KuboOS
+	key string
+}
+
+// NewKuboDriver creates a driver for the node with the RPC API at baseURL, e.g.
+// http://localhost:5001, keeping the files in the dirPath MFS directory
+func NewKuboDriver(baseURL, dirPath string, headers map[string]string) *KuboOS {
+	scheme, host, _ := strings.Cut(baseURL, "://")
+	return &KuboOS{
+		client:   clients.NewKuboClient(baseURL, headers),
+		basePath: strings.Trim(dirPath, "/"),
+		config:   &OSURL{Scheme: "ipfs+" + scheme, Host: host, Path: dirPath},
+	}
+}
+
+// newKuboDriver creates a driver from an ipfs+http(s)://user:password@host:port/path
+// URL, the path being the MFS directory. The credentials, or the bearerToken
+// query parameter, authenticate the requests to the RPC API.
+func newKuboDriver(u *OSURL) (*KuboOS, error) {
+	if u.Host == "" {
+		return nil, errors.New("host not found in URL")
+	}
+	os := NewKuboDriver(strings.TrimPrefix(u.Scheme, "ipfs+")+"://"+u.Host, u.Path, kuboHeaders(u))
+	os.config = u.clone()
+	return os, nil
+}
+
+// kuboHeaders returns the headers authenticating the requests to the RPC API of
+// the Kubo node of the URL, with its credentials or bearerToken query parameter
+func kuboHeaders(u *OSURL) map[string]string {
+	headers := map[string]string{}
+	if u.User != "" || u.Password != "" {
+		headers["Authorization"] = "Basic " + basicAuth(u.User, u.Password)
+	}
+	if token := u.Query.Get("bearerToken"); token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	return headers
+}
+
+func (ostore *KuboOS) NewSession(path string) OSSession {
+	return &kuboSession{
+		os:  ostore,
+		key: strings.Trim(ostore.basePath+"/"+path, "/"),
+	}
+}
+
+func (ostore *KuboOS) Config() *OSURL {
+	return ostore.config.clone()
+}
+
+func (ostore *KuboOS) UriSchemes() []string {
+	return []string{"ipfs+http", "ipfs+https"}
+}
+
+func (ostore *KuboOS) Description() string {
+	return "Kubo IPFS node RPC driver."
+}
+
+// Publish pins the MFS directory of the driver, and returns its ipfs:// URL
+func (ostore *KuboOS) Publish(ctx context.Context) (string, error) {
+	stat, err := ostore.client.FilesStat(ctx, "/"+ostore.basePath)
+	if err != nil {
+		return "", err
+	}
+	if err := ostore.client.Pin(ctx, stat.Hash); err != nil {
+		return "", err
+	}
+	return "ipfs://" + stat.Hash, nil
+}
+
+func (session *kuboSession) OS() OSDriver {
+	return session.os
+}
+
+func (session *kuboSession) EndSession() {
+	// no op
+}
+
+func (session *kuboSession) IsExternal() bool {
+	return false
+}
+
+// IsOwn returns whether url is a CID, as returned by SaveData
+func (session *kuboSession) IsOwn(url string) bool {
+	_, err := cid.Decode(strings.TrimPrefix(url, "ipfs://"))
+	return err == nil
+}
+
+func (session *kuboSession) GetInfo() *OSInfo {
+	return nil
+}
+
+func (session *kuboSession) Presign(name string, expire time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+// filePath returns the IPFS path of name when it starts with a CID, and its
+// MFS path otherwise
+func (session *kuboSession) filePath(name string) (filePath string, isCid bool) {
+	first, _, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if _, err := cid.Decode(first); err == nil {
+		return "/ipfs/" + strings.TrimPrefix(name, "/"), true
+	}
+	return "/" + path.Join(session.key, name), false
+}
+
+// SaveData adds and pins the data, and copies it to the MFS path of name,
+// replacing the existing file. The content of a replaced file stays pinned.
+func (session *kuboSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	fullPath := path.Join(session.key, name)
+	if fullPath == "" {
+		fullPath = "data.bin"
+	}
+	if timeout == 0 {
+		timeout = defaultSaveTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	contentType := propertiesContentType(fullPath, fields)
+	cr := newChecksumReader(data)
+	fileCid, _, err := session.os.client.PinContent(ctx, path.Base(fullPath), contentType, cr)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.os.client.FilesRm(ctx, "/"+fullPath); err != nil && !clients.IsKuboNotFound(err) {
+		return nil, err
+	}
+	if err := session.os.client.FilesCp(ctx, "/ipfs/"+fileCid, "/"+fullPath); err != nil {
+		return nil, err
+	}
+	return &SaveDataOutput{
+		URL:         fileCid,
+		Key:         fullPath,
+		Size:        cr.size,
+		ContentType: contentType,
+		Checksums:   cr.Sum(),
+	}, nil
+}
+
+func (session *kuboSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return session.ReadDataRange(ctx, name, "")
+}
+
+// ReadDataRange reads the file of the MFS path or IPFS path of name
+func (session *kuboSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	res, err := session.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	size := *res.Size
+	start, length := int64(0), int64(-1)
+	if byteRange != "" {
+		var end int64
+		start, end, err = parseByteRange(byteRange)
+		if err != nil {
+			return nil, err
+		}
+		if start < 0 {
+			start += size
+			if start < 0 {
+				start = 0
+			}
+		}
+		if end == -1 || end >= size {
+			end = size - 1
+		}
+		if start > end {
+			return nil, fmt.Errorf("range %q not satisfiable for size %d", byteRange, size)
+		}
+		length = end - start + 1
+		res.Size = &length
+		res.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+	}
+	res.Body, err = session.os.client.Cat(ctx, "/ipfs/"+res.ETag, start, length)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Stat returns the properties of the file, with its CID as ETag
+func (session *kuboSession) Stat(ctx context.Context, name string) (*FileInfoReader, error) {
+	filePath, _ := session.filePath(name)
+	stat, err := session.os.client.FilesStat(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Type == "directory" {
+		return nil, fmt.Errorf("%s is a directory", filePath)
+	}
+	contentType, _ := TypeByExtension(path.Ext(name))
+	return &FileInfoReader{
+		FileInfo: FileInfo{
+			Name: name,
+			ETag: stat.Hash,
+			Size: &stat.Size,
+		},
+		ContentType: contentType,
+	}, nil
+}
+
+// DeleteFile unpins the CID, or removes the MFS file and unpins its content
+func (session *kuboSession) DeleteFile(ctx context.Context, name string) error {
+	filePath, isCid := session.filePath(name)
+	if isCid {
+		return session.os.client.Unpin(ctx, strings.TrimPrefix(filePath, "/ipfs/"))
+	}
+	stat, err := session.os.client.FilesStat(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	if err := session.os.client.FilesRm(ctx, filePath); err != nil {
+		return err
+	}
+	return session.os.client.Unpin(ctx, stat.Hash)
+}
+
+// ListFiles returns the pin of the CID when prefix is a CID, like IpfsOS, and
+// lists the MFS files starting with prefix otherwise. The directories are
+// returned when delim is set, and listed otherwise.
+func (session *kuboSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	pi := &singlePageInfo{
+		files:       []FileInfo{},
+		directories: []string{},
+	}
+	if _, err := cid.Decode(prefix); err == nil {
+		pinList, _, err := session.os.client.List(ctx, 1, 0, prefix)
+		if err != nil || len(pinList.Pins) == 0 {
+			return pi, err
+		}
+		stat, err := session.os.client.FilesStat(ctx, "/ipfs/"+prefix)
+		if err != nil {
+			return nil, err
+		}
+		pi.files = append(pi.files, FileInfo{Name: pinList.Pins[0].Metadata.Name, Size: &stat.CumulativeSize,
+			ETag: pinList.Pins[0].IPFSPinHash})
+		return pi, nil
+	}
+
+	if session.key != "" {
+		prefix = session.key + "/" + prefix
+	}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		dir = prefix[:i+1]
+	}
+	for pending := []string{dir}; len(pending) > 0; pending = pending[1:] {
+		entries, err := session.os.client.FilesLs(ctx, "/"+pending[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := pending[0] + entry.Name
+			if !strings.HasPrefix(name, prefix) && !strings.HasPrefix(name+"/", prefix) {
+				continue
+			}
+			if entry.Type == 1 {
+				if delim != "" && strings.HasPrefix(name+"/", prefix) && name+"/" != prefix {
+					pi.directories = append(pi.directories, name+"/")
+				} else {
+					pending = append(pending, name+"/")
+				}
+				continue
+			}
+			if strings.HasPrefix(name, prefix) {
+				size := entry.Size
+				pi.files = append(pi.files, FileInfo{Name: name, Size: &size, ETag: entry.Hash})
+			}
+		}
+	}
+	return pi, nil
+}
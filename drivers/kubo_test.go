@@ -0,0 +1,290 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKubo is a stand-in of the RPC API of a Kubo node, with the blocks of the
+// files added as single raw blocks
+type fakeKubo struct {
+	lock   sync.Mutex
+	blocks map[string][]byte
+	pins   map[string]string
+	mfs    map[string]string
+	peers  []string
+	// auth is the Authorization header required when set
+	auth string
+}
+
+func newFakeKubo() *fakeKubo {
+	return &fakeKubo{blocks: map[string][]byte{}, pins: map[string]string{}, mfs: map[string]string{}}
+}
+
+func (k *fakeKubo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/api/v0/") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if k.auth != "" && r.Header.Get("Authorization") != k.auth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	command := strings.TrimPrefix(r.URL.Path, "/api/v0/")
+	q := r.URL.Query()
+	arg := q.Get("arg")
+	fail := func(msg string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Message": msg, "Code": 0, "Type": "error"})
+	}
+	reply := func(v interface{}) {
+		json.NewEncoder(w).Encode(v)
+	}
+	switch command {
+	case "add":
+		if q.Get("cid-version") != "1" || q.Get("raw-leaves") != "true" || q.Get("pin") != "true" {
+			fail("unexpected options " + r.URL.RawQuery)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		data, _ := io.ReadAll(file)
+		c := rawCid(data)
+		k.blocks[c] = data
+		k.pins[c] = q.Get("pin-name")
+		reply(map[string]string{"Name": header.Filename, "Hash": c, "Size": strconv.Itoa(len(data))})
+	case "pin/add":
+		k.pins[arg] = ""
+		reply(map[string]interface{}{"Pins": []string{arg}})
+	case "pin/rm":
+		if _, ok := k.pins[arg]; !ok {
+			fail("not pinned or pinned indirectly")
+			return
+		}
+		delete(k.pins, arg)
+		reply(map[string]interface{}{"Pins": []string{arg}})
+	case "pin/ls":
+		keys := map[string]interface{}{}
+		for c, name := range k.pins {
+			if arg == "" || arg == c {
+				keys[c] = map[string]string{"Type": "recursive", "Name": name}
+			}
+		}
+		if arg != "" && len(keys) == 0 {
+			fail(fmt.Sprintf("path '%s' is not pinned", arg))
+			return
+		}
+		reply(map[string]interface{}{"Keys": keys})
+	case "cat":
+		data, ok := k.blocks[strings.TrimPrefix(arg, "/ipfs/")]
+		if !ok {
+			fail("block not found")
+			return
+		}
+		offset, _ := strconv.Atoi(q.Get("offset"))
+		data = data[offset:]
+		if l := q.Get("length"); l != "" {
+			length, _ := strconv.Atoi(l)
+			data = data[:length]
+		}
+		w.Write(data)
+	case "files/stat":
+		if c := strings.TrimPrefix(arg, "/ipfs/"); c != arg {
+			size := len(k.blocks[c])
+			reply(map[string]interface{}{"Hash": c, "Size": size, "CumulativeSize": size, "Type": "file"})
+			return
+		}
+		if c, ok := k.mfs[arg]; ok {
+			size := len(k.blocks[c])
+			reply(map[string]interface{}{"Hash": c, "Size": size, "CumulativeSize": size, "Type": "file"})
+			return
+		}
+		if !k.isDir(arg) {
+			fail("file does not exist")
+			return
+		}
+		reply(map[string]interface{}{"Hash": rawCid([]byte(arg)), "Type": "directory"})
+	case "files/cp":
+		src, dst := q["arg"][0], q["arg"][1]
+		if q.Get("parents") != "true" {
+			fail("parents not set")
+			return
+		}
+		if _, ok := k.mfs[dst]; ok {
+			fail("directory already has entry by that name")
+			return
+		}
+		k.mfs[dst] = strings.TrimPrefix(src, "/ipfs/")
+	case "files/rm":
+		if _, ok := k.mfs[arg]; !ok {
+			fail("file does not exist")
+			return
+		}
+		delete(k.mfs, arg)
+	case "files/ls":
+		if !k.isDir(arg) {
+			fail("file does not exist")
+			return
+		}
+		dir := strings.TrimSuffix(arg, "/") + "/"
+		entries := map[string]map[string]interface{}{}
+		for p, c := range k.mfs {
+			if !strings.HasPrefix(p, dir) {
+				continue
+			}
+			name, _, isDir := strings.Cut(strings.TrimPrefix(p, dir), "/")
+			if isDir {
+				entries[name] = map[string]interface{}{"Name": name, "Type": 1, "Size": 0, "Hash": rawCid([]byte(dir + name))}
+			} else {
+				entries[name] = map[string]interface{}{"Name": name, "Type": 0, "Size": len(k.blocks[c]), "Hash": c}
+			}
+		}
+		var res []map[string]interface{}
+		for _, e := range entries {
+			res = append(res, e)
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i]["Name"].(string) < res[j]["Name"].(string) })
+		reply(map[string]interface{}{"Entries": res})
+	case "swarm/connect":
+		k.peers = append(k.peers, q["arg"]...)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// rawCid returns the CIDv1 of the data as a single raw block
+func rawCid(data []byte) string {
+	c, _ := cid.NewPrefixV1(cid.Raw, multihash.SHA2_256).Sum(data)
+	return c.String()
+}
+
+func (k *fakeKubo) isDir(dirPath string) bool {
+	dir := strings.TrimSuffix(dirPath, "/") + "/"
+	for p := range k.mfs {
+		if strings.HasPrefix(p, dir) {
+			return true
+		}
+	}
+	return dir == "/"
+}
+
+func TestKuboDriver(t *testing.T) {
+	require := require.New(t)
+	kubo := newFakeKubo()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		kubo.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ctx := context.Background()
+
+	os, err := ParseOSURL("ipfs+http://user:secret@"+host+"/videos", true)
+	require.NoError(err)
+	require.Equal("ipfs+http://xxxxx:xxxxx@"+host+"/videos", os.Config().Redacted())
+	sess := os.NewSession("stream")
+	out, err := sess.SaveData(ctx, "source/1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	fileCid := rawCid([]byte("segment"))
+	require.Equal(fileCid, out.URL)
+	require.Equal("videos/stream/source/1.ts", out.Key)
+	require.Equal(int64(7), out.Size)
+	require.Equal("video/mp2t", out.ContentType)
+	require.NotEmpty(out.Checksums.MD5)
+	require.True(sess.IsOwn(out.URL))
+	require.Equal(fileCid, kubo.mfs["/videos/stream/source/1.ts"])
+	require.Equal("1.ts", kubo.pins[fileCid])
+	// existing files are replaced
+	out, err = sess.SaveData(ctx, "source/1.ts", strings.NewReader("new segment"), nil, 0)
+	require.NoError(err)
+	require.Equal(rawCid([]byte("new segment")), kubo.mfs["/videos/stream/source/1.ts"])
+	for _, name := range []string{"1.ts", "2.ts", "source/2.ts"} {
+		_, err = sess.SaveData(ctx, name, strings.NewReader(name), nil, 0)
+		require.NoError(err)
+	}
+
+	fi, err := sess.ReadData(ctx, "source/1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("new segment", string(data))
+	require.Equal(int64(11), *fi.Size)
+	require.Equal(out.URL, fi.ETag)
+
+	fi, err = sess.ReadDataRange(ctx, "source/1.ts", "bytes=4-6")
+	require.NoError(err)
+	data, err = io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("seg", string(data))
+	require.Equal("bytes 4-6/11", fi.ContentRange)
+	fi, err = sess.ReadDataRange(ctx, fileCid, "bytes=-4")
+	require.NoError(err)
+	data, err = io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("ment", string(data))
+	require.Equal("bytes 3-6/7", fi.ContentRange)
+
+	// the pins are listed by CID, like the Pinata driver
+	pi, err := sess.ListFiles(ctx, fileCid, "")
+	require.NoError(err)
+	require.Len(pi.Files(), 1)
+	require.Equal("1.ts", pi.Files()[0].Name)
+	require.Equal(fileCid, pi.Files()[0].ETag)
+	require.Equal(int64(7), *pi.Files()[0].Size)
+
+	pi, err = sess.ListFiles(ctx, "", "/")
+	require.NoError(err)
+	var names []string
+	for _, f := range pi.Files() {
+		names = append(names, f.Name)
+	}
+	require.Equal([]string{"videos/stream/1.ts", "videos/stream/2.ts"}, names)
+	require.Equal([]string{"videos/stream/source/"}, pi.Directories())
+	pi, err = sess.ListFiles(ctx, "", "")
+	require.NoError(err)
+	names = nil
+	for _, f := range pi.Files() {
+		names = append(names, f.Name)
+	}
+	require.Equal([]string{"videos/stream/1.ts", "videos/stream/2.ts", "videos/stream/source/1.ts", "videos/stream/source/2.ts"}, names)
+	require.Empty(pi.Directories())
+
+	require.NoError(sess.DeleteFile(ctx, "source/1.ts"))
+	require.NotContains(kubo.mfs, "/videos/stream/source/1.ts")
+	require.NotContains(kubo.pins, out.URL)
+	_, err = sess.ReadData(ctx, "source/1.ts")
+	require.ErrorContains(err, "file does not exist")
+	require.NoError(sess.DeleteFile(ctx, fileCid))
+	require.NotContains(kubo.pins, fileCid)
+
+	u, err := os.Publish(ctx)
+	require.NoError(err)
+	require.Equal("ipfs://"+rawCid([]byte("/videos")), u)
+	require.Contains(kubo.pins, strings.TrimPrefix(u, "ipfs://"))
+
+	profile := &StorageProfile{Type: "ipfs+https", Endpoint: "ipfs.example.com:5001", Prefix: "videos", Secret: "token"}
+	osURL, err := profile.OSURL("")
+	require.NoError(err)
+	require.Equal("ipfs+https://ipfs.example.com:5001/videos?bearerToken=token", osURL)
+}
@@ -20,6 +20,7 @@ type MemoryOS struct {
 	baseURI  *url.URL
 	sessions map[string]*MemorySession
 	lock     sync.RWMutex
+	config   *OSURL
 }
 
 var _ OSSession = (*MemorySession)(nil)
@@ -33,10 +34,15 @@ type MemorySession struct {
 }
 
 func NewMemoryDriver(baseURI *url.URL) *MemoryOS {
+	config := &OSURL{Scheme: "memory"}
+	if baseURI != nil {
+		config.Path = baseURI.Path
+	}
 	return &MemoryOS{
 		baseURI:  baseURI,
 		sessions: make(map[string]*MemorySession),
 		lock:     sync.RWMutex{},
+		config:   config,
 	}
 }
 
@@ -145,19 +151,41 @@ func (ostore *MemorySession) ListFiles(ctx context.Context, prefix, delim string
 }
 
 func (ostore *MemorySession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
-	data := ostore.GetData(name)
-	if data == nil {
+	item := ostore.getItem(name)
+	if item == nil {
+		return nil, errors.New("Not found")
+	}
+	res := memoryFileInfo(name, item)
+	res.Body = ioutil.NopCloser(bytes.NewReader(item.data))
+	return res, nil
+}
+
+func (ostore *MemorySession) Stat(ctx context.Context, name string) (*FileInfoReader, error) {
+	item := ostore.getItem(name)
+	if item == nil {
 		return nil, errors.New("Not found")
 	}
-	size := int64(len(data))
+	return memoryFileInfo(name, item), nil
+}
+
+func memoryFileInfo(name string, item *dataCacheItem) *FileInfoReader {
+	size := int64(len(item.data))
 	res := &FileInfoReader{
 		FileInfo: FileInfo{
 			Name: name,
 			Size: &size,
 		},
-		Body: ioutil.NopCloser(bytes.NewReader(data)),
 	}
-	return res, nil
+	if props := item.props; props != nil {
+		res.Metadata = props.Metadata
+		res.ContentType = props.ContentType
+		res.CacheControl = props.CacheControl
+		res.ContentEncoding = props.ContentEncoding
+		res.ContentDisposition = props.ContentDisposition
+		res.ContentLanguage = props.ContentLanguage
+		res.Expires = props.Expires
+	}
+	return res
 }
 
 func (ostore *MemorySession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
@@ -173,6 +201,13 @@ func (ostore *MemorySession) ReadDataRange(ctx context.Context, name, byteRange
 // - /stream/ + ostore.path + path + file (if ostore.os.baseURI is empty)
 // - ostore.path + path + file
 func (ostore *MemorySession) GetData(name string) []byte {
+	if item := ostore.getItem(name); item != nil {
+		return item.data
+	}
+	return nil
+}
+
+func (ostore *MemorySession) getItem(name string) *dataCacheItem {
 	// Since the memory cache uses the path as the key for fetching data we make sure that
 	// ostore.os.baseURI and /stream/ are stripped before splitting into a path and a filename
 	prefix := ""
@@ -193,7 +228,11 @@ func (ostore *MemorySession) GetData(name string) []byte {
 		}
 	}
 	if cache, ok := dCache[path]; ok {
-		return cache.GetData(file)
+		if item := cache.getItem(file); item != nil {
+			// the cache slot can be reused once unlocked
+			copied := *item
+			return &copied
+		}
 	}
 	return nil
 }
@@ -214,6 +253,10 @@ func (ostore *MemorySession) GetInfo() *OSInfo {
 	return nil
 }
 
+func (ostore *MemoryOS) Config() *OSURL {
+	return ostore.config.clone()
+}
+
 func (ostore *MemoryOS) UriSchemes() []string {
 	return []string{"memory"}
 }
@@ -232,14 +275,26 @@ func (ostore *MemorySession) SaveData(ctx context.Context, name string, data io.
 		return nil, fmt.Errorf("Session ended")
 	}
 
-	bytes, err := ioutil.ReadAll(data)
+	cr := newChecksumReader(data)
+	bytes, err := ioutil.ReadAll(cr)
 	if err != nil {
 		return nil, err
 	}
+	var props *FileProperties
+	if fields != nil {
+		props = &FileProperties{}
+		*props = *fields
+	}
 	dc := ostore.getCacheForStream(path)
-	dc.Insert(file, bytes)
+	dc.insert(file, bytes, props)
 
-	return &SaveDataOutput{URL: ostore.getAbsoluteURI(name)}, nil
+	return &SaveDataOutput{
+		URL:         ostore.getAbsoluteURI(name),
+		Key:         ostore.getAbsolutePath(name),
+		Size:        cr.size,
+		ContentType: propertiesContentType(name, fields),
+		Checksums:   cr.Sum(),
+	}, nil
 }
 
 func (ostore *MemorySession) getCacheForStream(streamID string) *dataCache {
@@ -270,8 +325,9 @@ type dataCache struct {
 }
 
 type dataCacheItem struct {
-	name string
-	data []byte
+	name  string
+	data  []byte
+	props *FileProperties
 }
 
 func newDataCache(len int) *dataCache {
@@ -279,15 +335,18 @@ func newDataCache(len int) *dataCache {
 }
 
 func (dc *dataCache) Insert(name string, data []byte) {
+	dc.insert(name, data, nil)
+}
+
+func (dc *dataCache) insert(name string, data []byte, props *FileProperties) {
 	// replace existing item
 	for i, item := range dc.cache {
 		if item.name == name {
-			dc.cache[i] = dataCacheItem{name: name, data: data}
+			dc.cache[i] = dataCacheItem{name: name, data: data, props: props}
 			return
 		}
 	}
-	dc.cache[dc.nextFree].name = name
-	dc.cache[dc.nextFree].data = data
+	dc.cache[dc.nextFree] = dataCacheItem{name: name, data: data, props: props}
 	dc.nextFree++
 	if dc.nextFree >= dc.cacheLen {
 		dc.nextFree = 0
@@ -295,9 +354,16 @@ func (dc *dataCache) Insert(name string, data []byte) {
 }
 
 func (dc *dataCache) GetData(name string) []byte {
-	for _, s := range dc.cache {
-		if s.name == name {
-			return s.data
+	if item := dc.getItem(name); item != nil {
+		return item.data
+	}
+	return nil
+}
+
+func (dc *dataCache) getItem(name string) *dataCacheItem {
+	for i := range dc.cache {
+		if dc.cache[i].name == name {
+			return &dc.cache[i]
 		}
 	}
 	return nil
@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -28,6 +29,10 @@ func TestLocalOS(t *testing.T) {
 	require.NoError(t, err)
 	path := out.URL
 	require.Equal(t, "fake.com/url/stream/sesspath/name1/1.ts", path)
+	require.Equal(t, "sesspath/name1/1.ts", out.Key)
+	require.Equal(t, int64(len(tempData1)), out.Size)
+	require.Equal(t, "video/mp2t", out.ContentType)
+	require.Len(t, out.Checksums.SHA256, 32)
 
 	data := sess.GetData("sesspath/name1/1.ts")
 	require.Equal(t, tempData1, string(data))
@@ -66,3 +71,34 @@ func TestLocalOS(t *testing.T) {
 	data = sess.GetData(path)
 	require.Equal(t, tempData1, string(data))
 }
+
+func TestLocalOSProperties(t *testing.T) {
+	require := require.New(t)
+	sess := NewMemoryDriver(nil).NewSession("sesspath").(*MemorySession)
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, err := sess.SaveData(context.TODO(), "name1/1.ts", strings.NewReader("data"), &FileProperties{
+		CacheControl:       "no-cache",
+		ContentEncoding:    "gzip",
+		ContentDisposition: "inline",
+		ContentLanguage:    "de",
+		Expires:            expires,
+	}, 0)
+	require.NoError(err)
+
+	fi, err := sess.ReadData(context.TODO(), "sesspath/name1/1.ts")
+	require.NoError(err)
+	require.Equal("no-cache", fi.CacheControl)
+	require.Equal("gzip", fi.ContentEncoding)
+	require.Equal("inline", fi.ContentDisposition)
+	require.Equal("de", fi.ContentLanguage)
+	require.Equal(expires, fi.Expires)
+
+	fi, err = Stat(context.TODO(), sess, "sesspath/name1/1.ts")
+	require.NoError(err)
+	require.Nil(fi.Body)
+	require.Equal(int64(4), *fi.Size)
+	require.Equal("de", fi.ContentLanguage)
+
+	_, err = sess.Stat(context.TODO(), "sesspath/name1/2.ts")
+	require.EqualError(err, "Not found")
+}
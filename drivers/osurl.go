@@ -0,0 +1,168 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// redactedSecret replaces the secrets in redacted OS URLs
+const redactedSecret = "xxxxx"
+
+// osURLSecretParams are the query parameters holding secrets
+var osURLSecretParams = []string{"sseCustomerKey", "sas", "bearerToken", "header"}
+
+// OSURL is a parsed OS URL, e.g. s3://key:secret@us-east-1/bucket/prefix. The
+// meaning of the fields depends on the scheme:
+//   - s3: Host is the region, User and Password the access key and its secret
+//   - s3+http, s3+https: Host is the endpoint, User and Password the access key and its secret
+//   - gs: Host is the bucket, User the JSON service account key
+//   - azblob: Host is the container, User the storage account and Password its key
+//   - http, https, webdav, webdav+http: Host is the server, User and Password the
+//     basic auth credentials
+//   - sftp: Host is the server, User the SSH user and Password its password
+//   - ipfs: Host is the provider, User and Password the API key and secret, or Password the JWT.
+//     Hosts other than pinata.cloud are IPFS Pinning Service APIs, with Path as the
+//     path of the API and Password as the access token
+//   - ipfs+http, ipfs+https: Host is the RPC API of the Kubo node, User and Password
+//     the basic auth credentials, and Path the MFS directory
+//   - w3s: Host is the pubId, User the UCAN proof
+//   - memory: Host names the storage shared by the drivers in tests
+//   - file, or no scheme: Path is the directory
+//   - profile: Host is the name of the storage profile
+//
+// The query sets the options of the driver.
+type OSURL struct {
+	Scheme   string
+	User     string
+	Password string
+	Host     string
+	// Bucket is the first element of the path of S3 URLs
+	Bucket string
+	// Path is the key prefix of S3 URLs, the rest of the path, and the path of
+	// other URLs
+	Path  string
+	Query url.Values
+}
+
+// Parse parses raw into u
+func (u *OSURL) Parse(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if parsed.Opaque != "" {
+		return fmt.Errorf("invalid OS URL, missing // after %s:", parsed.Scheme)
+	}
+	if parsed.Scheme == "" && (parsed.Host != "" || parsed.User != nil) {
+		return errors.New("invalid OS URL, missing scheme")
+	}
+	query, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return fmt.Errorf("invalid OS URL query: %w", err)
+	}
+	res := OSURL{
+		Scheme: parsed.Scheme,
+		Host:   parsed.Host,
+		Path:   parsed.Path,
+	}
+	if len(query) > 0 {
+		res.Query = query
+	}
+	if parsed.User != nil {
+		res.User = parsed.User.Username()
+		res.Password, _ = parsed.User.Password()
+	}
+	if res.isS3() {
+		// without credentials in the URL the default AWS credential chain is used
+		if _, ok := parsed.User.Password(); parsed.User != nil && !ok {
+			return fmt.Errorf("password is required with s3:// OS")
+		}
+		// bucket immediately follows domain name, the rest is key
+		res.Bucket, res.Path, _ = strings.Cut(strings.TrimPrefix(parsed.Path, "/"), "/")
+		if res.Bucket == "" {
+			return errors.New("S3 bucket not found in URL path")
+		}
+	}
+	*u = res
+	return nil
+}
+
+func (u *OSURL) isS3() bool {
+	return u.Scheme == "s3" || u.Scheme == "s3+http" || u.Scheme == "s3+https"
+}
+
+func (u *OSURL) url() *url.URL {
+	res := &url.URL{
+		Scheme:   u.Scheme,
+		Host:     u.Host,
+		Path:     u.Path,
+		RawQuery: u.Query.Encode(),
+	}
+	if u.isS3() {
+		res.Path = "/" + u.Bucket
+		if u.Path != "" {
+			res.Path += "/" + u.Path
+		}
+	}
+	// without scheme a colon in the first segment of the path would be parsed as
+	// one, so it's escaped
+	if first, rest, found := strings.Cut(res.EscapedPath(), "/"); res.Scheme == "" && strings.Contains(first, ":") {
+		res.RawPath = strings.ReplaceAll(first, ":", "%3A")
+		if found {
+			res.RawPath += "/" + rest
+		}
+	}
+	// s3 requires the password whenever there is a user, even if empty
+	if u.Password != "" || (u.isS3() && u.User != "") {
+		res.User = url.UserPassword(u.User, u.Password)
+	} else if u.User != "" {
+		res.User = url.User(u.User)
+	}
+	return res
+}
+
+// String returns the OS URL, including its credentials
+func (u *OSURL) String() string {
+	return u.url().String()
+}
+
+// Redacted returns the OS URL with its secrets replaced, to be logged. Only the
+// access keys of S3 URLs and the accounts of Azure ones are kept.
+func (u *OSURL) Redacted() string {
+	redacted := u.clone()
+	if redacted.Password != "" {
+		redacted.Password = redactedSecret
+	}
+	if redacted.User != "" && !redacted.isS3() && redacted.Scheme != "azblob" && redacted.Scheme != "sftp" {
+		redacted.User = redactedSecret
+	}
+	for _, param := range osURLSecretParams {
+		for i := range redacted.Query[param] {
+			redacted.Query[param][i] = redactedSecret
+		}
+	}
+	// the IPFS nodes of the pinning services have their own credentials
+	for i, node := range redacted.Query["node"] {
+		var nodeURL OSURL
+		if err := nodeURL.Parse(node); err != nil {
+			redacted.Query["node"][i] = redactedSecret
+		} else {
+			redacted.Query["node"][i] = nodeURL.Redacted()
+		}
+	}
+	return redacted.String()
+}
+
+// clone returns a deep copy of u
+func (u *OSURL) clone() *OSURL {
+	res := *u
+	if u.Query != nil {
+		res.Query = make(url.Values, len(u.Query))
+		for k, v := range u.Query {
+			res.Query[k] = append([]string(nil), v...)
+		}
+	}
+	return &res
+}
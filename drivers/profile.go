@@ -0,0 +1,390 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StorageProfileEnvPrefix starts the names of the environment variables defining
+// storage profiles, e.g. LP_STORAGE_PROFILE_RECORDINGS_BUCKET=recordings sets the
+// bucket of the profile named "recordings". Options are set as a URL query
+// string, e.g. LP_STORAGE_PROFILE_RECORDINGS_OPTIONS=storageClass=GLACIER.
+const StorageProfileEnvPrefix = "LP_STORAGE_PROFILE_"
+
+// StorageProfile is a named storage configuration, referenced by profile://name/path
+// URLs so that credentials don't appear in the URLs. Credentials are references:
+// "env:NAME" reads the environment variable NAME, "file:/path" reads the file,
+// anything else is the value itself.
+//
+// Fields used by each type:
+//   - s3: Region, Bucket, Prefix, AccessKey, Secret (the AWS default credential
+//     chain is used without them)
+//   - s3+http, s3+https: Endpoint, Bucket, Prefix, AccessKey, Secret (the AWS
+//     default credential chain is used without them)
+//   - gs: Bucket, Prefix, KeyFile (path of the service account key, the Application
+//     Default Credentials are used without it)
+//   - azblob: Bucket (the container), Prefix, AccessKey (the storage account),
+//     Secret (the account key, or a SAS token set in the sas option instead) and
+//     Endpoint (defaults to the one of the account)
+//   - http, https, webdav, webdav+http: Endpoint (the host), Prefix, AccessKey and
+//     Secret for basic auth, or Secret alone with a bearer token. Custom headers
+//     are set with header options, e.g. header=X-Api-Key:secret, and http(s)
+//     profiles are read-only without the writable=true option.
+//   - sftp: Endpoint (host:port), Prefix, AccessKey (the user), Secret (the password)
+//     or KeyFile (path of the private key), and the hostKey or knownHosts option
+//   - ipfs: Endpoint (defaults to pinata.cloud), AccessKey and Secret, or Secret with a JWT.
+//     Other endpoints are IPFS Pinning Service APIs, with Prefix as the path of the
+//     API and Secret as the access token, adding the content to the Kubo node of
+//     the node option, e.g. node=http://localhost:5001
+//   - ipfs+http, ipfs+https: Endpoint (the RPC API of the Kubo node), Prefix (the MFS
+//     directory), AccessKey and Secret for basic auth, or Secret alone with a bearer token
+//   - w3s: Bucket (the pubId), Prefix, Secret (the UCAN proof)
+//   - file: Prefix (the directory)
+//
+// Options are added to the query of the resulting OS URL.
+type StorageProfile struct {
+	Name      string            `json:"-" yaml:"-"`
+	Type      string            `json:"type" yaml:"type"`
+	Endpoint  string            `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Region    string            `json:"region,omitempty" yaml:"region,omitempty"`
+	Bucket    string            `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Prefix    string            `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	AccessKey string            `json:"accessKey,omitempty" yaml:"accessKey,omitempty"`
+	Secret    string            `json:"secret,omitempty" yaml:"secret,omitempty"`
+	KeyFile   string            `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	Options   map[string]string `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// StorageProfiles are storage profiles by name
+type StorageProfiles map[string]*StorageProfile
+
+// StorageProfileError is returned for invalid profiles
+type StorageProfileError struct {
+	Profile string
+	Field   string
+	Reason  string
+}
+
+func (e *StorageProfileError) Error() string {
+	return fmt.Sprintf("storage profile %q: field %q %s", e.Profile, e.Field, e.Reason)
+}
+
+var (
+	storageProfiles     StorageProfiles
+	storageProfilesLock sync.RWMutex
+)
+
+// UseStorageProfiles makes the profiles available to ParseOSURL. Profiles which
+// are not found there are looked up in the environment.
+func UseStorageProfiles(profiles StorageProfiles) error {
+	for _, p := range profiles {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	storageProfilesLock.Lock()
+	storageProfiles = profiles
+	storageProfilesLock.Unlock()
+	return nil
+}
+
+// LoadStorageProfiles reads the profiles from a YAML or JSON file, depending on
+// its extension. The file lists the profiles under the "profiles" key.
+func LoadStorageProfiles(file string) (StorageProfiles, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		format = "json"
+	}
+	return ParseStorageProfiles(data, format)
+}
+
+// ParseStorageProfiles parses and validates profiles in the "yaml" or "json" format
+func ParseStorageProfiles(data []byte, format string) (StorageProfiles, error) {
+	var config struct {
+		Profiles StorageProfiles `json:"profiles" yaml:"profiles"`
+	}
+	var err error
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &config)
+	case "json":
+		err = json.Unmarshal(data, &config)
+	default:
+		return nil, fmt.Errorf("unsupported storage profiles format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing storage profiles: %w", err)
+	}
+	for name, p := range config.Profiles {
+		if p == nil {
+			return nil, &StorageProfileError{Profile: name, Field: "type", Reason: "is required"}
+		}
+		p.Name = name
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return config.Profiles, nil
+}
+
+var storageProfileEnvFields = map[string]func(p *StorageProfile, v string) error{
+	"TYPE":       func(p *StorageProfile, v string) error { p.Type = v; return nil },
+	"ENDPOINT":   func(p *StorageProfile, v string) error { p.Endpoint = v; return nil },
+	"REGION":     func(p *StorageProfile, v string) error { p.Region = v; return nil },
+	"BUCKET":     func(p *StorageProfile, v string) error { p.Bucket = v; return nil },
+	"PREFIX":     func(p *StorageProfile, v string) error { p.Prefix = v; return nil },
+	"ACCESS_KEY": func(p *StorageProfile, v string) error { p.AccessKey = v; return nil },
+	"SECRET":     func(p *StorageProfile, v string) error { p.Secret = v; return nil },
+	"KEY_FILE":   func(p *StorageProfile, v string) error { p.KeyFile = v; return nil },
+	"OPTIONS": func(p *StorageProfile, v string) error {
+		q, err := url.ParseQuery(v)
+		if err != nil {
+			return &StorageProfileError{Profile: p.Name, Field: "options", Reason: "is not a valid query string: " + err.Error()}
+		}
+		p.Options = make(map[string]string, len(q))
+		for k := range q {
+			p.Options[k] = q.Get(k)
+		}
+		return nil
+	},
+}
+
+// StorageProfilesFromEnv parses and validates the profiles defined by the
+// environment variables starting with StorageProfileEnvPrefix. Profile names
+// are lowercase.
+func StorageProfilesFromEnv(environ []string) (StorageProfiles, error) {
+	// longer suffixes first, in case a field name ends with another one
+	fields := make([]string, 0, len(storageProfileEnvFields))
+	for f := range storageProfileEnvFields {
+		fields = append(fields, f)
+	}
+	sort.Slice(fields, func(i, j int) bool { return len(fields[i]) > len(fields[j]) })
+
+	profiles := StorageProfiles{}
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(key, StorageProfileEnvPrefix) {
+			continue
+		}
+		key = strings.TrimPrefix(key, StorageProfileEnvPrefix)
+		for _, f := range fields {
+			if !strings.HasSuffix(key, "_"+f) || len(key) == len(f)+1 {
+				continue
+			}
+			name := strings.ToLower(strings.TrimSuffix(key, "_"+f))
+			p, ok := profiles[name]
+			if !ok {
+				p = &StorageProfile{Name: name}
+				profiles[name] = p
+			}
+			if err := storageProfileEnvFields[f](p, value); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	for _, p := range profiles {
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return profiles, nil
+}
+
+// Validate checks the fields required by the profile type are set
+func (p *StorageProfile) Validate() error {
+	var required []string
+	switch p.Type {
+	case "s3":
+		required = []string{"region", "bucket"}
+	case "s3+http", "s3+https":
+		required = []string{"endpoint", "bucket"}
+	case "gs":
+		required = []string{"bucket"}
+	case "azblob":
+		required = []string{"bucket", "accessKey"}
+	case "http", "https", "webdav", "webdav+http":
+		required = []string{"endpoint"}
+	case "sftp":
+		required = []string{"endpoint", "accessKey"}
+	case "ipfs":
+		required = []string{"secret"}
+	case "ipfs+http", "ipfs+https":
+		required = []string{"endpoint"}
+	case "w3s":
+		required = []string{"bucket", "secret"}
+	case "file":
+		required = []string{"prefix"}
+	case "":
+		return &StorageProfileError{Profile: p.Name, Field: "type", Reason: "is required"}
+	default:
+		return &StorageProfileError{Profile: p.Name, Field: "type", Reason: fmt.Sprintf("has unsupported value %q", p.Type)}
+	}
+	values := map[string]string{
+		"endpoint":  p.Endpoint,
+		"region":    p.Region,
+		"bucket":    p.Bucket,
+		"prefix":    p.Prefix,
+		"accessKey": p.AccessKey,
+		"secret":    p.Secret,
+		"keyFile":   p.KeyFile,
+	}
+	for _, field := range required {
+		if values[field] == "" {
+			return &StorageProfileError{Profile: p.Name, Field: field, Reason: fmt.Sprintf("is required for type %s", p.Type)}
+		}
+	}
+	if strings.HasPrefix(p.Type, "s3") && (p.AccessKey == "") != (p.Secret == "") {
+		field := "secret"
+		if p.AccessKey == "" {
+			field = "accessKey"
+		}
+		return &StorageProfileError{Profile: p.Name, Field: field, Reason: "is required when the other credential is set"}
+	}
+	if strings.Contains(p.Bucket, "/") {
+		return &StorageProfileError{Profile: p.Name, Field: "bucket", Reason: "must not contain /"}
+	}
+	return nil
+}
+
+// OSURL returns the OS URL of the object at path within the profile, with the
+// credentials resolved. The URL contains secrets and must not be logged.
+func (p *StorageProfile) OSURL(objPath string) (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", err
+	}
+	accessKey, err := p.resolve("accessKey", p.AccessKey)
+	if err != nil {
+		return "", err
+	}
+	secret, err := p.resolve("secret", p.Secret)
+	if err != nil {
+		return "", err
+	}
+	fullPath := path.Join("/", p.Prefix, objPath)
+	u := &url.URL{Scheme: p.Type}
+	switch p.Type {
+	case "s3", "s3+http", "s3+https":
+		u.Host = p.Region
+		if p.Type != "s3" {
+			u.Host = p.Endpoint
+		}
+		if accessKey != "" {
+			u.User = url.UserPassword(accessKey, secret)
+		}
+		u.Path = path.Join("/", p.Bucket, fullPath)
+	case "gs":
+		if p.KeyFile != "" {
+			keyData, err := ioutil.ReadFile(p.KeyFile)
+			if err != nil {
+				return "", &StorageProfileError{Profile: p.Name, Field: "keyFile", Reason: "can't be read: " + err.Error()}
+			}
+			u.User = url.User(string(keyData))
+		}
+		u.Host = p.Bucket
+		u.Path = fullPath
+	case "azblob":
+		u.Host = p.Bucket
+		u.User = url.User(accessKey)
+		if secret != "" {
+			u.User = url.UserPassword(accessKey, secret)
+		}
+		u.Path = fullPath
+	case "http", "https", "webdav", "webdav+http", "ipfs+http", "ipfs+https":
+		u.Host = p.Endpoint
+		if accessKey != "" {
+			u.User = url.UserPassword(accessKey, secret)
+		}
+		u.Path = fullPath
+	case "sftp":
+		u.Host = p.Endpoint
+		u.User = url.User(accessKey)
+		if secret != "" {
+			u.User = url.UserPassword(accessKey, secret)
+		}
+		u.Path = fullPath
+	case "ipfs":
+		u.Host = p.Endpoint
+		if u.Host == "" {
+			u.Host = "pinata.cloud"
+		}
+		u.User = url.UserPassword(accessKey, secret)
+		u.Path = fullPath
+	case "w3s":
+		u.Host = p.Bucket
+		u.User = url.User(secret)
+		u.Path = fullPath
+	case "file":
+		u.Scheme = ""
+		u.Path = fullPath
+	}
+	q := url.Values{}
+	for k, v := range p.Options {
+		q.Set(k, v)
+	}
+	if p.Type == "sftp" && p.KeyFile != "" {
+		q.Set("keyFile", p.KeyFile)
+	}
+	if p.Type == "azblob" && p.Endpoint != "" {
+		q.Set("endpoint", p.Endpoint)
+	}
+	if strings.HasPrefix(p.Type, "http") || strings.HasPrefix(p.Type, "webdav") || strings.HasPrefix(p.Type, "ipfs+") {
+		if accessKey == "" && secret != "" {
+			q.Set("bearerToken", secret)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// resolve returns the credential a reference points to
+func (p *StorageProfile) resolve(field, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", &StorageProfileError{Profile: p.Name, Field: field, Reason: fmt.Sprintf("references undefined environment variable %s", name)}
+		}
+		return v, nil
+	case strings.HasPrefix(ref, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", &StorageProfileError{Profile: p.Name, Field: field, Reason: "references a file which can't be read: " + err.Error()}
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return ref, nil
+}
+
+// lookupStorageProfile returns the profile used by a profile:// URL
+func lookupStorageProfile(name string) (*StorageProfile, error) {
+	storageProfilesLock.RLock()
+	p, ok := storageProfiles[name]
+	storageProfilesLock.RUnlock()
+	if ok {
+		return p, nil
+	}
+	envProfiles, err := StorageProfilesFromEnv(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := envProfiles[strings.ToLower(name)]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("storage profile %q not found", name)
+}
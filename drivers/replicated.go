@@ -0,0 +1,466 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// replicaChunkSize is the size of the chunks the SaveData stream is fanned out in
+const replicaChunkSize = 128 * 1024
+
+// replicaMaxChunksBehind is the number of chunks a replica can fall behind the
+// fastest ones
+const replicaMaxChunksBehind = 16
+
+var (
+	errReplicaDone   = errors.New("replica stopped reading")
+	errReplicaBehind = errors.New("replica fell behind the write quorum")
+)
+
+var _ OSSession = (*ReplicatedSession)(nil)
+
+// ReplicatedSession writes every object to a number of backend sessions. The
+// SaveData stream is read once and teed to all the replicas concurrently, with at
+// most replicaMaxChunksBehind chunks buffered per replica. SaveData succeeds as
+// soon as writeQuorum replicas acknowledge the write. Replicas which failed or
+// fell behind are recorded as lagging and can be brought up to date with Repair.
+type ReplicatedSession struct {
+	sessions    []OSSession
+	writeQuorum int
+
+	mu      sync.Mutex
+	lagging map[laggingKey]*LaggingReplica
+}
+
+// LaggingReplica describes an object that is missing or outdated on one replica
+type LaggingReplica struct {
+	Name    string
+	Replica int
+	Err     error
+	Time    time.Time
+	fields  *FileProperties
+}
+
+type laggingKey struct {
+	name    string
+	replica int
+}
+
+type replicaResult struct {
+	replica int
+	out     *SaveDataOutput
+	err     error
+}
+
+// NewReplicatedSession returns a session replicating writes to all sessions. The
+// first session is the preferred one for reads and listing. writeQuorum must be
+// between 1 and the number of sessions.
+func NewReplicatedSession(writeQuorum int, sessions ...OSSession) (*ReplicatedSession, error) {
+	if len(sessions) == 0 {
+		return nil, errors.New("no replica sessions specified")
+	}
+	if writeQuorum < 1 || writeQuorum > len(sessions) {
+		return nil, fmt.Errorf("invalid write quorum %d for %d replicas", writeQuorum, len(sessions))
+	}
+	return &ReplicatedSession{
+		sessions:    sessions,
+		writeQuorum: writeQuorum,
+		lagging:     make(map[laggingKey]*LaggingReplica),
+	}, nil
+}
+
+func (rs *ReplicatedSession) OS() OSDriver {
+	return rs.sessions[0].OS()
+}
+
+func (rs *ReplicatedSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	results := make(chan replicaResult, len(rs.sessions))
+	writers := make([]*io.PipeWriter, len(rs.sessions))
+	for i, sess := range rs.sessions {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		go func(i int, sess OSSession, pr *io.PipeReader) {
+			out, err := sess.SaveData(ctx, name, pr, fields, timeout)
+			if err != nil {
+				pr.CloseWithError(err)
+			} else {
+				pr.CloseWithError(errReplicaDone)
+			}
+			results <- replicaResult{replica: i, out: out, err: err}
+		}(i, sess, pr)
+	}
+
+	teeErr := rs.tee(data, writers)
+
+	var (
+		out       *SaveDataOutput
+		succeeded int
+		lastErr   error
+	)
+	for received := 0; received < len(rs.sessions); received++ {
+		res := <-results
+		if teeErr == nil {
+			// the replicas can't be blamed when the source failed
+			rs.recordResult(name, fields, res)
+		}
+		if res.err != nil {
+			lastErr = res.err
+		} else {
+			succeeded++
+			if out == nil {
+				out = res.out
+			}
+		}
+		if teeErr != nil {
+			continue
+		}
+		if succeeded >= rs.writeQuorum {
+			// let the remaining replicas finish in background
+			go rs.collect(name, fields, results, len(rs.sessions)-received-1)
+			return out, nil
+		}
+		if len(rs.sessions)-(received+1-succeeded) < rs.writeQuorum {
+			go rs.collect(name, fields, results, len(rs.sessions)-received-1)
+			break
+		}
+	}
+	if teeErr != nil {
+		return nil, teeErr
+	}
+	return nil, fmt.Errorf("write quorum not reached: %d of %d replicas succeeded, required %d: %w",
+		succeeded, len(rs.sessions), rs.writeQuorum, lastErr)
+}
+
+// tee copies data to all the writers until they fail or data is exhausted. Each
+// replica is fed from its own buffer, so that the slower ones don't hold the
+// others back. The replicas whose buffer is still full once the quorum took a
+// chunk are dropped, and recorded as lagging.
+func (rs *ReplicatedSession) tee(data io.Reader, writers []*io.PipeWriter) error {
+	progress := make(chan struct{}, 1)
+	feeds := make([]*replicaFeed, len(writers))
+	for i, pw := range writers {
+		feeds[i] = &replicaFeed{
+			pw:       pw,
+			chunks:   make(chan []byte, replicaMaxChunksBehind),
+			progress: progress,
+			exited:   make(chan struct{}),
+		}
+		go feeds[i].run()
+	}
+	// stop stops feeding the replicas, aborting their writes with err if set
+	stop := func(err error) {
+		for _, f := range feeds {
+			if f.stopped {
+				continue
+			}
+			f.stopped = true
+			if err != nil {
+				f.pw.CloseWithError(err)
+			}
+			close(f.chunks)
+		}
+	}
+	for {
+		failed := 0
+		for _, f := range feeds {
+			// the replicas dropped for falling behind are failed too
+			if f.stopped || (f.hasExited() && f.failed) {
+				failed++
+			}
+		}
+		if len(feeds)-failed < rs.writeQuorum {
+			// quorum can't be reached anymore, stop feeding the rest of the replicas
+			stop(errReplicaDone)
+			return nil
+		}
+		// the chunks are shared by the replicas, which read them at their pace
+		buf := make([]byte, replicaChunkSize)
+		n, err := data.Read(buf)
+		if n > 0 {
+			chunk := buf[:n]
+			accepted := 0
+			var behind []*replicaFeed
+			for _, f := range feeds {
+				if f.stopped || f.hasExited() {
+					continue
+				}
+				select {
+				case f.chunks <- chunk:
+					accepted++
+				default:
+					behind = append(behind, f)
+				}
+			}
+			// wait for the quorum to take the chunk
+			for accepted < rs.writeQuorum && accepted+len(behind) >= rs.writeQuorum {
+				<-progress
+				remaining := behind[:0]
+				for _, f := range behind {
+					if f.hasExited() {
+						continue
+					}
+					select {
+					case f.chunks <- chunk:
+						accepted++
+					default:
+						remaining = append(remaining, f)
+					}
+				}
+				behind = remaining
+			}
+			if accepted >= rs.writeQuorum {
+				// the replicas still behind would hold back the quorum
+				for _, f := range behind {
+					f.stopped = true
+					f.pw.CloseWithError(errReplicaBehind)
+					close(f.chunks)
+				}
+			}
+		}
+		if err == io.EOF {
+			// the replicas write the rest of their buffers, and SaveData waits for
+			// their results
+			stop(nil)
+			return nil
+		}
+		if err != nil {
+			stop(err)
+			return err
+		}
+	}
+}
+
+// replicaFeed writes the chunks of the SaveData stream to a replica
+type replicaFeed struct {
+	pw     *io.PipeWriter
+	chunks chan []byte
+	// progress is signaled when a chunk is taken from the buffer, or the replica
+	// stopped reading
+	progress chan struct{}
+	// exited is closed once the replica stopped reading, after failed is set
+	exited chan struct{}
+	failed bool
+	// stopped is set once the chunks are closed
+	stopped bool
+}
+
+func (f *replicaFeed) run() {
+	defer f.signal()
+	defer close(f.exited)
+	for chunk := range f.chunks {
+		f.signal()
+		if _, err := f.pw.Write(chunk); err != nil {
+			// a replica may stop reading because it is done (and succeeded) or because it failed
+			f.failed = err != errReplicaDone
+			return
+		}
+	}
+	f.pw.Close()
+}
+
+func (f *replicaFeed) signal() {
+	select {
+	case f.progress <- struct{}{}:
+	default:
+	}
+}
+
+func (f *replicaFeed) hasExited() bool {
+	select {
+	case <-f.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rs *ReplicatedSession) collect(name string, fields *FileProperties, results chan replicaResult, remaining int) {
+	for i := 0; i < remaining; i++ {
+		rs.recordResult(name, fields, <-results)
+	}
+}
+
+func (rs *ReplicatedSession) recordResult(name string, fields *FileProperties, res replicaResult) {
+	key := laggingKey{name: name, replica: res.replica}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if res.err == nil {
+		delete(rs.lagging, key)
+		return
+	}
+	rs.lagging[key] = &LaggingReplica{
+		Name:    name,
+		Replica: res.replica,
+		Err:     res.err,
+		Time:    time.Now(),
+		fields:  fields,
+	}
+}
+
+// Lagging returns the objects that failed to be written to some of the replicas
+func (rs *ReplicatedSession) Lagging() []LaggingReplica {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	res := make([]LaggingReplica, 0, len(rs.lagging))
+	for _, lr := range rs.lagging {
+		res = append(res, *lr)
+	}
+	return res
+}
+
+// Repair copies the lagging objects from a replica holding them to the replicas
+// missing them. Objects which could not be repaired stay recorded as lagging.
+func (rs *ReplicatedSession) Repair(ctx context.Context) error {
+	var lastErr error
+	for _, lr := range rs.Lagging() {
+		if err := rs.repair(ctx, lr); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (rs *ReplicatedSession) repair(ctx context.Context, lr LaggingReplica) error {
+	for i, sess := range rs.sessions {
+		if i == lr.Replica || rs.isLagging(lr.Name, i) {
+			continue
+		}
+		fi, err := sess.ReadData(ctx, lr.Name)
+		if err != nil {
+			continue
+		}
+		fields := lr.fields
+		if fields == nil {
+			fields = &FileProperties{Metadata: fi.Metadata, ContentType: fi.ContentType}
+		}
+		_, err = rs.sessions[lr.Replica].SaveData(ctx, lr.Name, fi.Body, fields, 0)
+		fi.Body.Close()
+		rs.recordResult(lr.Name, lr.fields, replicaResult{replica: lr.Replica, err: err})
+		return err
+	}
+	return fmt.Errorf("no healthy replica holds %s", lr.Name)
+}
+
+func (rs *ReplicatedSession) isLagging(name string, replica int) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	_, ok := rs.lagging[laggingKey{name: name, replica: replica}]
+	return ok
+}
+
+func (rs *ReplicatedSession) EndSession() {
+	for _, sess := range rs.sessions {
+		sess.EndSession()
+	}
+}
+
+func (rs *ReplicatedSession) GetInfo() *OSInfo {
+	return rs.sessions[0].GetInfo()
+}
+
+func (rs *ReplicatedSession) sessionKey() string {
+	if ks, ok := rs.sessions[0].(keyedSession); ok {
+		return ks.sessionKey()
+	}
+	return ""
+}
+
+func (rs *ReplicatedSession) IsExternal() bool {
+	for _, sess := range rs.sessions {
+		if sess.IsExternal() {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *ReplicatedSession) IsOwn(url string) bool {
+	for _, sess := range rs.sessions {
+		if sess.IsOwn(url) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs *ReplicatedSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	return rs.sessions[0].ListFiles(ctx, prefix, delim)
+}
+
+// DeleteFile deletes the object from all the replicas. It fails if the object
+// could not be deleted from at least writeQuorum of them.
+func (rs *ReplicatedSession) DeleteFile(ctx context.Context, name string) error {
+	var lastErr error
+	deleted := 0
+	for _, sess := range rs.sessions {
+		if err := sess.DeleteFile(ctx, name); err != nil {
+			lastErr = err
+			continue
+		}
+		deleted++
+	}
+	if deleted < rs.writeQuorum {
+		return fmt.Errorf("delete quorum not reached: %d of %d replicas succeeded: %w", deleted, len(rs.sessions), lastErr)
+	}
+	rs.mu.Lock()
+	for key := range rs.lagging {
+		if key.name == name {
+			delete(rs.lagging, key)
+		}
+	}
+	rs.mu.Unlock()
+	return nil
+}
+
+// ReadData reads the object from the first replica that is not known to lag behind
+func (rs *ReplicatedSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return rs.read(name, func(sess OSSession) (*FileInfoReader, error) {
+		return sess.ReadData(ctx, name)
+	})
+}
+
+func (rs *ReplicatedSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	return rs.read(name, func(sess OSSession) (*FileInfoReader, error) {
+		return sess.ReadDataRange(ctx, name, byteRange)
+	})
+}
+
+func (rs *ReplicatedSession) read(name string, readFn func(OSSession) (*FileInfoReader, error)) (*FileInfoReader, error) {
+	var lastErr error
+	for i, sess := range rs.sessions {
+		if rs.isLagging(name, i) {
+			continue
+		}
+		fi, err := readFn(sess)
+		if err == nil {
+			return fi, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no healthy replica holds %s", name)
+	}
+	return nil, lastErr
+}
+
+func (rs *ReplicatedSession) Presign(name string, expire time.Duration) (string, error) {
+	var lastErr error
+	for i, sess := range rs.sessions {
+		if rs.isLagging(name, i) {
+			continue
+		}
+		url, err := sess.Presign(name, expire)
+		if err == nil {
+			return url, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = ErrNotSupported
+	}
+	return "", lastErr
+}
@@ -0,0 +1,153 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicatedSessionWritesAllReplicas(t *testing.T) {
+	require := require.New(t)
+	data := make([]byte, 1024*1024+7)
+	rand.Read(data)
+	s1, s2, s3 := newFakeSession(), newFakeSession(), newFakeSession()
+	rs, err := NewReplicatedSession(3, s1, s2, s3)
+	require.NoError(err)
+
+	out, err := rs.SaveData(context.Background(), "rec/1.ts", bytes.NewReader(data), nil, 0)
+	require.NoError(err)
+	require.Equal("fake://rec/1.ts", out.URL)
+	for _, s := range []*fakeSession{s1, s2, s3} {
+		require.Equal(data, s.get("rec/1.ts"))
+	}
+	require.Empty(rs.Lagging())
+}
+
+func TestReplicatedSessionQuorumAndRepair(t *testing.T) {
+	require := require.New(t)
+	data := []byte("recording data")
+	s1, s2 := newFakeSession(), newFakeSession()
+	s2.setSaveErr(errors.New("provider outage"))
+	rs, err := NewReplicatedSession(1, s1, s2)
+	require.NoError(err)
+
+	_, err = rs.SaveData(context.Background(), "rec/1.ts", bytes.NewReader(data), &FileProperties{ContentType: "video/mp2t"}, 0)
+	require.NoError(err)
+	require.Eventually(func() bool { return len(rs.Lagging()) == 1 }, time.Second, time.Millisecond)
+	lagging := rs.Lagging()
+	require.Equal("rec/1.ts", lagging[0].Name)
+	require.Equal(1, lagging[0].Replica)
+	require.EqualError(lagging[0].Err, "provider outage")
+
+	// repair fails while the replica is still down
+	require.Error(rs.Repair(context.Background()))
+	require.Len(rs.Lagging(), 1)
+
+	s2.setSaveErr(nil)
+	require.NoError(rs.Repair(context.Background()))
+	require.Empty(rs.Lagging())
+	require.Equal(data, s2.get("rec/1.ts"))
+	require.Equal("video/mp2t", s2.objects["rec/1.ts"].fields.ContentType)
+}
+
+func TestReplicatedSessionQuorumNotReached(t *testing.T) {
+	require := require.New(t)
+	s1, s2, s3 := newFakeSession(), newFakeSession(), newFakeSession()
+	s2.setSaveErr(errors.New("outage 2"))
+	s3.setSaveErr(errors.New("outage 3"))
+	rs, err := NewReplicatedSession(2, s1, s2, s3)
+	require.NoError(err)
+
+	_, err = rs.SaveData(context.Background(), "rec/1.ts", bytes.NewReader(make([]byte, 1024*1024)), nil, 0)
+	require.ErrorContains(err, "write quorum not reached")
+
+	_, err = NewReplicatedSession(4, s1, s2, s3)
+	require.Error(err)
+}
+
+func TestReplicatedSessionSourceFailure(t *testing.T) {
+	require := require.New(t)
+	s1, s2 := newFakeSession(), newFakeSession()
+	rs, err := NewReplicatedSession(1, s1, s2)
+	require.NoError(err)
+
+	data := io.MultiReader(bytes.NewReader(make([]byte, 2*replicaChunkSize)), iotest.ErrReader(errors.New("source gone")))
+	_, err = rs.SaveData(context.Background(), "rec/1.ts", data, nil, 0)
+	require.EqualError(err, "source gone")
+	// the replicas aren't recorded as lagging
+	require.Empty(rs.Lagging())
+}
+
+// blockedSession starts reading the data saved once released
+type blockedSession struct {
+	*fakeSession
+	release chan struct{}
+}
+
+func (s blockedSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	<-s.release
+	return s.fakeSession.SaveData(ctx, name, data, fields, timeout)
+}
+
+func TestReplicatedSessionSlowReplica(t *testing.T) {
+	require := require.New(t)
+	data := make([]byte, (replicaMaxChunksBehind+4)*replicaChunkSize)
+	rand.Read(data)
+	s1, s2 := newFakeSession(), newFakeSession()
+	slow := blockedSession{newFakeSession(), make(chan struct{})}
+	rs, err := NewReplicatedSession(2, s1, s2, slow)
+	require.NoError(err)
+
+	// the replicas making the quorum aren't held back by the slow one
+	_, err = rs.SaveData(context.Background(), "rec/1.ts", bytes.NewReader(data), nil, 0)
+	require.NoError(err)
+	require.Equal(data, s1.get("rec/1.ts"))
+	require.Equal(data, s2.get("rec/1.ts"))
+	close(slow.release)
+	require.Eventually(func() bool { return len(rs.Lagging()) == 1 }, time.Second, time.Millisecond)
+	lagging := rs.Lagging()
+	require.Equal(2, lagging[0].Replica)
+	require.ErrorIs(lagging[0].Err, errReplicaBehind)
+	require.Nil(slow.get("rec/1.ts"))
+
+	// the slow replicas needed for the quorum are waited for
+	slow = blockedSession{newFakeSession(), make(chan struct{})}
+	rs, err = NewReplicatedSession(2, s1, slow)
+	require.NoError(err)
+	time.AfterFunc(50*time.Millisecond, func() { close(slow.release) })
+	_, err = rs.SaveData(context.Background(), "rec/2.ts", bytes.NewReader(data), nil, 0)
+	require.NoError(err)
+	require.Equal(data, slow.get("rec/2.ts"))
+	require.Empty(rs.Lagging())
+}
+
+func TestReplicatedSessionReadSkipsLaggingReplicas(t *testing.T) {
+	require := require.New(t)
+	s1, s2 := newFakeSession(), newFakeSession()
+	s1.setSaveErr(errors.New("outage"))
+	rs, err := NewReplicatedSession(1, s1, s2)
+	require.NoError(err)
+
+	_, err = rs.SaveData(context.Background(), "a.json", bytes.NewReader([]byte("{}")), nil, 0)
+	require.NoError(err)
+	require.Eventually(func() bool { return len(rs.Lagging()) == 1 }, time.Second, time.Millisecond)
+	// stale copy on the lagging replica must not be served
+	s1.put("a.json", []byte("stale"))
+
+	fi, err := rs.ReadData(context.Background(), "a.json")
+	require.NoError(err)
+	got, err := ioutil.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("{}", string(got))
+
+	require.NoError(rs.DeleteFile(context.Background(), "a.json"))
+	require.Empty(rs.Lagging())
+}
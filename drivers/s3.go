@@ -5,22 +5,29 @@ import (
 	"bytes"
 	"context"
 	"crypto/hmac"
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/request"
+	"hash/crc32"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -31,6 +38,9 @@ const (
 	S3_POLICY_EXPIRE_IN_HOURS = 24
 	// defaultSaveTimeout is used on save ops when no custom timeout is provided.
 	defaultSaveTimeout = 10 * time.Second
+	// policySignTimeout bounds the retrieval of the credentials signing a POST
+	// policy, or the remote signing of it
+	policySignTimeout = 10 * time.Second
 	// uploaderConcurrency controls how many parts to upload in parallel when
 	// saving a file to S3. Will only make a difference for large files (not small
 	// video segments), since we use a big part size.
@@ -40,6 +50,8 @@ const (
 	// Cloud Storage (also improves performance). Can make this configurable in
 	// the future for optimized support of other storage providers.
 	uploaderPartSize = 63 * 1024 * 1024
+	// s3SSECustomerAlgorithm is the only algorithm supported by SSE-C
+	s3SSECustomerAlgorithm = "AES256"
 	// default region parameter if we can't derive one from the url
 	defaultIgnoredRegion = "us-east-1"
 )
@@ -59,21 +71,41 @@ type S3OS struct {
 	s3svc              *s3.S3
 	s3sess             *session.Session
 	useFullAPI         bool
+	// sendChecksums enables the x-amz-checksum headers, and the verification of
+	// the data against the ETags, which S3-compatible services other than AWS
+	// might not support or not set to the MD5 of the data
+	sendChecksums bool
+	// creds are static when an access key is given, from the default chain otherwise
+	creds *credentials.Credentials
+	// objectDefaults has the S3 properties of the objects uploaded without them
+	objectDefaults FileProperties
+	config         *OSURL
 }
 
 type s3Session struct {
-	os          *S3OS
-	host        string
-	bucket      string
-	key         string
-	policy      string
-	signature   string
-	credential  string
-	xAmzDate    string
-	storageType OSInfo_StorageType
-	fields      map[string]string
-	s3svc       *s3.S3
-	s3sess      *session.Session
+	os            *S3OS
+	host          string
+	bucket        string
+	key           string
+	policy        string
+	signature     string
+	credential    string
+	xAmzDate      string
+	securityToken string
+	// objectDefaults has the S3 properties of the objects uploaded without them,
+	// the ones of the POST policy for sessions created from an OSInfo
+	objectDefaults FileProperties
+	storageType    OSInfo_StorageType
+	fields         map[string]string
+	s3svc          *s3.S3
+	s3sess         *session.Session
+	// sign creates the POST policy of ps allowing the object headers, for the
+	// sessions created by a driver. The policy of the session, given by GetInfo,
+	// is created once it's needed and allows none. The sessions created from an
+	// OSInfo are signed already.
+	sign     func(ctx context.Context, ps *s3Session, headers []string) error
+	signLock sync.Mutex
+	signed   bool
 }
 
 func s3Host(bucket string) string {
@@ -81,7 +113,7 @@ func s3Host(bucket string) string {
 }
 
 func customS3Host(host string, ssl bool) string {
-	if !strings.Contains("://", host) {
+	if !strings.Contains(host, "://") {
 		protocol := "http"
 		if ssl {
 			protocol = "https"
@@ -110,12 +142,19 @@ func customS3Region(host string) string {
 
 func newS3Session(info *S3OSInfo) OSSession {
 	sess := &s3Session{
-		host:        info.Host,
-		key:         info.Key,
-		policy:      info.Policy,
-		signature:   info.Signature,
-		xAmzDate:    info.XAmzDate,
-		credential:  info.Credential,
+		host:          info.Host,
+		key:           info.Key,
+		policy:        info.Policy,
+		signature:     info.Signature,
+		xAmzDate:      info.XAmzDate,
+		credential:    info.Credential,
+		securityToken: info.SecurityToken,
+		objectDefaults: FileProperties{
+			ACL:                  info.ACL,
+			StorageClass:         info.StorageClass,
+			ServerSideEncryption: info.ServerSideEncryption,
+			SSEKMSKeyID:          info.SSEKMSKeyID,
+		},
 		storageType: OSInfo_S3,
 	}
 	sess.fields = s3GetFields(sess)
@@ -123,91 +162,279 @@ func newS3Session(info *S3OSInfo) OSSession {
 }
 
 func NewS3Driver(region, bucket, accessKey, accessKeySecret string, keyPrefix string, useFullAPI bool) (OSDriver, error) {
+	return newS3Driver(&OSURL{
+		Scheme:   "s3",
+		User:     accessKey,
+		Password: accessKeySecret,
+		Host:     region,
+		Bucket:   bucket,
+		Path:     keyPrefix,
+	}, useFullAPI)
+}
+
+func newS3Driver(u *OSURL, useFullAPI bool) (OSDriver, error) {
+	opts, err := s3OptionsFromQuery(u.Query)
+	if err != nil {
+		return nil, err
+	}
 	os := &S3OS{
-		host:               s3Host(bucket),
-		region:             region,
-		bucket:             bucket,
-		awsAccessKeyID:     accessKey,
-		awsSecretAccessKey: accessKeySecret,
+		host:               s3Host(u.Bucket),
+		region:             u.Host,
+		bucket:             u.Bucket,
+		awsAccessKeyID:     u.User,
+		awsSecretAccessKey: u.Password,
 		useFullAPI:         useFullAPI,
-		keyPrefix:          keyPrefix,
+		keyPrefix:          u.Path,
+		sendChecksums:      true,
+		objectDefaults:     opts.objects,
+		config:             u.clone(),
 	}
-	if os.awsAccessKeyID != "" {
-		var err error
-		creds := credentials.NewStaticCredentials(os.awsAccessKeyID, os.awsSecretAccessKey, "")
-		cfg := aws.NewConfig().
-			WithRegion(os.region).
-			WithCredentials(creds)
-		os.s3sess, err = session.NewSession(cfg)
-		if err != nil {
-			return nil, err
-		}
-		os.s3svc = s3.New(os.s3sess)
+	os.creds, err = s3Credentials(os.region, "", u.User, u.Password, opts.role)
+	if err != nil {
+		return nil, err
 	}
+	cfg := aws.NewConfig().
+		WithRegion(os.region).
+		WithCredentials(os.creds)
+	os.s3sess, err = session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	os.s3svc = s3.New(os.s3sess)
 	return os, nil
 }
 
 // NewCustomS3Driver for creating S3-compatible stores other than S3 itself
 func NewCustomS3Driver(host, bucket, accessKey, accessKeySecret, keyPrefix string, useFullAPI bool, useSSL bool) (OSDriver, error) {
+	u := &OSURL{
+		Scheme:   "s3+http",
+		User:     accessKey,
+		Password: accessKeySecret,
+		Host:     host,
+		Bucket:   bucket,
+		Path:     keyPrefix,
+	}
+	if useSSL {
+		u.Scheme = "s3+https"
+	}
+	if endpoint, err := url.Parse(host); err == nil && strings.Contains(host, "://") {
+		u.Host = endpoint.Host
+		u.Scheme = "s3+" + endpoint.Scheme
+	}
+	return newCustomS3Driver(u, useFullAPI)
+}
+
+func newCustomS3Driver(u *OSURL, useFullAPI bool) (OSDriver, error) {
+	opts, err := s3OptionsFromQuery(u.Query)
+	if err != nil {
+		return nil, err
+	}
+	useSSL := u.Scheme == "s3+https"
 	os := &S3OS{
-		host:               customS3Host(host, useSSL),
-		bucket:             bucket,
-		awsAccessKeyID:     accessKey,
-		awsSecretAccessKey: accessKeySecret,
-		keyPrefix:          keyPrefix,
+		host:               customS3Host(u.Host, useSSL),
+		bucket:             u.Bucket,
+		awsAccessKeyID:     u.User,
+		awsSecretAccessKey: u.Password,
+		keyPrefix:          u.Path,
 		useFullAPI:         useFullAPI,
+		objectDefaults:     opts.objects,
+		config:             u.clone(),
 	}
 	os.region = customS3Region(os.host)
+	// S3-compatible services implementing STS, like MinIO, serve it on the same endpoint
+	os.creds, err = s3Credentials(os.region, os.host, u.User, u.Password, opts.role)
+	if err != nil {
+		return nil, err
+	}
+	cfg := aws.NewConfig().
+		WithRegion(os.region).
+		WithCredentials(os.creds).
+		WithEndpoint(os.host).
+		WithS3ForcePathStyle(true).
+		WithDisableSSL(!useSSL)
 	if !useFullAPI {
-		os.host += "/" + bucket
+		os.host += "/" + u.Bucket
 	}
-	if os.awsAccessKeyID != "" {
-		var err error
-		creds := credentials.NewStaticCredentials(os.awsAccessKeyID, os.awsSecretAccessKey, "")
-		cfg := aws.NewConfig().
-			WithRegion(os.region).
-			WithCredentials(creds).
-			WithEndpoint(host).
-			WithS3ForcePathStyle(true).
-			WithDisableSSL(!useSSL)
-		os.s3sess, err = session.NewSession(cfg)
-		if err != nil {
-			return nil, err
-		}
-		os.s3svc = s3.New(os.s3sess)
+	os.s3sess, err = session.NewSession(cfg)
+	if err != nil {
+		return nil, err
 	}
+	os.s3svc = s3.New(os.s3sess)
 	return os, nil
 }
 
+// s3DriverOptions are set through the query of OS URLs
+type s3DriverOptions struct {
+	role *s3AssumeRole
+	// objects has the S3 properties of the uploaded objects
+	objects FileProperties
+}
+
+func s3OptionsFromQuery(q url.Values) (*s3DriverOptions, error) {
+	opts := &s3DriverOptions{}
+	if q.Get("assumeRole") != "" {
+		opts.role = &s3AssumeRole{
+			roleARN:     q.Get("assumeRole"),
+			externalID:  q.Get("externalId"),
+			sessionName: q.Get("roleSessionName"),
+		}
+	}
+	var err error
+	opts.objects, err = s3PropertiesFromQuery(q)
+	return opts, err
+}
+
+// s3AssumeRole is the role assumed through STS to access the bucket
+type s3AssumeRole struct {
+	roleARN     string
+	externalID  string
+	sessionName string
+}
+
+// s3Credentials returns static credentials when an access key is given and the
+// default credential chain of the SDK otherwise: environment variables, shared
+// config and credentials files (honoring AWS_PROFILE), web identity tokens and
+// ECS or EC2 instance roles. When a role is given, it is assumed with these
+// credentials, using the STS service at stsEndpoint if not empty.
+func s3Credentials(region, stsEndpoint, accessKey, accessKeySecret string, role *s3AssumeRole) (*credentials.Credentials, error) {
+	var creds *credentials.Credentials
+	if accessKey != "" {
+		creds = credentials.NewStaticCredentials(accessKey, accessKeySecret, "")
+		if role == nil {
+			return creds, nil
+		}
+	}
+	if region == "" {
+		region = defaultIgnoredRegion
+	}
+	cfg := aws.NewConfig().
+		WithRegion(region).
+		WithCredentials(creds)
+	if stsEndpoint != "" {
+		cfg = cfg.WithEndpoint(stsEndpoint)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return sess.Config.Credentials, nil
+	}
+	return stscreds.NewCredentials(sess, role.roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if role.externalID != "" {
+			p.ExternalID = aws.String(role.externalID)
+		}
+		if role.sessionName != "" {
+			p.RoleSessionName = role.sessionName
+		}
+	}), nil
+}
+
 func (os *S3OS) NewSession(path string) OSSession {
-	policy, signature, credential, xAmzDate := createPolicy(os.awsAccessKeyID,
-		os.bucket, os.region, os.awsSecretAccessKey, path)
 	sess := &s3Session{
-		os:          os,
-		host:        os.host,
-		bucket:      os.bucket,
-		key:         os.keyPrefix + path,
-		policy:      policy,
-		signature:   signature,
-		credential:  credential,
-		xAmzDate:    xAmzDate,
-		storageType: OSInfo_S3,
+		os:             os,
+		host:           os.host,
+		bucket:         os.bucket,
+		key:            os.keyPrefix + path,
+		objectDefaults: os.objectDefaults,
+		storageType:    OSInfo_S3,
+	}
+	sess.sign = func(ctx context.Context, ps *s3Session, headers []string) error {
+		return os.signSession(ctx, ps, path, headers)
 	}
 	if os.useFullAPI {
 		sess.s3svc = os.s3svc
 		sess.s3sess = os.s3sess
 	}
-	sess.fields = s3GetFields(sess)
 	return sess
 }
 
+// signSession creates the POST policy of the session, allowing the headers
+func (os *S3OS) signSession(ctx context.Context, sess *s3Session, path string, headers []string) error {
+	if len(os.objectDefaults.SSECustomerKey) > 0 {
+		// the POST form would have to carry the customer key
+		return errors.New("S3 POST policies aren't supported with SSE-C")
+	}
+	// the POST policy is signed with the credentials retrieved from the chain,
+	// and can't outlive them
+	var creds credentials.Value
+	expireAt := time.Now().Add(S3_POLICY_EXPIRE_IN_HOURS * time.Hour)
+	if os.creds != nil {
+		var err error
+		if creds, err = os.creds.GetWithContext(ctx); err != nil {
+			return fmt.Errorf("error getting S3 credentials: %w", err)
+		}
+		if credsExpireAt, err := os.creds.ExpiresAt(); err == nil && credsExpireAt.Before(expireAt) {
+			expireAt = credsExpireAt
+		}
+	}
+	conditions := s3ObjectFields(os.objectDefaults)
+	if creds.SessionToken != "" {
+		conditions["x-amz-security-token"] = creds.SessionToken
+	}
+	sess.policy, sess.signature, sess.credential, sess.xAmzDate = createPolicy(creds.AccessKeyID,
+		os.bucket, os.region, creds.SecretAccessKey, path, expireAt, conditions, headers)
+	sess.securityToken = creds.SessionToken
+	sess.fields = s3GetFields(sess)
+	return nil
+}
+
+// signPolicy signs the POST policy of the session if it isn't yet
+func (os *s3Session) signPolicy(ctx context.Context) error {
+	if os.sign == nil {
+		return nil
+	}
+	os.signLock.Lock()
+	defer os.signLock.Unlock()
+	if os.signed {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, policySignTimeout)
+	defer cancel()
+	if err := os.sign(ctx, os, nil); err != nil {
+		return fmt.Errorf("error signing POST policy: %w", err)
+	}
+	os.signed = true
+	return nil
+}
+
+// headersPolicy returns the session holding the POST policy allowing the
+// object headers, the one of the session without headers. The policies with
+// headers are signed for every upload, as the forms must have the fields of
+// all the conditions.
+func (os *s3Session) headersPolicy(ctx context.Context, headers []string) (*s3Session, error) {
+	if len(headers) == 0 {
+		return os, os.signPolicy(ctx)
+	}
+	if os.sign == nil {
+		return nil, fmt.Errorf("object headers %s can't be set when saving with a POST policy", strings.Join(headers, ", "))
+	}
+	ctx, cancel := context.WithTimeout(ctx, policySignTimeout)
+	defer cancel()
+	ps := &s3Session{objectDefaults: os.objectDefaults}
+	if err := os.sign(ctx, ps, headers); err != nil {
+		return nil, fmt.Errorf("error signing POST policy: %w", err)
+	}
+	return ps, nil
+}
+
 func s3GetFields(sess *s3Session) map[string]string {
-	return map[string]string{
+	fields := map[string]string{
 		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
 		"x-amz-credential": sess.credential,
 		"x-amz-date":       sess.xAmzDate,
 		"x-amz-signature":  sess.signature,
 	}
+	if sess.securityToken != "" {
+		fields["x-amz-security-token"] = sess.securityToken
+	}
+	for k, v := range s3ObjectFields(sess.objectDefaults) {
+		fields[k] = v
+	}
+	return fields
 }
 
 func (os *s3Session) OS() OSDriver {
@@ -221,6 +448,10 @@ func (os *s3Session) IsExternal() bool {
 func (os *s3Session) EndSession() {
 }
 
+func (ostore *S3OS) Config() *OSURL {
+	return ostore.config.clone()
+}
+
 func (ostore *S3OS) UriSchemes() []string {
 	return []string{"s3", "s3+http", "s3+https"}
 }
@@ -341,12 +572,78 @@ func (os *s3Session) ReadDataRange(ctx context.Context, name, byteRange string)
 	if byteRange != "" {
 		params.Range = aws.String(byteRange)
 	}
+	if os.os != nil && os.os.sendChecksums {
+		params.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+	if key := os.objectDefaults.SSECustomerKey; len(key) > 0 {
+		params.SSECustomerAlgorithm = aws.String(s3SSECustomerAlgorithm)
+		params.SSECustomerKey = aws.String(string(key))
+	}
 	resp, err := os.s3svc.GetObjectWithContext(ctx, params)
 	if err != nil {
 		return nil, err
 	}
+	res := s3FileInfo(name, resp, os.etagChecksums())
+	if byteRange == "" && !res.Checksums.IsEmpty() {
+		res.Body = NewVerifyingReader(res.Body, res.Checksums)
+	}
+	return res, nil
+}
+
+// Stat returns the properties of the object with a HEAD request
+func (os *s3Session) Stat(ctx context.Context, name string) (*FileInfoReader, error) {
+	if os.s3svc == nil {
+		return nil, fmt.Errorf("Not implemented")
+	}
+	// TODO: Remove this compat once legacy clients stop sending the full path for reading
+	if os.key != "" && !strings.HasPrefix(name, os.key+"/") {
+		name = path.Join(os.key, name)
+	}
+	params := &s3.HeadObjectInput{
+		Bucket: aws.String(os.bucket),
+		Key:    aws.String(name),
+	}
+	if os.os != nil && os.os.sendChecksums {
+		params.ChecksumMode = aws.String(s3.ChecksumModeEnabled)
+	}
+	if key := os.objectDefaults.SSECustomerKey; len(key) > 0 {
+		params.SSECustomerAlgorithm = aws.String(s3SSECustomerAlgorithm)
+		params.SSECustomerKey = aws.String(string(key))
+	}
+	resp, err := os.s3svc.HeadObjectWithContext(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	// a HEAD response has the headers of the GET one
+	return s3FileInfo(name, &s3.GetObjectOutput{
+		CacheControl:         resp.CacheControl,
+		ChecksumCRC32C:       resp.ChecksumCRC32C,
+		ChecksumSHA256:       resp.ChecksumSHA256,
+		ContentDisposition:   resp.ContentDisposition,
+		ContentEncoding:      resp.ContentEncoding,
+		ContentLanguage:      resp.ContentLanguage,
+		ContentLength:        resp.ContentLength,
+		ContentType:          resp.ContentType,
+		ETag:                 resp.ETag,
+		Expires:              resp.Expires,
+		LastModified:         resp.LastModified,
+		Metadata:             resp.Metadata,
+		SSECustomerAlgorithm: resp.SSECustomerAlgorithm,
+		ServerSideEncryption: resp.ServerSideEncryption,
+	}, os.etagChecksums()), nil
+}
+
+func s3FileInfo(name string, resp *s3.GetObjectOutput, etagChecksums bool) *FileInfoReader {
 	res := &FileInfoReader{
-		Body: resp.Body,
+		Body:               resp.Body,
+		CacheControl:       aws.StringValue(resp.CacheControl),
+		ContentEncoding:    aws.StringValue(resp.ContentEncoding),
+		ContentDisposition: aws.StringValue(resp.ContentDisposition),
+		ContentLanguage:    aws.StringValue(resp.ContentLanguage),
+	}
+	if resp.Expires != nil {
+		// invalid dates are allowed, and mean already expired
+		res.Expires, _ = http.ParseTime(*resp.Expires)
 	}
 	if resp.LastModified != nil {
 		res.LastModified = *resp.LastModified
@@ -368,7 +665,34 @@ func (os *s3Session) ReadDataRange(ctx context.Context, name, byteRange string)
 			res.Metadata[k] = *v
 		}
 	}
-	return res, nil
+	if etagChecksums && resp.SSECustomerAlgorithm == nil && aws.StringValue(resp.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+		// ETags of objects encrypted with KMS or customer keys aren't the MD5 of the data
+		res.Checksums.MD5 = etagMD5(res.ETag)
+	}
+	if resp.ChecksumSHA256 != nil {
+		res.Checksums.SHA256 = decodeBase64Checksum(*resp.ChecksumSHA256, sha256.Size)
+	}
+	if resp.ChecksumCRC32C != nil {
+		res.Checksums.CRC32C = decodeBase64Checksum(*resp.ChecksumCRC32C, crc32.Size)
+	}
+	return res
+}
+
+// etagChecksums tells whether the ETags of the objects are the MD5 of their
+// data, when not encrypted with KMS or customer keys, as with AWS. The sessions
+// created from an OSInfo don't verify them.
+func (os *s3Session) etagChecksums() bool {
+	return os.os != nil && os.os.sendChecksums
+}
+
+// etagMD5 returns the MD5 checksum an ETag of an object uploaded in a single part
+// consists of, or nil for ETags of multipart uploads
+func etagMD5(etag string) []byte {
+	b, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(b) != md5.Size {
+		return nil
+	}
+	return b
 }
 
 func (os *s3Session) saveDataPut(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
@@ -381,6 +705,14 @@ func (os *s3Session) saveDataPut(ctx context.Context, name string, data io.Reade
 			metadata[k] = aws.String(v)
 		}
 	}
+	props, err := os.objectProperties(fields)
+	if err != nil {
+		return nil, err
+	}
+	precomputed, err := precomputeChecksums(data)
+	if err != nil {
+		return nil, err
+	}
 	data, contentType, err := os.peekContentType(name, data)
 	if err != nil {
 		return nil, err
@@ -388,6 +720,7 @@ func (os *s3Session) saveDataPut(ctx context.Context, name string, data io.Reade
 	if fields != nil && fields.ContentType != "" {
 		contentType = fields.ContentType
 	}
+	cr := newChecksumReader(data)
 
 	respHeaders := http.Header{}
 	uploader := s3manager.NewUploader(os.s3sess, func(u *s3manager.Uploader) {
@@ -399,25 +732,77 @@ func (os *s3Session) saveDataPut(ctx context.Context, name string, data io.Reade
 		Bucket:      bucket,
 		Key:         keyname,
 		Metadata:    metadata,
-		Body:        data,
+		Body:        cr,
 		ContentType: aws.String(contentType),
 	}
+	if precomputed != nil {
+		// only used by S3 when uploading in a single part, parts of multipart
+		// uploads are verified with the Content-MD5 computed by the SDK
+		params.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(precomputed.MD5))
+		if os.os.sendChecksums {
+			params.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(precomputed.SHA256))
+		}
+	}
 	if fields != nil {
-		params.CacheControl = &fields.CacheControl
+		if fields.CacheControl != "" {
+			params.CacheControl = aws.String(fields.CacheControl)
+		}
+		if fields.ContentEncoding != "" {
+			params.ContentEncoding = aws.String(fields.ContentEncoding)
+		}
+		if fields.ContentDisposition != "" {
+			params.ContentDisposition = aws.String(fields.ContentDisposition)
+		}
+		if fields.ContentLanguage != "" {
+			params.ContentLanguage = aws.String(fields.ContentLanguage)
+		}
+		if !fields.Expires.IsZero() {
+			params.Expires = aws.Time(fields.Expires)
+		}
+	}
+	if props.ACL != "" {
+		params.ACL = aws.String(props.ACL)
+	}
+	if props.StorageClass != "" {
+		params.StorageClass = aws.String(props.StorageClass)
+	}
+	if props.ServerSideEncryption != "" {
+		params.ServerSideEncryption = aws.String(props.ServerSideEncryption)
+	}
+	if props.SSEKMSKeyID != "" {
+		params.SSEKMSKeyId = aws.String(props.SSEKMSKeyID)
+	}
+	if len(props.SSECustomerKey) > 0 {
+		// the SDK encodes the key and adds its MD5
+		params.SSECustomerAlgorithm = aws.String(s3SSECustomerAlgorithm)
+		params.SSECustomerKey = aws.String(string(props.SSECustomerKey))
 	}
 	if timeout == 0 {
 		timeout = defaultSaveTimeout
 	}
 	ctx, cancel := context.WithTimeout(ctx, timeout)
-	_, err = uploader.UploadWithContext(ctx, params)
+	out, err := uploader.UploadWithContext(ctx, params)
 	cancel()
 	if err != nil {
 		return nil, err
 	}
+	sums := cr.Sum()
+	if out.ETag != nil && os.etagChecksums() && respHeaders.Get("X-Amz-Server-Side-Encryption") != s3.ServerSideEncryptionAwsKms &&
+		respHeaders.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == "" {
+		if err := sums.Verify(Checksums{MD5: etagMD5(*out.ETag)}); err != nil {
+			return nil, fmt.Errorf("error verifying upload of %s: %w", *keyname, err)
+		}
+	}
 
 	return &SaveDataOutput{
 		URL:                     os.getAbsURL(*keyname),
 		UploaderResponseHeaders: respHeaders,
+		Key:                     *keyname,
+		Size:                    cr.size,
+		ETag:                    aws.StringValue(out.ETag),
+		ContentType:             contentType,
+		VersionID:               aws.StringValue(out.VersionID),
+		Checksums:               sums,
 	}, nil
 }
 
@@ -440,15 +825,7 @@ func (os *s3Session) SaveData(ctx context.Context, name string, data io.Reader,
 	if os.s3svc != nil {
 		return os.saveDataPut(ctx, name, data, fields, timeout)
 	}
-	_ = path.Join(os.host, os.key, name)
-	path, err := os.postData(ctx, name, data, fields, timeout)
-	if err != nil {
-		// handle error
-		return nil, err
-	}
-
-	url := os.getAbsURL(path)
-	return &SaveDataOutput{URL: url}, nil
+	return os.postData(ctx, name, data, fields, timeout)
 }
 
 func (os *s3Session) getAbsURL(path string) string {
@@ -458,16 +835,28 @@ func (os *s3Session) getAbsURL(path string) string {
 	return os.host + "/" + os.bucket + "/" + path
 }
 
+func (os *s3Session) sessionKey() string {
+	return os.key
+}
+
+// GetInfo returns the info of the session, with the POST policy signed on the
+// first call. The policy is left out if signing fails, SaveData reports why.
 func (os *s3Session) GetInfo() *OSInfo {
+	os.signPolicy(context.Background())
 	oi := &OSInfo{
 		S3Info: &S3OSInfo{
-			Host:       os.host,
-			Bucket:     os.bucket,
-			Key:        os.key,
-			Policy:     os.policy,
-			Signature:  os.signature,
-			Credential: os.credential,
-			XAmzDate:   os.xAmzDate,
+			Host:                 os.host,
+			Bucket:               os.bucket,
+			Key:                  os.key,
+			Policy:               os.policy,
+			Signature:            os.signature,
+			Credential:           os.credential,
+			XAmzDate:             os.xAmzDate,
+			SecurityToken:        os.securityToken,
+			ACL:                  os.objectDefaults.ACL,
+			StorageClass:         os.objectDefaults.StorageClass,
+			ServerSideEncryption: os.objectDefaults.ServerSideEncryption,
+			SSEKMSKeyID:          os.objectDefaults.SSEKMSKeyID,
 		},
 		StorageType: os.storageType,
 	}
@@ -475,6 +864,12 @@ func (os *s3Session) GetInfo() *OSInfo {
 }
 
 func (os *s3Session) peekContentType(fileName string, data io.Reader) (*bufio.Reader, string, error) {
+	return peekContentType(fileName, data)
+}
+
+// peekContentType returns the content type derived from the file extension or, if
+// unknown, sniffed from the first bytes of data. Returned reader replaces data.
+func peekContentType(fileName string, data io.Reader) (*bufio.Reader, string, error) {
 	bufData := bufio.NewReaderSize(data, 4096)
 	firstBytes, err := bufData.Peek(512)
 	if err != nil && err != io.EOF {
@@ -489,45 +884,89 @@ func (os *s3Session) peekContentType(fileName string, data io.Reader) (*bufio.Re
 }
 
 // if s3 storage is not our own, we are saving data into it using POST request
-func (os *s3Session) postData(ctx context.Context, fileName string, data io.Reader, props *FileProperties, timeout time.Duration) (string, error) {
+func (os *s3Session) postData(ctx context.Context, fileName string, data io.Reader, props *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	if props != nil {
+		// the properties are conditions of the POST policy, signed by the owner
+		objProps, err := os.objectProperties(props)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(s3ObjectFields(objProps), s3ObjectFields(os.objectDefaults)) {
+			return nil, errors.New("S3 object properties can't be changed when saving with a POST policy")
+		}
+	}
+	headerFields := postHeaderFields(props)
+	headers := make([]string, 0, len(headerFields))
+	for k := range headerFields {
+		headers = append(headers, k)
+	}
+	sort.Strings(headers)
+	ps, err := os.headersPolicy(ctx, headers)
+	if err != nil {
+		return nil, err
+	}
 	data, fileType, err := os.peekContentType(fileName, data)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	cr := newChecksumReader(data)
 	path, fileName := path.Split(path.Join(os.key, fileName))
 	fields := map[string]string{
 		"acl":          "public-read",
 		"Content-Type": fileType,
 		"key":          path + "${filename}",
-		"policy":       os.policy,
+		"policy":       ps.policy,
+	}
+	for k, v := range ps.fields {
+		fields[k] = v
 	}
-	for k, v := range os.fields {
+	for k, v := range headerFields {
 		fields[k] = v
 	}
 	postURL := os.host
 	if !strings.Contains(postURL, os.bucket) {
 		postURL += "/" + os.bucket
 	}
-	req, cancel, err := newfileUploadRequest(ctx, postURL, fields, data, fileName, timeout)
+	req, cancel, err := newfileUploadRequest(ctx, postURL, fields, cr, fileName, timeout)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	cancel()
 	body := &bytes.Buffer{}
 	sz, err := body.ReadFrom(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	resp.Body.Close()
 	if sz > 0 {
-		return "", fmt.Errorf(body.String()) // body likely to contain error message
+		return nil, fmt.Errorf(body.String()) // body likely to contain error message
+	}
+	key := path + fileName
+	sums := cr.Sum()
+	etag := resp.Header.Get("ETag")
+	// ETags of objects encrypted with KMS or customer keys aren't the MD5 of the data
+	if os.etagChecksums() && os.objectDefaults.ServerSideEncryption != s3.ServerSideEncryptionAwsKms &&
+		resp.Header.Get("X-Amz-Server-Side-Encryption") != s3.ServerSideEncryptionAwsKms &&
+		resp.Header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") == "" {
+		if err := sums.Verify(Checksums{MD5: etagMD5(etag)}); err != nil {
+			return nil, fmt.Errorf("error verifying upload of %s: %w", key, err)
+		}
 	}
-	return path + fileName, err
+	return &SaveDataOutput{
+		URL:                     os.getAbsURL(key),
+		UploaderResponseHeaders: resp.Header,
+		Key:                     key,
+		Size:                    cr.size,
+		ETag:                    etag,
+		ContentType:             fileType,
+		VersionID:               resp.Header.Get("X-Amz-Version-Id"),
+		Checksums:               sums,
+	}, nil
 }
 
 func (os *s3Session) IsOwn(url string) bool {
@@ -562,25 +1001,40 @@ func signString(stringToSign, sregion, amzDate, secret string) string {
 	return sSignature
 }
 
-// createPolicy returns policy, signature, xAmzCredentail and xAmzDate
-func createPolicy(key, bucket, region, secret, path string) (string, string, string, string) {
+// createPolicy returns policy, signature, xAmzCredentail and xAmzDate. The
+// policy requires the form fields in conditions to have the given values, and
+// allows any value for the object headers.
+func createPolicy(key, bucket, region, secret, path string, expireAt time.Time, conditions map[string]string, headers []string) (string, string, string, string) {
 	const timeFormat = "2006-01-02T15:04:05.999Z"
 	const shortTimeFormat = "20060102"
 
-	expireAt := time.Now().Add(S3_POLICY_EXPIRE_IN_HOURS * time.Hour)
 	expireFmt := expireAt.UTC().Format(timeFormat)
 	xAmzDate := time.Now().UTC().Format(shortTimeFormat)
 	xAmzCredential := fmt.Sprintf("%s/%s/%s/s3/aws4_request", key, xAmzDate, region)
+	if _, ok := conditions["acl"]; !ok {
+		conditions["acl"] = "public-read"
+	}
+	names := make([]string, 0, len(conditions))
+	for name := range conditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var extraConditions strings.Builder
+	for _, name := range names {
+		nameJSON, _ := json.Marshal(name)
+		valueJSON, _ := json.Marshal(conditions[name])
+		fmt.Fprintf(&extraConditions, `,
+		{%s: %s}`, nameJSON, valueJSON)
+	}
 	src := fmt.Sprintf(`{ "expiration": "%s",
 	"conditions": [
 		{"bucket": "%s"},
-		{"acl": "public-read"},
-		["starts-with", "$Content-Type", ""],
+		["starts-with", "$Content-Type", ""],%s
 		["starts-with", "$key", "%s"],
 		{"x-amz-algorithm": "AWS4-HMAC-SHA256"},
 		{"x-amz-credential": "%s"},
-		{"x-amz-date": "%sT000000Z" }
-	]}`, expireFmt, bucket, path, xAmzCredential, xAmzDate)
+		{"x-amz-date": "%sT000000Z" }%s
+	]}`, expireFmt, bucket, postHeaderConditions(headers), path, xAmzCredential, xAmzDate, extraConditions.String())
 	policy := base64.StdEncoding.EncodeToString([]byte(src))
 	return policy, signString(policy, region, xAmzDate, secret), xAmzCredential, xAmzDate + "T000000Z"
 }
@@ -613,3 +1067,135 @@ func newfileUploadRequest(ctx context.Context, uri string, params map[string]str
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	return req, cancel, err
 }
+
+// s3PropertiesFromQuery returns the S3 properties of uploaded objects set by the
+// acl, storageClass, sse, sseKmsKeyId and sseCustomerKey (base64) query parameters
+func s3PropertiesFromQuery(q url.Values) (FileProperties, error) {
+	props := FileProperties{
+		ACL:                  q.Get("acl"),
+		StorageClass:         q.Get("storageClass"),
+		ServerSideEncryption: q.Get("sse"),
+		SSEKMSKeyID:          q.Get("sseKmsKeyId"),
+	}
+	if key := q.Get("sseCustomerKey"); key != "" {
+		var err error
+		if props.SSECustomerKey, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return props, fmt.Errorf("invalid sseCustomerKey: %w", err)
+		}
+	}
+	return props, validateS3Properties(props)
+}
+
+func validateS3Properties(props FileProperties) error {
+	valid := func(name, value string, values []string) error {
+		if value == "" {
+			return nil
+		}
+		for _, v := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid S3 %s %q, expected one of %s", name, value, strings.Join(values, ", "))
+	}
+	if err := valid("ACL", props.ACL, s3.ObjectCannedACL_Values()); err != nil {
+		return err
+	}
+	if err := valid("storage class", props.StorageClass, s3.StorageClass_Values()); err != nil {
+		return err
+	}
+	if err := valid("server-side encryption", props.ServerSideEncryption, s3.ServerSideEncryption_Values()); err != nil {
+		return err
+	}
+	if props.SSEKMSKeyID != "" && props.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("S3 KMS key ID requires %s server-side encryption", s3.ServerSideEncryptionAwsKms)
+	}
+	if len(props.SSECustomerKey) > 0 {
+		if len(props.SSECustomerKey) != 32 {
+			return errors.New("S3 SSE-C key must be 256 bits long")
+		}
+		if props.ServerSideEncryption != "" {
+			return errors.New("S3 SSE-C can't be combined with other server-side encryption")
+		}
+	}
+	return nil
+}
+
+// objectProperties returns the S3 properties of an uploaded object, the ones in
+// fields overriding the session defaults
+func (os *s3Session) objectProperties(fields *FileProperties) (FileProperties, error) {
+	props := os.objectDefaults
+	if fields == nil {
+		return props, nil
+	}
+	if fields.ACL != "" {
+		props.ACL = fields.ACL
+	}
+	if fields.StorageClass != "" {
+		props.StorageClass = fields.StorageClass
+	}
+	if fields.ServerSideEncryption != "" || fields.SSEKMSKeyID != "" || len(fields.SSECustomerKey) > 0 {
+		props.ServerSideEncryption = fields.ServerSideEncryption
+		props.SSEKMSKeyID = fields.SSEKMSKeyID
+		props.SSECustomerKey = fields.SSECustomerKey
+	}
+	return props, validateS3Properties(props)
+}
+
+// s3ObjectFields returns the POST form fields setting the S3 properties
+func s3ObjectFields(props FileProperties) map[string]string {
+	fields := make(map[string]string)
+	if props.ACL != "" {
+		fields["acl"] = props.ACL
+	}
+	if props.StorageClass != "" {
+		fields["x-amz-storage-class"] = props.StorageClass
+	}
+	if props.ServerSideEncryption != "" {
+		fields["x-amz-server-side-encryption"] = props.ServerSideEncryption
+	}
+	if props.SSEKMSKeyID != "" {
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = props.SSEKMSKeyID
+	}
+	if len(props.SSECustomerKey) > 0 {
+		keyMD5 := md5.Sum(props.SSECustomerKey)
+		fields["x-amz-server-side-encryption-customer-algorithm"] = s3SSECustomerAlgorithm
+		fields["x-amz-server-side-encryption-customer-key"] = base64.StdEncoding.EncodeToString(props.SSECustomerKey)
+		fields["x-amz-server-side-encryption-customer-key-MD5"] = base64.StdEncoding.EncodeToString(keyMD5[:])
+	}
+	return fields
+}
+
+// postHeaderConditions returns the POST policy conditions allowing any value
+// for the headers set by postHeaderFields. The forms missing the field of a
+// condition are rejected, so only the headers sent are conditioned.
+func postHeaderConditions(headers []string) string {
+	var b strings.Builder
+	for _, h := range headers {
+		fmt.Fprintf(&b, `
+		["starts-with", "$%s", ""],`, h)
+	}
+	return b.String()
+}
+
+// postHeaderFields returns the POST form fields setting the headers of the object
+func postHeaderFields(props *FileProperties) map[string]string {
+	fields := make(map[string]string)
+	if props == nil {
+		return fields
+	}
+	for k, v := range map[string]string{
+		"Cache-Control":       props.CacheControl,
+		"Content-Disposition": props.ContentDisposition,
+		"Content-Encoding":    props.ContentEncoding,
+		"Content-Language":    props.ContentLanguage,
+	} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	if !props.Expires.IsZero() {
+		fields["Expires"] = props.Expires.UTC().Format(http.TimeFormat)
+	}
+	return fields
+}
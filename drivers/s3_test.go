@@ -3,8 +3,15 @@ package drivers
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
@@ -196,3 +203,434 @@ func TestWasabiS3Upload(t *testing.T) {
 		t.Skip("No Wasabi S3 credentials, test skipped")
 	}
 }
+
+// isolateAwsEnv keeps the default credential chain from using the credentials
+// of the machine running the tests
+func isolateAwsEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", path.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", path.Join(dir, "credentials"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+}
+
+func decodePolicy(require *require.Assertions, policy string) string {
+	src, err := base64.StdEncoding.DecodeString(policy)
+	require.NoError(err)
+	require.True(json.Valid(src))
+	return string(src)
+}
+
+func TestS3DefaultCredentialChain(t *testing.T) {
+	require := require.New(t)
+	isolateAwsEnv(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "ASIAENVKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "env-token")
+
+	os, err := ParseOSURL("s3://us-west-2/example-bucket/key", false)
+	require.NoError(err)
+	s3 := os.(*S3OS)
+	require.Equal("", s3.awsAccessKeyID)
+	require.NotNil(s3.s3svc)
+
+	info := os.NewSession("stream").GetInfo().S3Info
+	require.Equal("env-token", info.SecurityToken)
+	require.True(strings.HasPrefix(info.Credential, "ASIAENVKEY/"))
+	require.Contains(decodePolicy(require, info.Policy), `{"x-amz-security-token": "env-token"}`)
+
+	sess := newS3Session(info).(*s3Session)
+	require.Equal("env-token", sess.fields["x-amz-security-token"])
+	require.Equal(info.Credential, sess.fields["x-amz-credential"])
+
+	_, err = ParseOSURL("s3+https://minio.example.com/example-bucket", false)
+	require.NoError(err)
+	_, err = ParseOSURL("s3://user@us-west-2/example-bucket", false)
+	require.EqualError(err, "password is required with s3:// OS")
+}
+
+func TestS3StaticCredentialsPolicy(t *testing.T) {
+	require := require.New(t)
+	os, err := ParseOSURL("s3://user:secret@us-west-2/example-bucket", false)
+	require.NoError(err)
+	info := os.NewSession("stream").GetInfo().S3Info
+	require.Equal("", info.SecurityToken)
+	require.True(strings.HasPrefix(info.Credential, "user/"))
+	require.NotContains(decodePolicy(require, info.Policy), "x-amz-security-token")
+	_, ok := newS3Session(info).(*s3Session).fields["x-amz-security-token"]
+	require.False(ok)
+}
+
+func TestS3AssumeRole(t *testing.T) {
+	require := require.New(t)
+	isolateAwsEnv(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "base-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "base-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var form url.Values
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(r.ParseForm())
+		form = r.PostForm
+		require.Contains(r.Header.Get("Authorization"), "Credential=base-key/")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAROLEKEY</AccessKeyId>
+      <SecretAccessKey>role-secret</SecretAccessKey>
+      <SessionToken>role-token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, expiration.Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	u := fmt.Sprintf("s3+http://%s/example-bucket?assumeRole=%s&externalId=ext&roleSessionName=recordings",
+		strings.TrimPrefix(sts.URL, "http://"), url.QueryEscape("arn:aws:iam::123456789012:role/writer"))
+	os, err := ParseOSURL(u, false)
+	require.NoError(err)
+
+	info := os.NewSession("stream").GetInfo().S3Info
+	require.Equal("AssumeRole", form.Get("Action"))
+	require.Equal("arn:aws:iam::123456789012:role/writer", form.Get("RoleArn"))
+	require.Equal("ext", form.Get("ExternalId"))
+	require.Equal("recordings", form.Get("RoleSessionName"))
+	require.Equal("role-token", info.SecurityToken)
+	require.True(strings.HasPrefix(info.Credential, "ASIAROLEKEY/"))
+
+	// the policy expires with the credentials it is signed with
+	var policy struct {
+		Expiration time.Time `json:"expiration"`
+	}
+	require.NoError(json.Unmarshal([]byte(decodePolicy(require, info.Policy)), &policy))
+	require.False(policy.Expiration.After(expiration.Add(time.Second)))
+}
+
+func TestS3AssumeRoleFailure(t *testing.T) {
+	require := require.New(t)
+	isolateAwsEnv(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "base-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "base-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	calls := 0
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>not allowed</Message></Error></ErrorResponse>`)
+	}))
+	defer sts.Close()
+
+	u := fmt.Sprintf("s3+http://%s/example-bucket?assumeRole=%s",
+		strings.TrimPrefix(sts.URL, "http://"), url.QueryEscape("arn:aws:iam::123456789012:role/writer"))
+	os, err := ParseOSURL(u, false)
+	require.NoError(err)
+
+	// the credentials are only retrieved once the policy is needed
+	sess := os.NewSession("stream")
+	require.Equal(0, calls)
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "error signing POST policy: error getting S3 credentials")
+	require.Empty(sess.GetInfo().S3Info.Policy)
+}
+
+func TestS3ObjectPropertiesPolicy(t *testing.T) {
+	require := require.New(t)
+	os, err := ParseOSURL("s3://user:secret@us-west-2/example-bucket?acl=private&storageClass=STANDARD_IA&sse=aws:kms&sseKmsKeyId=key-id", false)
+	require.NoError(err)
+	info := os.NewSession("stream").GetInfo().S3Info
+	require.Equal("private", info.ACL)
+	require.Equal("STANDARD_IA", info.StorageClass)
+	require.Equal("aws:kms", info.ServerSideEncryption)
+	require.Equal("key-id", info.SSEKMSKeyID)
+	policy := decodePolicy(require, info.Policy)
+	require.Contains(policy, `{"acl": "private"}`)
+	require.NotContains(policy, "public-read")
+	require.Contains(policy, `{"x-amz-storage-class": "STANDARD_IA"}`)
+	require.Contains(policy, `{"x-amz-server-side-encryption": "aws:kms"}`)
+	require.Contains(policy, `{"x-amz-server-side-encryption-aws-kms-key-id": "key-id"}`)
+
+	fields := newS3Session(info).(*s3Session).fields
+	require.Equal("private", fields["acl"])
+	require.Equal("STANDARD_IA", fields["x-amz-storage-class"])
+	require.Equal("aws:kms", fields["x-amz-server-side-encryption"])
+	require.Equal("key-id", fields["x-amz-server-side-encryption-aws-kms-key-id"])
+
+	// the default ACL of POST policies is kept
+	os, err = ParseOSURL("s3://user:secret@us-west-2/example-bucket", false)
+	require.NoError(err)
+	require.Contains(decodePolicy(require, os.NewSession("").GetInfo().S3Info.Policy), `{"acl": "public-read"}`)
+
+	for query, expected := range map[string]string{
+		"storageClass=COLD":                  `invalid S3 storage class "COLD"`,
+		"acl=everyone":                       `invalid S3 ACL "everyone"`,
+		"sse=AES256&sseKmsKeyId=key-id":      "S3 KMS key ID requires aws:kms server-side encryption",
+		"sseCustomerKey=c2hvcnQ=":            "S3 SSE-C key must be 256 bits long",
+		"sseCustomerKey=not-base64":          "invalid sseCustomerKey",
+		"sse=AES256&sseCustomerKey=" + key32: "S3 SSE-C can't be combined with other server-side encryption",
+	} {
+		_, err = ParseOSURL("s3://user:secret@us-west-2/example-bucket?"+query, false)
+		require.ErrorContains(err, expected, query)
+	}
+}
+
+var key32 = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+func TestS3ObjectPropertiesPost(t *testing.T) {
+	require := require.New(t)
+	var form *multipart.Form
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(r.ParseMultipartForm(1 << 20))
+		form = r.MultipartForm
+		// the ETag of objects encrypted with KMS isn't the MD5 of the data
+		w.Header().Set("X-Amz-Server-Side-Encryption", "aws:kms")
+		w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	os, err := ParseOSURL("s3+http://user:secret@"+strings.TrimPrefix(server.URL, "http://")+"/bucket?storageClass=GLACIER_IR&sse=aws:kms", false)
+	require.NoError(err)
+	sess := newS3Session(os.NewSession("stream").GetInfo().S3Info)
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("data"), &FileProperties{Metadata: map[string]string{"a": "b"}}, 0)
+	require.NoError(err)
+	require.Equal([]string{"GLACIER_IR"}, form.Value["x-amz-storage-class"])
+	require.Equal([]string{"aws:kms"}, form.Value["x-amz-server-side-encryption"])
+	require.Equal([]string{"public-read"}, form.Value["acl"])
+
+	_, err = sess.SaveData(context.Background(), "2.ts", strings.NewReader("data"), &FileProperties{StorageClass: "STANDARD"}, 0)
+	require.EqualError(err, "S3 object properties can't be changed when saving with a POST policy")
+
+	// the SSE-C key isn't handed over with a POST policy
+	form = nil
+	os, err = ParseOSURL("s3+http://user:secret@"+strings.TrimPrefix(server.URL, "http://")+"/bucket?sseCustomerKey="+url.QueryEscape(key32), false)
+	require.NoError(err)
+	driverSess := os.NewSession("stream")
+	info := driverSess.GetInfo().S3Info
+	require.Empty(info.Policy)
+	require.Empty(info.Signature)
+	infoJSON, err := json.Marshal(info)
+	require.NoError(err)
+	require.NotContains(string(infoJSON), key32)
+	_, err = driverSess.SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.EqualError(err, "error signing POST policy: S3 POST policies aren't supported with SSE-C")
+	require.Nil(form)
+}
+
+func TestS3ObjectPropertiesUpload(t *testing.T) {
+	require := require.New(t)
+	isolateAwsEnv(t)
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(http.MethodPut, r.Method)
+		headers = r.Header
+		body := new(bytes.Buffer)
+		body.ReadFrom(r.Body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body.Bytes())))
+	}))
+	defer server.Close()
+
+	os, err := ParseOSURL("s3+http://user:secret@"+strings.TrimPrefix(server.URL, "http://")+"/bucket?storageClass=INTELLIGENT_TIERING&sse=AES256&acl=private", true)
+	require.NoError(err)
+	sess := os.NewSession("stream")
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	require.Equal("INTELLIGENT_TIERING", headers.Get("X-Amz-Storage-Class"))
+	require.Equal("AES256", headers.Get("X-Amz-Server-Side-Encryption"))
+	require.Equal("private", headers.Get("X-Amz-Acl"))
+
+	// object properties override the ones of the URL
+	_, err = sess.SaveData(context.Background(), "2.ts", strings.NewReader("data"), &FileProperties{
+		ACL:                  "bucket-owner-full-control",
+		StorageClass:         "GLACIER_IR",
+		ServerSideEncryption: "aws:kms",
+		SSEKMSKeyID:          "key-id",
+	}, 0)
+	require.NoError(err)
+	require.Equal("GLACIER_IR", headers.Get("X-Amz-Storage-Class"))
+	require.Equal("aws:kms", headers.Get("X-Amz-Server-Side-Encryption"))
+	require.Equal("key-id", headers.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	require.Equal("bucket-owner-full-control", headers.Get("X-Amz-Acl"))
+
+	_, err = sess.SaveData(context.Background(), "3.ts", strings.NewReader("data"), &FileProperties{StorageClass: "COLD"}, 0)
+	require.ErrorContains(err, `invalid S3 storage class "COLD"`)
+}
+
+func TestS3CompatibleETags(t *testing.T) {
+	require := require.New(t)
+	isolateAwsEnv(t)
+	var data []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// e.g. MinIO with SSE, the ETags aren't the MD5 of the data
+		w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+		switch r.Method {
+		case http.MethodPut:
+			data, _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	os, err := ParseOSURL("s3+http://user:secret@"+strings.TrimPrefix(server.URL, "http://")+"/bucket", true)
+	require.NoError(err)
+	sess := os.NewSession("stream")
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	fi, err := sess.ReadData(context.Background(), "1.ts")
+	require.NoError(err)
+	read, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	require.Equal("data", string(read))
+	require.Nil(fi.Checksums.MD5)
+
+	// the ETags are verified with AWS
+	os.(*S3OS).sendChecksums = true
+	_, err = sess.SaveData(context.Background(), "1.ts", strings.NewReader("data"), nil, 0)
+	require.ErrorContains(err, "error verifying upload of stream/1.ts")
+}
+
+func TestS3ObjectHeaders(t *testing.T) {
+	require := require.New(t)
+	isolateAwsEnv(t)
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	var putHeaders http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			putHeaders = r.Header
+			body := new(bytes.Buffer)
+			body.ReadFrom(r.Body)
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body.Bytes())))
+		case http.MethodHead:
+			for _, h := range []string{"Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language", "Expires"} {
+				w.Header().Set(h, putHeaders.Get(h))
+			}
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("X-Amz-Meta-A", "b")
+		}
+	}))
+	defer server.Close()
+
+	os, err := ParseOSURL("s3+http://user:secret@"+strings.TrimPrefix(server.URL, "http://")+"/bucket", true)
+	require.NoError(err)
+	sess := os.NewSession("stream")
+	_, err = sess.SaveData(context.Background(), "video.mp4", strings.NewReader("data"), &FileProperties{
+		CacheControl:       "max-age=60",
+		ContentDisposition: `attachment; filename="video.mp4"`,
+		ContentEncoding:    "identity",
+		ContentLanguage:    "en",
+		Expires:            expires,
+	}, 0)
+	require.NoError(err)
+	require.Equal("Wed, 02 Jan 2030 03:04:05 GMT", putHeaders.Get("Expires"))
+
+	fi, err := Stat(context.Background(), sess, "video.mp4")
+	require.NoError(err)
+	require.Nil(fi.Body)
+	require.Equal("stream/video.mp4", fi.Name)
+	require.Equal(int64(4), *fi.Size)
+	require.Equal(map[string]string{"A": "b"}, fi.Metadata)
+	require.Equal("max-age=60", fi.CacheControl)
+	require.Equal(`attachment; filename="video.mp4"`, fi.ContentDisposition)
+	require.Equal("identity", fi.ContentEncoding)
+	require.Equal("en", fi.ContentLanguage)
+	require.True(expires.Equal(fi.Expires))
+}
+
+// checkPostPolicy checks the fields of the POST form against the conditions of
+// its policy, like S3 and GCS: every conditioned field must be sent, and every
+// field sent must be conditioned
+func checkPostPolicy(form *multipart.Form) error {
+	src, err := base64.StdEncoding.DecodeString(form.Value["policy"][0])
+	if err != nil {
+		return err
+	}
+	var policy struct {
+		Conditions []interface{} `json:"conditions"`
+	}
+	if err := json.Unmarshal(src, &policy); err != nil {
+		return err
+	}
+	conditioned := map[string]bool{}
+	for _, c := range policy.Conditions {
+		switch c := c.(type) {
+		case []interface{}:
+			name := strings.TrimPrefix(c[1].(string), "$")
+			conditioned[name] = true
+			if name == "key" {
+				continue
+			}
+			if len(form.Value[name]) == 0 || !strings.HasPrefix(form.Value[name][0], c[2].(string)) {
+				return fmt.Errorf("field %s doesn't match the policy", name)
+			}
+		case map[string]interface{}:
+			for name, value := range c {
+				conditioned[name] = true
+				if name != "bucket" && (len(form.Value[name]) == 0 || form.Value[name][0] != value) {
+					return fmt.Errorf("field %s doesn't match the policy", name)
+				}
+			}
+		}
+	}
+	for name := range form.Value {
+		switch name {
+		case "policy", "x-amz-signature":
+		default:
+			if !conditioned[name] {
+				return fmt.Errorf("field %s not in the policy", name)
+			}
+		}
+	}
+	return nil
+}
+
+func TestS3PostObjectHeaders(t *testing.T) {
+	require := require.New(t)
+	var form *multipart.Form
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(r.ParseMultipartForm(1 << 20))
+		form = r.MultipartForm
+		if err := checkPostPolicy(form); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	os, err := ParseOSURL("s3+http://user:secret@"+strings.TrimPrefix(server.URL, "http://")+"/bucket", false)
+	require.NoError(err)
+	sess := os.NewSession("stream")
+	info := sess.GetInfo().S3Info
+	// the policy given doesn't condition the headers, which the uploads without
+	// them would lack
+	require.NotContains(decodePolicy(require, info.Policy), "Cache-Control")
+	_, err = newS3Session(info).SaveData(ctx, "video.mp4", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+	require.Empty(form.Value["Content-Disposition"])
+	_, err = newS3Session(info).SaveData(ctx, "video.mp4", strings.NewReader("data"), &FileProperties{ContentDisposition: "inline"}, 0)
+	require.EqualError(err, "object headers Content-Disposition can't be set when saving with a POST policy")
+
+	// the uploads with headers are signed with a policy conditioning them
+	_, err = sess.SaveData(ctx, "video.mp4", strings.NewReader("data"), &FileProperties{
+		ContentDisposition: "inline",
+		Expires:            time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, 0)
+	require.NoError(err)
+	require.Equal([]string{"inline"}, form.Value["Content-Disposition"])
+	require.Equal([]string{"Wed, 02 Jan 2030 03:04:05 GMT"}, form.Value["Expires"])
+	require.Empty(form.Value["Content-Language"])
+	policy := decodePolicy(require, form.Value["policy"][0])
+	require.Contains(policy, `["starts-with", "$Content-Disposition", ""]`)
+	require.NotContains(policy, "Content-Language")
+	require.Equal(info.Policy, sess.GetInfo().S3Info.Policy)
+	_, err = sess.SaveData(ctx, "video.mp4", strings.NewReader("data"), nil, 0)
+	require.NoError(err)
+}
@@ -0,0 +1,195 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errFakeNotFound = errors.New("not found")
+
+// fakeSession is a map backed OSSession used for testing session wrappers
+type fakeSession struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	// saveErr and readErr, when set, are returned by the corresponding calls
+	saveErr error
+	readErr error
+	// failAfterRead makes SaveData consume the data before failing with saveErr
+	failAfterRead bool
+	// noRanges makes ReadDataRange return ErrNotSupported
+	noRanges bool
+	saves    int
+	reads    int
+}
+
+type fakeObject struct {
+	data     []byte
+	fields   FileProperties
+	modified time.Time
+}
+
+var _ OSSession = (*fakeSession)(nil)
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{objects: make(map[string]*fakeObject)}
+}
+
+func (s *fakeSession) put(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = &fakeObject{data: data, modified: time.Now()}
+}
+
+func (s *fakeSession) get(name string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj, ok := s.objects[name]; ok {
+		return obj.data
+	}
+	return nil
+}
+
+func (s *fakeSession) setSaveErr(err error) {
+	s.mu.Lock()
+	s.saveErr = err
+	s.mu.Unlock()
+}
+
+func (s *fakeSession) OS() OSDriver {
+	return nil
+}
+
+func (s *fakeSession) SaveData(ctx context.Context, name string, data io.Reader, fields *FileProperties, timeout time.Duration) (*SaveDataOutput, error) {
+	s.mu.Lock()
+	s.saves++
+	saveErr := s.saveErr
+	s.mu.Unlock()
+	if saveErr != nil && !s.failAfterRead {
+		return nil, saveErr
+	}
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	if saveErr != nil {
+		return nil, saveErr
+	}
+	obj := &fakeObject{data: b, modified: time.Now()}
+	if fields != nil {
+		obj.fields = *fields
+	}
+	s.mu.Lock()
+	s.objects[name] = obj
+	s.mu.Unlock()
+	return &SaveDataOutput{URL: "fake://" + name}, nil
+}
+
+func (s *fakeSession) EndSession() {}
+
+func (s *fakeSession) GetInfo() *OSInfo {
+	return nil
+}
+
+func (s *fakeSession) IsExternal() bool {
+	return false
+}
+
+func (s *fakeSession) IsOwn(url string) bool {
+	return strings.HasPrefix(url, "fake://")
+}
+
+func (s *fakeSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pi := &singlePageInfo{}
+	dirs := map[string]bool{}
+	for name, obj := range s.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delim != "" {
+			if i := strings.Index(name[len(prefix):], delim); i >= 0 {
+				dirs[name[:len(prefix)+i+len(delim)]] = true
+				continue
+			}
+		}
+		size := int64(len(obj.data))
+		pi.files = append(pi.files, FileInfo{Name: name, Size: &size, LastModified: obj.modified})
+	}
+	for dir := range dirs {
+		pi.directories = append(pi.directories, dir)
+	}
+	sort.Slice(pi.files, func(i, j int) bool { return pi.files[i].Name < pi.files[j].Name })
+	sort.Strings(pi.directories)
+	return pi, nil
+}
+
+func (s *fakeSession) DeleteFile(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return errFakeNotFound
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *fakeSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
+	return s.ReadDataRange(ctx, name, "")
+}
+
+func (s *fakeSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	if s.readErr != nil {
+		return nil, s.readErr
+	}
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, errFakeNotFound
+	}
+	data, contentRange := obj.data, ""
+	if byteRange != "" {
+		if s.noRanges {
+			return nil, ErrNotSupported
+		}
+		start, end, err := parseByteRange(byteRange)
+		if err != nil {
+			return nil, err
+		}
+		total := int64(len(data))
+		if end < 0 || end >= total {
+			end = total - 1
+		}
+		if start >= total {
+			return nil, errors.New("range not satisfiable")
+		}
+		data = data[start : end+1]
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, total)
+	}
+	size := int64(len(data))
+	return &FileInfoReader{
+		FileInfo: FileInfo{
+			Name:         name,
+			Size:         &size,
+			LastModified: obj.modified,
+		},
+		Metadata:     obj.fields.Metadata,
+		ContentType:  obj.fields.ContentType,
+		ContentRange: contentRange,
+		Body:         ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+func (s *fakeSession) Presign(name string, expire time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
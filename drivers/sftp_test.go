@@ -0,0 +1,237 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSFTPServer serves an in-memory file system over SFTP, accepting the
+// user with the password or the client key
+func startSFTPServer(t *testing.T, password string, clientKey ssh.PublicKey) (addr string, hostKey ssh.PublicKey) {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == password {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "user" && clientKey != nil && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+	handlers := sftp.InMemHandler()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config, handlers)
+		}
+	}()
+	return listener.Addr().String(), hostSigner.PublicKey()
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig, handlers sftp.Handlers) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}()
+		go func() {
+			server := sftp.NewRequestServer(channel, handlers)
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
+
+func TestSFTPDriver(t *testing.T) {
+	require := require.New(t)
+	addr, hostKey := startSFTPServer(t, "secret", nil)
+	hostKeyParam := "hostKey=" + url.QueryEscape(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey))))
+	ctx := context.Background()
+
+	_, err := ParseOSURL("sftp://user:secret@"+addr+"/videos", true)
+	require.EqualError(err, "SFTP hostKey or knownHosts is required to verify the server")
+	driver, err := ParseOSURL("sftp://user:wrong@"+addr+"/videos?"+hostKeyParam, true)
+	require.NoError(err)
+	_, err = driver.NewSession("stream").SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "unable to authenticate")
+
+	// the host key must match
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	otherSigner, err := ssh.NewSignerFromKey(otherKey)
+	require.NoError(err)
+	otherKeyParam := "hostKey=" + url.QueryEscape(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey()))))
+	driver, err = ParseOSURL("sftp://user:secret@"+addr+"/videos?"+otherKeyParam, true)
+	require.NoError(err)
+	_, err = driver.NewSession("stream").SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "host key mismatch")
+
+	driver, err = ParseOSURL("sftp://user:secret@"+addr+"/videos?"+hostKeyParam, true)
+	require.NoError(err)
+	defer driver.(*SFTPOS).Close()
+	require.Equal("sftp://user:xxxxx@"+addr+"/videos?"+hostKeyParam, driver.Config().Redacted())
+	sess := driver.NewSession("stream")
+	out, err := sess.SaveData(ctx, "source/1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal("videos/stream/source/1.ts", out.Key)
+	require.Equal("sftp://"+addr+"/videos/stream/source/1.ts", out.URL)
+	require.Equal(int64(7), out.Size)
+	require.Equal("video/mp2t", out.ContentType)
+	require.NotEmpty(out.Checksums.MD5)
+	require.True(sess.IsOwn(out.URL))
+	// existing files are replaced
+	out, err = sess.SaveData(ctx, "source/1.ts", strings.NewReader("new segment"), nil, 0)
+	require.NoError(err)
+	require.Equal(int64(11), out.Size)
+	for _, name := range []string{"1.ts", "2.ts", "source/2.ts"} {
+		_, err = sess.SaveData(ctx, name, strings.NewReader(name), nil, 0)
+		require.NoError(err)
+	}
+
+	fi, err := sess.ReadData(ctx, "source/1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal("new segment", string(data))
+	require.Equal(int64(11), *fi.Size)
+	require.Equal("video/mp2t", fi.ContentType)
+
+	fi, err = sess.ReadDataRange(ctx, "source/1.ts", "bytes=4-6")
+	require.NoError(err)
+	data, err = io.ReadAll(fi.Body)
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal("seg", string(data))
+	require.Equal("bytes 4-6/11", fi.ContentRange)
+	require.Equal(int64(3), *fi.Size)
+	fi, err = sess.ReadDataRange(ctx, "source/1.ts", "bytes=-4")
+	require.NoError(err)
+	data, err = io.ReadAll(fi.Body)
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal("ment", string(data))
+	require.Equal("bytes 7-10/11", fi.ContentRange)
+
+	fi, err = Stat(ctx, sess, "1.ts")
+	require.NoError(err)
+	require.Nil(fi.Body)
+	require.Equal(int64(4), *fi.Size)
+
+	pi, err := sess.ListFiles(ctx, "", "/")
+	require.NoError(err)
+	require.False(pi.HasNextPage())
+	var names []string
+	for _, f := range pi.Files() {
+		names = append(names, f.Name)
+	}
+	// the temporary files are renamed
+	require.ElementsMatch([]string{"videos/stream/1.ts", "videos/stream/2.ts"}, names)
+	require.Equal([]string{"videos/stream/source/"}, pi.Directories())
+
+	pi, err = sess.ListFiles(ctx, "", "")
+	require.NoError(err)
+	names = nil
+	for _, f := range pi.Files() {
+		names = append(names, f.Name)
+	}
+	require.ElementsMatch([]string{"videos/stream/1.ts", "videos/stream/2.ts", "videos/stream/source/1.ts", "videos/stream/source/2.ts"}, names)
+	require.Empty(pi.Directories())
+
+	require.NoError(sess.DeleteFile(ctx, "source/1.ts"))
+	_, err = sess.ReadData(ctx, "source/1.ts")
+	require.ErrorIs(err, os.ErrNotExist)
+
+	// the connection is reopened once closed
+	require.NoError(driver.(*SFTPOS).Close())
+	fi, err = Stat(ctx, sess, "2.ts")
+	require.NoError(err)
+	require.Equal(int64(4), *fi.Size)
+}
+
+func TestSFTPDriverKeyAuth(t *testing.T) {
+	require := require.New(t)
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	sshPub, err := ssh.NewPublicKey(clientPub)
+	require.NoError(err)
+	addr, hostKey := startSFTPServer(t, "", sshPub)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientPriv)
+	require.NoError(err)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	require.NoError(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(os.WriteFile(knownHosts, []byte(knownHostsLine(addr, hostKey)), 0600))
+	ctx := context.Background()
+
+	profile := &StorageProfile{Type: "sftp", Endpoint: addr, Prefix: "videos", AccessKey: "user", KeyFile: keyFile, Options: map[string]string{"knownHosts": knownHosts}}
+	u, err := profile.OSURL("stream")
+	require.NoError(err)
+	driver, err := ParseOSURL(u, true)
+	require.NoError(err)
+	defer driver.(*SFTPOS).Close()
+	sess := driver.NewSession("")
+	out, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal("videos/stream/1.ts", out.Key)
+	fi, err := sess.ReadData(ctx, "1.ts")
+	require.NoError(err)
+	data, err := io.ReadAll(fi.Body)
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal("segment", string(data))
+
+	_, err = ParseOSURL("sftp://user@"+addr+"/videos?knownHosts="+knownHosts, true)
+	require.EqualError(err, "SFTP password or keyFile is required")
+}
+
+func knownHostsLine(addr string, key ssh.PublicKey) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return "[" + host + "]:" + port + " " + string(ssh.MarshalAuthorizedKey(key))
+}
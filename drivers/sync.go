@@ -0,0 +1,372 @@
+package drivers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SyncActionType string
+
+const (
+	SyncCopy   SyncActionType = "copy"
+	SyncDelete SyncActionType = "delete"
+	SyncSkip   SyncActionType = "skip"
+
+	defaultSyncParallelism = 4
+)
+
+// SyncAction describes what Sync did, or would do in a dry run, with an object
+type SyncAction struct {
+	Type SyncActionType
+	// Name of the object relative to the root of the sessions
+	Name string
+	// Size of the source object for copies, of the destination object for deletes
+	Size int64
+	// Reason the object is copied, e.g. "missing" or "size differs"
+	Reason string
+	Err    error
+}
+
+type SyncOptions struct {
+	// Delete removes the objects under the prefix from dst which are not in src
+	Delete bool
+	// DryRun reports the actions without copying or deleting anything
+	DryRun bool
+	// Parallelism is the number of objects copied or deleted concurrently
+	Parallelism int
+	// CompareChecksums compares the checksums stored by both backends when the
+	// objects have the same size and their ETags can't be compared. Requires a
+	// read request for every such object on both sides.
+	CompareChecksums bool
+	// Checkpoint is the path of a file the completed actions are appended to. An
+	// interrupted sync started again with the same checkpoint does not repeat
+	// them. The file is removed once the sync finishes without errors.
+	Checkpoint string
+	// Timeout of every SaveData call to dst
+	Timeout time.Duration
+	// OnAction, when set, is called once every action is done
+	OnAction func(SyncAction)
+}
+
+type SyncResult struct {
+	Copied      int
+	Deleted     int
+	Skipped     int
+	Failed      int
+	BytesCopied int64
+	Actions     []SyncAction
+}
+
+type syncEntry struct {
+	// listed is the name as returned by ListFiles, used for reading
+	listed string
+	info   FileInfo
+}
+
+// Sync mirrors the objects under prefix from src to dst, copying the objects
+// missing in dst or differing from src. Objects are considered the same when
+// their sizes match and, when comparable, their ETags or checksums too. Failed
+// copies and deletes don't stop the sync, an error summarizing them is returned
+// along the result.
+func Sync(ctx context.Context, src, dst OSSession, prefix string, opts SyncOptions) (*SyncResult, error) {
+	srcFiles, err := listSyncEntries(ctx, src, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing source: %w", err)
+	}
+	dstFiles, err := listSyncEntries(ctx, dst, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing destination: %w", err)
+	}
+	done, err := readSyncCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SyncResult{}
+	var actions []SyncAction
+	for _, name := range sortedSyncNames(srcFiles) {
+		s := srcFiles[name]
+		action := SyncAction{Type: SyncCopy, Name: name, Size: sizeOf(s.info)}
+		if done[name] {
+			action.Type, action.Reason = SyncSkip, "checkpoint"
+		} else if d, ok := dstFiles[name]; !ok {
+			action.Reason = "missing"
+		} else if reason, err := syncDiff(ctx, src, dst, s, d, opts.CompareChecksums); err != nil {
+			action.Err = err
+		} else if reason == "" {
+			action.Type = SyncSkip
+		} else {
+			action.Reason = reason
+		}
+		actions = append(actions, action)
+	}
+	if opts.Delete {
+		for _, name := range sortedSyncNames(dstFiles) {
+			if _, ok := srcFiles[name]; ok {
+				continue
+			}
+			action := SyncAction{Type: SyncDelete, Name: name, Size: sizeOf(dstFiles[name].info), Reason: "extra"}
+			if done[name] {
+				action.Type, action.Reason = SyncSkip, "checkpoint"
+			}
+			actions = append(actions, action)
+		}
+	}
+
+	var checkpoint *os.File
+	if opts.Checkpoint != "" && !opts.DryRun {
+		checkpoint, err = os.OpenFile(opts.Checkpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer checkpoint.Close()
+	}
+
+	var mu sync.Mutex
+	finish := func(i int, a SyncAction) {
+		mu.Lock()
+		defer mu.Unlock()
+		actions[i] = a
+		if a.Err == nil && checkpoint != nil && a.Type != SyncSkip {
+			if _, err := fmt.Fprintln(checkpoint, a.Name); err != nil {
+				a.Err = fmt.Errorf("error writing checkpoint: %w", err)
+				actions[i] = a
+			}
+		}
+		if opts.OnAction != nil {
+			opts.OnAction(a)
+		}
+	}
+
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultSyncParallelism
+	}
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				a := actions[i]
+				if a.Err == nil && !opts.DryRun {
+					switch a.Type {
+					case SyncCopy:
+						a.Err = syncCopy(ctx, src, dst, srcFiles[a.Name], a.Name, opts.Timeout)
+					case SyncDelete:
+						a.Err = dst.DeleteFile(ctx, a.Name)
+					}
+				}
+				finish(i, a)
+			}
+		}()
+	}
+	for i := range actions {
+		if err := ctx.Err(); err != nil {
+			actions[i].Err = err
+			continue
+		}
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var firstErr error
+	for _, a := range actions {
+		switch {
+		case a.Err != nil:
+			res.Failed++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s %s: %w", a.Type, a.Name, a.Err)
+			}
+		case a.Type == SyncCopy:
+			res.Copied++
+			res.BytesCopied += a.Size
+		case a.Type == SyncDelete:
+			res.Deleted++
+		default:
+			res.Skipped++
+		}
+	}
+	res.Actions = actions
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	if firstErr != nil {
+		return res, fmt.Errorf("%d of %d sync actions failed, first error: %w", res.Failed, len(actions), firstErr)
+	}
+	if checkpoint != nil {
+		checkpoint.Close()
+		os.Remove(opts.Checkpoint)
+	}
+	return res, nil
+}
+
+func syncCopy(ctx context.Context, src, dst OSSession, s syncEntry, name string, timeout time.Duration) error {
+	fi, err := src.ReadData(ctx, s.listed)
+	if err != nil {
+		return err
+	}
+	defer fi.Body.Close()
+	fields := &FileProperties{
+		Metadata:           fi.Metadata,
+		ContentType:        fi.ContentType,
+		CacheControl:       fi.CacheControl,
+		ContentEncoding:    fi.ContentEncoding,
+		ContentDisposition: fi.ContentDisposition,
+		ContentLanguage:    fi.ContentLanguage,
+		Expires:            fi.Expires,
+	}
+	out, err := dst.SaveData(ctx, name, fi.Body, fields, timeout)
+	if err != nil {
+		return err
+	}
+	if s.info.Size != nil && out != nil && out.Size > 0 && out.Size != *s.info.Size {
+		return fmt.Errorf("copied %d bytes, expected %d", out.Size, *s.info.Size)
+	}
+	return nil
+}
+
+// syncDiff returns why the objects differ, or an empty string if they are the same
+func syncDiff(ctx context.Context, src, dst OSSession, s, d syncEntry, compareChecksums bool) (string, error) {
+	if s.info.Size != nil && d.info.Size != nil && *s.info.Size != *d.info.Size {
+		return "size differs", nil
+	}
+	srcMD5, dstMD5 := etagMD5(s.info.ETag), etagMD5(d.info.ETag)
+	if srcMD5 != nil && dstMD5 != nil {
+		if !bytes.Equal(srcMD5, dstMD5) {
+			return "ETag differs", nil
+		}
+		return "", nil
+	}
+	if !compareChecksums || (s.info.ETag != "" && s.info.ETag == d.info.ETag) {
+		return "", nil
+	}
+	srcSums, err := storedChecksums(ctx, src, s.listed)
+	if err != nil {
+		return "", err
+	}
+	dstSums, err := storedChecksums(ctx, dst, d.listed)
+	if err != nil {
+		return "", err
+	}
+	if err := srcSums.Verify(dstSums); err != nil {
+		return "checksum differs", nil
+	}
+	return "", nil
+}
+
+func storedChecksums(ctx context.Context, sess OSSession, name string) (Checksums, error) {
+	fi, err := sess.ReadData(ctx, name)
+	if err != nil {
+		return Checksums{}, err
+	}
+	fi.Body.Close()
+	return fi.Checksums, nil
+}
+
+// keyedSession is implemented by the sessions listing the names of their
+// objects with the key of the session, which the synced names are relative to
+type keyedSession interface {
+	sessionKey() string
+}
+
+// listSyncEntries lists all the objects under prefix, keyed by their names
+// relative to the root of the session. Drivers listing a single directory
+// level are walked recursively.
+func listSyncEntries(ctx context.Context, sess OSSession, prefix string) (map[string]syncEntry, error) {
+	keyPrefix := ""
+	if ks, ok := sess.(keyedSession); ok && ks.sessionKey() != "" {
+		keyPrefix = ks.sessionKey() + "/"
+	}
+	entries := make(map[string]syncEntry)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		page, err := sess.ListFiles(ctx, dir, "")
+		if err != nil {
+			return err
+		}
+		for {
+			for _, f := range page.Files() {
+				listed := qualifySyncName(dir, f.Name)
+				if keyPrefix != "" && !strings.HasPrefix(listed, keyPrefix) {
+					// sibling of the session key sharing its prefix
+					continue
+				}
+				entries[strings.TrimPrefix(listed, keyPrefix)] = syncEntry{listed: listed, info: f}
+			}
+			for _, d := range page.Directories() {
+				if err := walk(strings.TrimSuffix(qualifySyncName(dir, d), "/") + "/"); err != nil {
+					return err
+				}
+			}
+			if !page.HasNextPage() {
+				return nil
+			}
+			if page, err = page.NextPage(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := walk(prefix); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// qualifySyncName returns the full name of a listed entry, as some drivers list
+// names relative to the listed directory
+func qualifySyncName(dir, name string) string {
+	if dir == "" || strings.Contains(strings.TrimSuffix(name, "/"), "/") ||
+		(!strings.HasSuffix(dir, "/") && strings.HasPrefix(name, dir)) {
+		return name
+	}
+	return path.Join(dir, name)
+}
+
+func readSyncCheckpoint(file string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	if file == "" {
+		return done, nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			done[name] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+func sortedSyncNames(entries map[string]syncEntry) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sizeOf(fi FileInfo) int64 {
+	if fi.Size == nil {
+		return 0
+	}
+	return *fi.Size
+}
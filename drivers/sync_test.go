@@ -0,0 +1,129 @@
+package drivers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	require := require.New(t)
+	src, dst := newFakeSession(), newFakeSession()
+	src.put("rec/1.ts", []byte("segment 1"))
+	src.put("rec/2.ts", []byte("segment 2"))
+	src.put("rec/sub/index.m3u8", []byte("playlist"))
+	src.put("other/1.ts", []byte("not synced"))
+	dst.put("rec/1.ts", []byte("segment 1"))
+	dst.put("rec/2.ts", []byte("old"))
+	dst.put("rec/extra.ts", []byte("extra"))
+
+	res, err := Sync(context.Background(), src, dst, "rec/", SyncOptions{Delete: true, DryRun: true})
+	require.NoError(err)
+	require.Equal(2, res.Copied)
+	require.Equal(1, res.Deleted)
+	require.Equal(1, res.Skipped)
+	require.Equal(0, dst.saves)
+	require.Equal([]SyncAction{
+		{Type: SyncSkip, Name: "rec/1.ts", Size: 9},
+		{Type: SyncCopy, Name: "rec/2.ts", Size: 9, Reason: "size differs"},
+		{Type: SyncCopy, Name: "rec/sub/index.m3u8", Size: 8, Reason: "missing"},
+		{Type: SyncDelete, Name: "rec/extra.ts", Size: 5, Reason: "extra"},
+	}, res.Actions)
+
+	var mu sync.Mutex
+	var reported []string
+	res, err = Sync(context.Background(), src, dst, "rec/", SyncOptions{
+		Delete:      true,
+		Parallelism: 2,
+		OnAction: func(a SyncAction) {
+			mu.Lock()
+			reported = append(reported, a.Name)
+			mu.Unlock()
+		},
+	})
+	require.NoError(err)
+	require.Equal(int64(17), res.BytesCopied)
+	require.Len(reported, 4)
+	require.Equal("segment 2", string(dst.get("rec/2.ts")))
+	require.Equal("playlist", string(dst.get("rec/sub/index.m3u8")))
+	require.Nil(dst.get("rec/extra.ts"))
+	require.Nil(dst.get("other/1.ts"))
+
+	// nothing left to do
+	res, err = Sync(context.Background(), src, dst, "rec/", SyncOptions{Delete: true})
+	require.NoError(err)
+	require.Equal(3, res.Skipped)
+}
+
+// keyedFakeSession is a fake session listing the objects under its key
+type keyedFakeSession struct {
+	*fakeSession
+	key string
+}
+
+func (s keyedFakeSession) sessionKey() string {
+	return s.key
+}
+
+func (s keyedFakeSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	return s.fakeSession.ListFiles(ctx, s.key+"/"+prefix, delim)
+}
+
+func (s keyedFakeSession) GetInfo() *OSInfo {
+	panic("the upload credentials aren't needed")
+}
+
+func TestSyncSessionKey(t *testing.T) {
+	require := require.New(t)
+	src, dst := newFakeSession(), newFakeSession()
+	src.put("rec/1.ts", []byte("segment 1"))
+	src.put("rec/sub/index.m3u8", []byte("playlist"))
+	src.put("recording/1.ts", []byte("not synced"))
+
+	// the names are relative to the key of the session
+	res, err := Sync(context.Background(), keyedFakeSession{src, "rec"}, dst, "", SyncOptions{})
+	require.NoError(err)
+	require.Equal(2, res.Copied)
+	require.Equal("segment 1", string(dst.get("1.ts")))
+	require.Equal("playlist", string(dst.get("sub/index.m3u8")))
+	require.Len(dst.objects, 2)
+}
+
+func TestSyncCheckpoint(t *testing.T) {
+	require := require.New(t)
+	src, dst := newFakeSession(), newFakeSession()
+	src.put("a.ts", []byte("a"))
+	src.put("b.ts", []byte("b"))
+	checkpoint := filepath.Join(t.TempDir(), "sync.checkpoint")
+
+	dst.setSaveErr(errFakeNotFound)
+	res, err := Sync(context.Background(), src, dst, "", SyncOptions{Checkpoint: checkpoint, Parallelism: 1})
+	require.Error(err)
+	require.Equal(2, res.Failed)
+
+	// a.ts was copied by a previous run which got interrupted
+	require.NoError(ioutil.WriteFile(checkpoint, []byte("a.ts\n"), 0644))
+	dst.setSaveErr(nil)
+	res, err = Sync(context.Background(), src, dst, "", SyncOptions{Checkpoint: checkpoint})
+	require.NoError(err)
+	require.Equal(1, res.Copied)
+	require.Equal(1, res.Skipped)
+	require.Nil(dst.get("a.ts"))
+	require.Equal("b", string(dst.get("b.ts")))
+	_, err = os.Stat(checkpoint)
+	require.True(os.IsNotExist(err))
+}
+
+func TestQualifySyncName(t *testing.T) {
+	require := require.New(t)
+	require.Equal("rec/1.ts", qualifySyncName("", "rec/1.ts"))
+	require.Equal("rec/1.ts", qualifySyncName("rec/", "rec/1.ts"))
+	require.Equal("rec/1.ts", qualifySyncName("rec/", "1.ts"))
+	require.Equal("rec/sub", qualifySyncName("rec/", "sub"))
+	require.Equal("rec1.ts", qualifySyncName("rec", "rec1.ts"))
+}
@@ -1,61 +1,93 @@
 package drivers
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
-	bserv "github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
-	ds "github.com/ipfs/go-datastore"
-	dssync "github.com/ipfs/go-datastore/sync"
-	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	chunker "github.com/ipfs/go-ipfs-chunker"
 	format "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-unixfs"
+	"github.com/ipfs/go-unixfs/importer/balanced"
+	"github.com/ipfs/go-unixfs/importer/helpers"
 	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"github.com/livepeer/go-tools/clients"
 	"io"
+	"log"
+	"net/http"
 	"os"
-	"os/exec"
-	"regexp"
+	"path"
 	"strings"
-	"sync"
 	"time"
 )
 
 const w3SDefaultSaveTimeout = 5 * time.Minute
 
+// w3sGateway is the default gateway of the files read by W3sOS
+const w3sGateway = "https://w3s.link/ipfs/"
+
+// ipfsCarChunkSize and ipfsCarMaxLinks are the defaults of ipfs-car
+const (
+	ipfsCarChunkSize = 262144
+	ipfsCarMaxLinks  = 174
+)
+
+// w3sShardSize is the maximum size of the blocks of the CARs the files are
+// stored in, the default shard size of the w3up client
+const w3sShardSize = 133169152
+
 var base64Url = base64.URLEncoding.WithPadding(base64.NoPadding)
 
 var cidV1 = merkledag.V1CidPrefix()
 
-// This represents the main CAR directory structure organized by pubId.
-// Data for each pubId is removed after the CAR directory is published.
-//
-// Note that if Publish() is not called for the given pubId, it can cause memory leak.
-// This will be fixed as part of https://github.com/livepeer/go-tools/issues/16.
-var (
-	dataToPublish   = make(map[string]*rootCar)
-	dataToPublishMu sync.Mutex
-)
-
+// rootCar is the directory of the files of a pubId, built in the DAG of the
+// publish store
 type rootCar struct {
-	root    *merkledag.ProtoNode
-	dag     format.DAGService
-	carCids []string
-	mu      sync.Mutex
+	root *merkledag.ProtoNode
+	dag  format.DAGService
 }
 
-func newRootCar() *rootCar {
-	return &rootCar{
-		root: newDir(),
-		dag:  merkledag.NewDAGService(bserv.New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)),
+// loadRootCar returns the directory of the state, a new one if it's empty
+func loadRootCar(ctx context.Context, state *W3sPublishState, dag format.DAGService) (*rootCar, error) {
+	rc := &rootCar{root: newDir(), dag: dag}
+	if state.Root == "" {
+		return rc, nil
+	}
+	rootCid, err := cid.Parse(state.Root)
+	if err != nil {
+		return nil, err
+	}
+	n, err := dag.Get(ctx, rootCid)
+	if err != nil {
+		return nil, fmt.Errorf("loading the directory of the publication failed: %w", err)
+	}
+	root, ok := n.(*merkledag.ProtoNode)
+	if !ok {
+		return nil, merkledag.ErrNotProtobuf
 	}
+	rc.root = root
+	return rc, nil
 }
 
 type W3sOS struct {
 	ucanProof string
 	dirPath   string
 	pubId     string
+	config    *OSURL
+	store     W3sPublishStore
+	// w3upURL and w3upDID are the URL and DID of the w3up service
+	w3upURL string
+	w3upDID string
+	// gateway is the IPFS gateway of the files read, and verify enables the
+	// verification of their blocks
+	gateway string
+	verify  bool
+	// shardSize is the maximum size of the blocks of the CARs of a file
+	shardSize int
 }
 
 var _ OSSession = (*W3sSession)(nil)
@@ -69,6 +101,12 @@ func NewW3sDriver(ucanProof, dirPath, pubId string) *W3sOS {
 		ucanProof: ucanProof,
 		dirPath:   dirPath,
 		pubId:     pubId,
+		config:    &OSURL{Scheme: "w3s", User: ucanProof, Host: pubId, Path: dirPath},
+		store:     w3sPublishStore,
+		w3upURL:   clients.W3upServiceURL,
+		w3upDID:   clients.W3upServiceDID,
+		gateway:   w3sGateway,
+		shardSize: w3sShardSize,
 	}
 }
 
@@ -82,6 +120,10 @@ func (ostore *W3sOS) NewSession(filename string) OSSession {
 	return session
 }
 
+func (ostore *W3sOS) Config() *OSURL {
+	return ostore.config.clone()
+}
+
 func (ostore *W3sOS) UriSchemes() []string {
 	return []string{}
 }
@@ -98,16 +140,283 @@ func (session *W3sSession) EndSession() {
 	// no op
 }
 
-func (session *W3sSession) ListFiles(ctx context.Context, cid, delim string) (PageInfo, error) {
-	return nil, ErrNotSupported
+// ListFiles lists the files saved with the pubId starting with prefix, from
+// the directory built until it's published. The directories are returned when
+// delim is set, and listed otherwise.
+func (session *W3sSession) ListFiles(ctx context.Context, prefix, delim string) (PageInfo, error) {
+	if key := session.key(); key != "" {
+		prefix = key + "/" + prefix
+	}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		dir = prefix[:i+1]
+	}
+	pi := &singlePageInfo{
+		files:       []FileInfo{},
+		directories: []string{},
+	}
+	err := viewW3sPublication(ctx, session.os.store, session.os.pubId, func(state *W3sPublishState, dag format.DAGService) error {
+		rCar, err := loadRootCar(ctx, state, dag)
+		if err != nil {
+			return err
+		}
+		dirNode, err := rCar.lookupDir(ctx, dir)
+		if err != nil || dirNode == nil {
+			return err
+		}
+		type pendingDir struct {
+			name string
+			node *merkledag.ProtoNode
+		}
+		for pending := []pendingDir{{dir, dirNode}}; len(pending) > 0; pending = pending[1:] {
+			for _, link := range pending[0].node.Links() {
+				name := pending[0].name + link.Name
+				if !strings.HasPrefix(name, prefix) && !strings.HasPrefix(name+"/", prefix) {
+					continue
+				}
+				child, err := rCar.getDir(ctx, link.Cid)
+				if err != nil {
+					return err
+				}
+				if child != nil {
+					if delim != "" && strings.HasPrefix(name+"/", prefix) && name+"/" != prefix {
+						pi.directories = append(pi.directories, name+"/")
+					} else {
+						pending = append(pending, pendingDir{name + "/", child})
+					}
+					continue
+				}
+				if strings.HasPrefix(name, prefix) {
+					size := int64(link.Size)
+					pi.files = append(pi.files, FileInfo{Name: name, ETag: link.Cid.String(), Size: &size})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pi, nil
 }
 
 func (session *W3sSession) ReadData(ctx context.Context, name string) (*FileInfoReader, error) {
-	return nil, ErrNotSupported
+	return session.ReadDataRange(ctx, name, "")
 }
 
+// ReadDataRange reads the file of the CID, or the one saved with the name until
+// it's published, from the IPFS gateway. With verification, the CAR of the
+// file is requested and its blocks are checked against their CIDs.
 func (session *W3sSession) ReadDataRange(ctx context.Context, name, byteRange string) (*FileInfoReader, error) {
-	return nil, ErrNotSupported
+	fileCid, err := session.fileCid(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if session.os.verify {
+		return session.readVerified(ctx, name, fileCid, byteRange)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, session.os.gateway+fileCid.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &clients.HTTPStatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+	if byteRange != "" && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("range requests not supported by %s", session.os.gateway)
+	}
+	res := httpFileInfo(name, resp.Header)
+	res.ETag = fileCid.String()
+	if res.ContentType == "" {
+		res.ContentType, _ = TypeByExtension(path.Ext(name))
+	}
+	res.Body = resp.Body
+	return res, nil
+}
+
+// readVerified reads the file from the CAR of its DAG returned by the gateway,
+// with the blocks verified against their CIDs as they're read. The blocks are
+// requested in DFS order with the duplicates, so that they can be checked
+// against the links of their parents without being kept in memory.
+func (session *W3sSession) readVerified(ctx context.Context, name string, fileCid cid.Cid, byteRange string) (*FileInfoReader, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, session.os.gateway+fileCid.String()+"?format=car", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.car; version=1; order=dfs; dups=y")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &clients.HTTPStatusError{Status: resp.StatusCode, Body: string(body)}
+	}
+
+	cr, err := car.NewCarReader(bufio.NewReader(resp.Body))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	r := &carFileReader{cr: cr, pending: []cid.Cid{fileCid}}
+	// the size of the file is given by its root
+	size, err := r.next()
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	contentType, _ := TypeByExtension(path.Ext(name))
+	res := &FileInfoReader{
+		FileInfo:    FileInfo{Name: name, ETag: fileCid.String(), Size: &size},
+		ContentType: contentType,
+	}
+	if byteRange != "" {
+		start, end, err := parseByteRange(byteRange)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if start < 0 {
+			start += size
+			if start < 0 {
+				start = 0
+			}
+		}
+		if end == -1 || end >= size {
+			end = size - 1
+		}
+		if start > end {
+			resp.Body.Close()
+			return nil, fmt.Errorf("range %q not satisfiable for size %d", byteRange, size)
+		}
+		// the blocks before the range are still verified
+		if _, err := io.CopyN(io.Discard, r, start); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		length := end - start + 1
+		res.Size = &length
+		res.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, size)
+		res.Body = rangeReadCloser{io.LimitReader(r, length), resp.Body}
+		return res, nil
+	}
+	res.Body = rangeReadCloser{r, resp.Body}
+	return res, nil
+}
+
+// carFileReader reads the content of a UnixFS file from the blocks of its CAR
+// in DFS order, each checked to be the next one linked by the file
+type carFileReader struct {
+	cr *car.CarReader
+	// pending are the CIDs of the blocks still to read, the next one last
+	pending []cid.Cid
+	data    []byte
+}
+
+func (r *carFileReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+		if _, err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// next reads the next block of the file, and returns the size of the content
+// under it
+func (r *carFileReader) next() (int64, error) {
+	expected := r.pending[len(r.pending)-1]
+	r.pending = r.pending[:len(r.pending)-1]
+	// the blocks are checked against their CIDs by the CAR reader
+	b, err := r.cr.Next()
+	if err == io.EOF {
+		return 0, fmt.Errorf("block %s not returned by the gateway: %w", expected, io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return 0, fmt.Errorf("invalid CAR of %s returned by the gateway: %w", expected, err)
+	}
+	if !b.Cid().Equals(expected) {
+		return 0, fmt.Errorf("block %s returned by the gateway instead of %s", b.Cid(), expected)
+	}
+	switch expected.Type() {
+	case cid.Raw:
+		r.data = b.RawData()
+		return int64(len(r.data)), nil
+	case cid.DagProtobuf:
+		n, err := merkledag.DecodeProtobuf(b.RawData())
+		if err != nil {
+			return 0, err
+		}
+		fsn, err := unixfs.FSNodeFromBytes(n.Data())
+		if err != nil {
+			return 0, err
+		}
+		if fsn.Type() != unixfs.TFile && fsn.Type() != unixfs.TRaw {
+			return 0, fmt.Errorf("%s is not a file", expected)
+		}
+		r.data = fsn.Data()
+		links := n.Links()
+		for i := len(links) - 1; i >= 0; i-- {
+			r.pending = append(r.pending, links[i].Cid)
+		}
+		return int64(fsn.FileSize()), nil
+	default:
+		return 0, fmt.Errorf("unsupported block %s of a file", expected)
+	}
+}
+
+// fileCid returns the CID of name, or of the file saved with the name when it's
+// not a CID
+func (session *W3sSession) fileCid(ctx context.Context, name string) (cid.Cid, error) {
+	if c, err := cid.Decode(name); err == nil {
+		return c, nil
+	}
+	name = path.Join(session.key(), name)
+	fileCid := cid.Undef
+	err := viewW3sPublication(ctx, session.os.store, session.os.pubId, func(state *W3sPublishState, dag format.DAGService) error {
+		rCar, err := loadRootCar(ctx, state, dag)
+		if err != nil {
+			return err
+		}
+		dir, filename := path.Split(strings.Trim(name, "/"))
+		dirNode, err := rCar.lookupDir(ctx, dir)
+		if err != nil || dirNode == nil {
+			return err
+		}
+		if link, _, err := dirNode.ResolveLink([]string{filename}); err == nil {
+			fileCid = link.Cid
+		}
+		return nil
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !fileCid.Defined() {
+		return cid.Undef, fmt.Errorf("file %s not found in the files of %s", name, session.os.pubId)
+	}
+	return fileCid, nil
+}
+
+// key returns the path of the files of the session in the directory
+func (session *W3sSession) key() string {
+	return strings.Trim(session.os.dirPath, "/")
 }
 
 func (session *W3sSession) Presign(name string, expire time.Duration) (string, error) {
@@ -143,41 +452,53 @@ func (session *W3sSession) SaveData(ctx context.Context, name string, data io.Re
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	filePath, err := toFile(data)
+	w3up, err := session.os.w3upClient()
 	if err != nil {
 		return nil, err
 	}
-	defer deleteFile(filePath)
-
-	carPath, fileCid, err := ipfsCarPack(ctx, filePath)
+	cr := newChecksumReader(data)
+	fileCid, carCids, err := ipfsCarPack(ctx, cr, session.os.shardSize, func(carData []byte) (string, error) {
+		return w3StoreCar(ctx, w3up, carData)
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer deleteFile(carPath)
 
-	carCid, err := w3StoreCar(ctx, session.os.ucanProof, carPath)
+	err = session.os.store.Update(ctx, session.os.pubId, func(state *W3sPublishState, dag format.DAGService) error {
+		rCar, err := loadRootCar(ctx, state, dag)
+		if err != nil {
+			return err
+		}
+		if err := rCar.addFile(ctx, session.os.dirPath, name, fileCid, cr.size); err != nil {
+			return err
+		}
+		state.Root = rCar.root.Cid().String()
+		state.CarCids = append(state.CarCids, carCids...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	rCar := session.os.getRootCar()
-	if err = rCar.addFile(ctx, session.os.dirPath, name, fileCid, carCid); err != nil {
-		return nil, err
-	}
-
-	return &SaveDataOutput{URL: fileCid}, nil
+	return &SaveDataOutput{
+		URL:         fileCid,
+		Key:         path.Join(session.os.dirPath, name),
+		Size:        cr.size,
+		ContentType: propertiesContentType(name, fields),
+		Checksums:   cr.Sum(),
+		CarCID:      carCids[len(carCids)-1],
+	}, nil
 }
 
-func (rc *rootCar) addFile(ctx context.Context, dirPath, filename, fileCid, carCid string) error {
-	rc.mu.Lock()
-	defer rc.mu.Unlock()
-
-	rc.carCids = append(rc.carCids, carCid)
-
+// addFile links the file of the CID to the directory, with the size of its
+// content listed by ListFiles
+func (rc *rootCar) addFile(ctx context.Context, dirPath, filename, fileCid string, size int64) error {
+	// the name may have directories too
+	dirPath, filename = path.Split(path.Join(dirPath, filename))
 	// split path by "/", ignore empty strings
 	dirPaths := strings.FieldsFunc(dirPath, func(c rune) bool { return c == '/' })
 
-	newRoot, err := rc.addFileToDagRecursive(ctx, rc.root, dirPaths, filename, fileCid)
+	newRoot, err := rc.addFileToDagRecursive(ctx, rc.root, dirPaths, filename, fileCid, size)
 	if err != nil {
 		return err
 	}
@@ -188,18 +509,22 @@ func (rc *rootCar) addFile(ctx context.Context, dirPath, filename, fileCid, carC
 
 // addFileToDagRecursive recursively creates the nodes defined by dirPaths and adds the CID link at the end.
 // This uses the DFS algorithm in which visiting each node does the following actions:
-// - if no more dirPaths, create a leaf with the link to the file CID, otherwise do the following
+// - if no more dirPaths, create a leaf with the link to the file CID and size, otherwise do the following
 // - create directory defined by the first element in dirPaths
 // - recursively create the rest of directories defined with the remaining dirPaths
 // - recalculate the CID of the current node (it changed because its children have changed)
-func (rc *rootCar) addFileToDagRecursive(ctx context.Context, n *merkledag.ProtoNode, dirPaths []string, filename, fileCid string) (*merkledag.ProtoNode, error) {
+func (rc *rootCar) addFileToDagRecursive(ctx context.Context, n *merkledag.ProtoNode, dirPaths []string, filename, fileCid string, size int64) (*merkledag.ProtoNode, error) {
 	if len(dirPaths) == 0 {
 		// n is a leaf
 		fCid, err := cid.Parse(fileCid)
 		if err != nil {
 			return nil, err
 		}
-		n.AddRawLink(filename, &format.Link{Cid: fCid})
+		// replace the file saved with the name
+		if err := n.RemoveNodeLink(filename); err != nil && err != merkledag.ErrLinkNotFound {
+			return nil, err
+		}
+		n.AddRawLink(filename, &format.Link{Cid: fCid, Size: uint64(size)})
 		rc.dag.Add(ctx, n)
 		return n, nil
 	}
@@ -210,7 +535,7 @@ func (rc *rootCar) addFileToDagRecursive(ctx context.Context, n *merkledag.Proto
 	if err != nil {
 		return nil, err
 	}
-	child, err = rc.addFileToDagRecursive(ctx, child, childPaths, filename, fileCid)
+	child, err = rc.addFileToDagRecursive(ctx, child, childPaths, filename, fileCid, size)
 	if err != nil {
 		return nil, err
 	}
@@ -241,58 +566,99 @@ func (rc *rootCar) getOrCreateChild(ctx context.Context, n *merkledag.ProtoNode,
 	return child, nil
 }
 
-func (ostore *W3sOS) Publish(ctx context.Context) (string, error) {
-	rCar := ostore.getRootCar()
-	rootCid := rCar.root.Cid().String()
-
-	rCar.mu.Lock()
-	if err := rCar.storeDir(ctx, ostore.ucanProof); err != nil {
-		return "", err
+// lookupDir returns the directory of the path, or nil if it doesn't exist
+func (rc *rootCar) lookupDir(ctx context.Context, dirPath string) (*merkledag.ProtoNode, error) {
+	n := rc.root
+	for _, name := range strings.FieldsFunc(dirPath, func(c rune) bool { return c == '/' }) {
+		link, err := n.GetNodeLink(name)
+		if err == merkledag.ErrLinkNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if n, err = rc.getDir(ctx, link.Cid); err != nil || n == nil {
+			return nil, err
+		}
 	}
-	carCids := rCar.carCids
-	rCar.mu.Unlock()
+	return n, nil
+}
 
-	if err := w3UploadCar(ctx, ostore.ucanProof, rootCid, carCids); err != nil {
-		return "", err
+// getDir returns the directory of the CID, or nil if it's a file. Only the
+// directories are in the DAG, the files are links to their CIDs.
+func (rc *rootCar) getDir(ctx context.Context, c cid.Cid) (*merkledag.ProtoNode, error) {
+	n, err := rc.dag.Get(ctx, c)
+	if format.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-
-	defer ostore.deleteRootCar()
-	return fmt.Sprintf("ipfs://%s", rootCid), nil
+	dir, ok := n.(*merkledag.ProtoNode)
+	if !ok {
+		return nil, nil
+	}
+	return dir, nil
 }
 
-func (rc *rootCar) storeDir(ctx context.Context, proof string) error {
-	carFile, err := os.CreateTemp("", "car")
+// Publish stores the CAR of the directory of the files saved with the pubId,
+// and uploads it with their CARs. The publication is kept in the store if it
+// fails, so that it can be published again, even after a restart with a disk
+// store. It's also kept when files are saved while it's published, for them to
+// be published again.
+func (ostore *W3sOS) Publish(ctx context.Context) (string, error) {
+	w3up, err := ostore.w3upClient()
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer deleteFile(carFile.Name())
-	car.WriteCar(ctx, rc.dag, []cid.Cid{rc.root.Cid()}, carFile, merkledag.IgnoreMissing())
-	carFile.Close()
 
-	storedCid, err := w3StoreCar(ctx, proof, carFile.Name())
+	var rootCid, publishedRoot string
+	var carCids []string
+	var dirCar bytes.Buffer
+	err = ostore.store.Update(ctx, ostore.pubId, func(state *W3sPublishState, dag format.DAGService) error {
+		rCar, err := loadRootCar(ctx, state, dag)
+		if err != nil {
+			return err
+		}
+		if state.Root == "" {
+			// nothing saved, publish the empty directory
+			if err := dag.Add(ctx, rCar.root); err != nil {
+				return err
+			}
+		}
+		rootCid = rCar.root.Cid().String()
+		publishedRoot = state.Root
+		carCids = append(carCids, state.CarCids...)
+		return car.WriteCar(ctx, dag, []cid.Cid{rCar.root.Cid()}, &dirCar, merkledag.IgnoreMissing())
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	rc.carCids = append(rc.carCids, storedCid)
-
-	return nil
-}
 
-func (ostore *W3sOS) getRootCar() *rootCar {
-	dataToPublishMu.Lock()
-	defer dataToPublishMu.Unlock()
+	dirCarCid, err := w3StoreCar(ctx, w3up, dirCar.Bytes())
+	if err != nil {
+		return "", err
+	}
+	if err := w3UploadCar(ctx, w3up, rootCid, append(carCids, dirCarCid)); err != nil {
+		return "", err
+	}
 
-	if _, ok := dataToPublish[ostore.pubId]; !ok {
-		dataToPublish[ostore.pubId] = newRootCar()
+	err = ostore.store.Update(ctx, ostore.pubId, func(state *W3sPublishState, dag format.DAGService) error {
+		if state.Root == publishedRoot {
+			// the empty state is removed
+			*state = W3sPublishState{}
+		}
+		return nil
+	})
+	if err != nil {
+		// the upload is done, the publication expires with its TTL
+		log.Printf("error removing the published files of %s: %s", ostore.pubId, err)
 	}
-	return dataToPublish[ostore.pubId]
+	return fmt.Sprintf("ipfs://%s", rootCid), nil
 }
 
-func (ostore *W3sOS) deleteRootCar() {
-	dataToPublishMu.Lock()
-	defer dataToPublishMu.Unlock()
-
-	delete(dataToPublish, ostore.pubId)
+// Abort removes the files saved with the pubId from the publish store, so that
+// they are not published. The CARs already stored in web3.storage are kept.
+func (ostore *W3sOS) Abort(ctx context.Context) error {
+	return ostore.store.Abort(ctx, ostore.pubId)
 }
 
 func newDir() *merkledag.ProtoNode {
@@ -301,88 +667,153 @@ func newDir() *merkledag.ProtoNode {
 	return n
 }
 
-func toFile(data io.Reader) (string, error) {
-	fRaw, err := os.CreateTemp("", "w3s-raw")
+// ipfsCarPack chunks the data into a UnixFS file, with the CIDv1, raw leaves,
+// chunk size and layout of ipfs-car so that the file CID is the same. The
+// blocks are streamed into CARs of up to shardSize bytes of blocks, passed to
+// storeShard as they're filled, and the file CID and the CIDs of the CARs
+// returned. Like the shards of the w3up client, only the last CAR has the file
+// CID as root, since it's the last block built.
+func ipfsCarPack(ctx context.Context, data io.Reader, shardSize int, storeShard func(carData []byte) (string, error)) (string, []string, error) {
+	cw := &carBlockWriter{ctx: ctx, shardSize: shardSize, storeShard: storeShard, written: map[cid.Cid]bool{}}
+	dbp := helpers.DagBuilderParams{
+		Dagserv:    cw,
+		Maxlinks:   ipfsCarMaxLinks,
+		RawLeaves:  true,
+		CidBuilder: cidV1,
+	}
+	db, err := dbp.New(chunker.NewSizeSplitter(data, ipfsCarChunkSize))
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-
-	if _, err = io.Copy(fRaw, data); err != nil {
-		deleteFile(fRaw.Name())
-		return "", err
+	root, err := balanced.Layout(db)
+	if err != nil {
+		return "", nil, err
 	}
-
-	defer fRaw.Close()
-	return fRaw.Name(), nil
+	if err := cw.flush(root.Cid()); err != nil {
+		return "", nil, err
+	}
+	return root.Cid().String(), cw.carCids, nil
 }
 
-func deleteFile(filePath string) {
-	os.RemoveAll(filePath)
+// carBlockWriter is a DAG service writing the blocks added to CARs, once
+type carBlockWriter struct {
+	ctx        context.Context
+	shardSize  int
+	storeShard func(carData []byte) (string, error)
+	written    map[cid.Cid]bool
+	// blocks are the blocks of the CAR being filled
+	blocks  bytes.Buffer
+	carCids []string
 }
 
-// ipfsCarPack uses external binary 'ipfs-car' to convert a file into a CAR.
-func ipfsCarPack(ctx context.Context, filePath string) (string, string, error) {
-	fCar, err := os.CreateTemp("", "w3s-car")
-	if err != nil {
-		return "", "", err
+func (cw *carBlockWriter) Add(ctx context.Context, nd format.Node) error {
+	if err := cw.ctx.Err(); err != nil {
+		return err
 	}
+	if cw.written[nd.Cid()] {
+		return nil
+	}
+	cw.written[nd.Cid()] = true
+	size := util.LdSize(nd.Cid().Bytes(), nd.RawData())
+	if cw.blocks.Len() > 0 && uint64(cw.blocks.Len())+size > uint64(cw.shardSize) {
+		if err := cw.flush(); err != nil {
+			return err
+		}
+	}
+	return util.LdWrite(&cw.blocks, nd.Cid().Bytes(), nd.RawData())
+}
 
-	out, err := exec.CommandContext(ctx, "ipfs-car", "--wrapWithDirectory", "false", "--pack", filePath, "--output", fCar.Name()).CombinedOutput()
+// flush stores the CAR of the blocks written since the last one, with the roots
+func (cw *carBlockWriter) flush(roots ...cid.Cid) error {
+	if roots == nil {
+		roots = []cid.Cid{}
+	}
+	var carData bytes.Buffer
+	if err := car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, &carData); err != nil {
+		return err
+	}
+	carData.Grow(cw.blocks.Len())
+	cw.blocks.WriteTo(&carData)
+	carCid, err := cw.storeShard(carData.Bytes())
 	if err != nil {
-		deleteFile(fCar.Name())
-		return "", "", fmt.Errorf("executing 'ipfs-car' failed, command output: %s, err: %v", string(out), err)
+		return err
 	}
+	cw.carCids = append(cw.carCids, carCid)
+	return nil
+}
 
-	r := regexp.MustCompile(`root CID: ([A-Za-z0-9]+)`)
-	matches := r.FindStringSubmatch(string(out))
-	if len(matches) < 2 {
-		deleteFile(fCar.Name())
-		return "", "", fmt.Errorf("cannot find root file CID in the output: %s", string(out))
+func (cw *carBlockWriter) AddMany(ctx context.Context, nds []format.Node) error {
+	for _, nd := range nds {
+		if err := cw.Add(ctx, nd); err != nil {
+			return err
+		}
 	}
-	fileCid := matches[1]
+	return nil
+}
 
-	defer fCar.Close()
-	return fCar.Name(), fileCid, nil
+func (cw *carBlockWriter) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	return nil, format.ErrNotFound{Cid: c}
 }
 
-// w3StoreCar uses external binary `w3` to store a CAR file in web3.storage.
-func w3StoreCar(ctx context.Context, proof, carPath string) (string, error) {
-	out, err := runWithCredentials(exec.CommandContext(ctx, "livepeer-w3", "can", "store", "add", carPath), proof)
-	if err != nil {
-		return "", fmt.Errorf("executing 'livepeer-w3 can store add' failed, command output: %s, err: %v", string(out), err)
+func (cw *carBlockWriter) GetMany(ctx context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	out := make(chan *format.NodeOption, len(cids))
+	for _, c := range cids {
+		out <- &format.NodeOption{Err: format.ErrNotFound{Cid: c}}
 	}
-	return strings.TrimSpace(string(out)), nil
+	close(out)
+	return out
 }
 
-// w3StoreCar uses external binary `w3` to bind and publish multiple CARs.
-func w3UploadCar(ctx context.Context, proof, rootCid string, carCids []string) error {
-	args := []string{"can", "upload", "add"}
-	args = append(args, rootCid)
-	args = append(args, carCids...)
-	out, err := runWithCredentials(exec.CommandContext(ctx, "livepeer-w3", args...), proof)
-	if err != nil {
-		return fmt.Errorf("executing 'livepeer-w3 can store upload' failed, command output: %s, err: %v", string(out), err)
-	}
-	return nil
+func (cw *carBlockWriter) Remove(ctx context.Context, c cid.Cid) error {
+	return ErrNotSupported
+}
+
+func (cw *carBlockWriter) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	return ErrNotSupported
 }
 
-func runWithCredentials(cmd *exec.Cmd, proof string) ([]byte, error) {
-	if proof == "" {
+// w3upClient returns the client of the w3up service, as the principal of
+// W3_PRINCIPAL_KEY delegated the capabilities of a space by the UCAN proof.
+func (ostore *W3sOS) w3upClient() (*clients.W3upClient, error) {
+	if ostore.ucanProof == "" {
 		return nil, fmt.Errorf("UCAN proof not found")
 	}
-	base64Proof, err := base64UrlToBase64(proof)
+	proof, err := base64Url.DecodeString(ostore.ucanProof)
 	if err != nil {
 		return nil, fmt.Errorf("invalid UCAN proof format: %s", err)
 	}
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, fmt.Sprintf("W3_DELEGATION_PROOF='%s'", base64Proof))
-	return cmd.CombinedOutput()
+	principalKey, err := clients.ParseW3upPrincipalKey(os.Getenv("W3_PRINCIPAL_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	return clients.NewW3upClient(ostore.w3upURL, ostore.w3upDID, principalKey, proof)
 }
 
-func base64UrlToBase64(proof string) (string, error) {
-	ucanProofByte, err := base64Url.DecodeString(proof)
+// w3StoreCar stores a CAR in web3.storage, and returns its CID.
+func w3StoreCar(ctx context.Context, w3up *clients.W3upClient, carData []byte) (string, error) {
+	carCid, err := w3up.StoreAdd(ctx, bytes.NewReader(carData))
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("storing CAR in web3.storage failed: %w", err)
+	}
+	return carCid.String(), nil
+}
+
+// w3UploadCar binds and publishes multiple CARs as the upload of rootCid.
+func w3UploadCar(ctx context.Context, w3up *clients.W3upClient, rootCid string, carCids []string) error {
+	root, err := cid.Parse(rootCid)
+	if err != nil {
+		return err
+	}
+	shards := make([]cid.Cid, 0, len(carCids))
+	for _, carCid := range carCids {
+		shard, err := cid.Parse(carCid)
+		if err != nil {
+			return err
+		}
+		shards = append(shards, shard)
+	}
+	if err := w3up.UploadAdd(ctx, root, shards); err != nil {
+		return fmt.Errorf("uploading to web3.storage failed: %w", err)
 	}
-	return base64.StdEncoding.EncodeToString(ucanProofByte), nil
+	return nil
 }
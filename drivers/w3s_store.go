@@ -0,0 +1,259 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bserv "github.com/ipfs/go-blockservice"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// W3sDefaultPublishTTL is the TTL of the publications of the default store
+const W3sDefaultPublishTTL = 24 * time.Hour
+
+// w3sSweepInterval is the maximum interval of the removal of the expired
+// publications
+const w3sSweepInterval = time.Minute
+
+var (
+	w3sStatePrefix  = ds.NewKey("/w3s/state")
+	w3sBlocksPrefix = ds.NewKey("/w3s/blocks")
+)
+
+// w3sPublishStore is the store of the W3s drivers created after it's set
+var w3sPublishStore = NewW3sMemoryPublishStore(W3sDefaultPublishTTL)
+
+// SetW3sPublishStore sets the store of the publications of the W3s drivers
+// created afterwards, an in-memory store with W3sDefaultPublishTTL by default.
+func SetW3sPublishStore(store W3sPublishStore) {
+	w3sPublishStore = store
+}
+
+// W3sPublishState is the state of the files saved with a pubId, until they're
+// published
+type W3sPublishState struct {
+	// Root is the CID of the directory of the files, empty until a file is saved
+	Root string `json:"root,omitempty"`
+	// CarCids are the CIDs of the CARs of the files stored in web3.storage
+	CarCids []string `json:"carCids,omitempty"`
+	// Expires is when the state is removed unless it's updated before
+	Expires time.Time `json:"expires"`
+}
+
+// W3sPublishStore keeps the state of the publications of the W3s drivers, and
+// the blocks of their directories, until they're published or aborted. The
+// publications are removed once their TTL expires since they were last updated.
+type W3sPublishStore interface {
+	// Update calls fn with the state of the pubId, an empty one if there's
+	// none, and saves it if fn returns no error. The state and the blocks are
+	// removed like with Abort when fn leaves the state empty. The DAG holds the
+	// blocks of the directory of the pubId.
+	Update(ctx context.Context, pubId string, fn func(state *W3sPublishState, dag format.DAGService) error) error
+	// Abort removes the state and the blocks of the pubId
+	Abort(ctx context.Context, pubId string) error
+	Close() error
+}
+
+// W3sPublishViewer is optionally implemented by the stores reading the
+// publications without saving them. The files of the other stores are read
+// with Update, with the state discarded.
+type W3sPublishViewer interface {
+	// View calls fn with the state of the pubId like Update, without saving it
+	View(ctx context.Context, pubId string, fn func(state *W3sPublishState, dag format.DAGService) error) error
+}
+
+// errW3sViewed discards the state read with Update by stores that aren't a
+// W3sPublishViewer
+var errW3sViewed = errors.New("publication viewed")
+
+// viewW3sPublication calls fn with the state of the pubId in the store,
+// without saving it
+func viewW3sPublication(ctx context.Context, store W3sPublishStore, pubId string, fn func(state *W3sPublishState, dag format.DAGService) error) error {
+	if viewer, ok := store.(W3sPublishViewer); ok {
+		return viewer.View(ctx, pubId, fn)
+	}
+	err := store.Update(ctx, pubId, func(state *W3sPublishState, dag format.DAGService) error {
+		if err := fn(state, dag); err != nil {
+			return err
+		}
+		return errW3sViewed
+	})
+	if err == errW3sViewed {
+		return nil
+	}
+	return err
+}
+
+type datastorePublishStore struct {
+	ds        ds.Batching
+	ttl       time.Duration
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewW3sMemoryPublishStore creates a store keeping the publications in memory
+func NewW3sMemoryPublishStore(ttl time.Duration) W3sPublishStore {
+	return &datastorePublishStore{ds: dssync.MutexWrap(ds.NewMapDatastore()), ttl: ttl}
+}
+
+// NewW3sDiskPublishStore creates a store keeping the publications in a
+// LevelDB database in dirPath, so that they can be published after a restart
+func NewW3sDiskPublishStore(dirPath string, ttl time.Duration) (W3sPublishStore, error) {
+	d, err := leveldb.NewDatastore(dirPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &datastorePublishStore{ds: d, ttl: ttl}, nil
+}
+
+func (s *datastorePublishStore) Update(ctx context.Context, pubId string, fn func(state *W3sPublishState, dag format.DAGService) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.sweep(ctx); err != nil {
+		return err
+	}
+	state, err := s.get(ctx, pubId)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &W3sPublishState{}
+	}
+	if err := fn(state, s.dag(pubId)); err != nil {
+		return err
+	}
+	if state.Root == "" && len(state.CarCids) == 0 {
+		return s.abort(ctx, pubId)
+	}
+	state.Expires = time.Now().Add(s.ttl)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.ds.Put(ctx, w3sStateKey(pubId), data)
+}
+
+func (s *datastorePublishStore) View(ctx context.Context, pubId string, fn func(state *W3sPublishState, dag format.DAGService) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, err := s.get(ctx, pubId)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &W3sPublishState{}
+	}
+	return fn(state, s.dag(pubId))
+}
+
+func (s *datastorePublishStore) Abort(ctx context.Context, pubId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.abort(ctx, pubId)
+}
+
+func (s *datastorePublishStore) Close() error {
+	return s.ds.Close()
+}
+
+// get returns the state of the pubId, or nil if there's none or it expired
+func (s *datastorePublishStore) get(ctx context.Context, pubId string) (*W3sPublishState, error) {
+	data, err := s.ds.Get(ctx, w3sStateKey(pubId))
+	if err == ds.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state *W3sPublishState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state of pubId %s: %w", pubId, err)
+	}
+	if time.Now().After(state.Expires) {
+		return nil, s.abort(ctx, pubId)
+	}
+	return state, nil
+}
+
+func (s *datastorePublishStore) dag(pubId string) format.DAGService {
+	blocks := namespace.Wrap(s.ds, w3sBlocksPrefix.Child(ds.NewKey(base64Url.EncodeToString([]byte(pubId)))))
+	return merkledag.NewDAGService(bserv.New(blockstore.NewBlockstore(blocks), nil))
+}
+
+func (s *datastorePublishStore) abort(ctx context.Context, pubId string) error {
+	prefix := w3sBlocksPrefix.Child(ds.NewKey(base64Url.EncodeToString([]byte(pubId))))
+	res, err := s.ds.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	batch, err := s.ds.Batch(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := batch.Delete(ctx, ds.NewKey(e.Key)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Delete(ctx, w3sStateKey(pubId)); err != nil {
+		return err
+	}
+	return batch.Commit(ctx)
+}
+
+// sweep removes the expired publications, at most once by w3sSweepInterval or
+// by TTL when it's shorter
+func (s *datastorePublishStore) sweep(ctx context.Context) error {
+	interval := w3sSweepInterval
+	if s.ttl < interval {
+		interval = s.ttl
+	}
+	if time.Since(s.lastSweep) < interval {
+		return nil
+	}
+	s.lastSweep = time.Now()
+
+	res, err := s.ds.Query(ctx, query.Query{Prefix: w3sStatePrefix.String()})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		pubId, err := base64Url.DecodeString(ds.RawKey(e.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+		var state *W3sPublishState
+		if err := json.Unmarshal(e.Value, &state); err == nil && !time.Now().After(state.Expires) {
+			continue
+		}
+		if err := s.abort(ctx, string(pubId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func w3sStateKey(pubId string) ds.Key {
+	return w3sStatePrefix.ChildString(base64Url.EncodeToString([]byte(pubId)))
+}
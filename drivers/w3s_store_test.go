@@ -0,0 +1,220 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ipfs/go-datastore/query"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/require"
+)
+
+func TestW3sPublishStoreResume(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	w3up, proof := startFakeW3up(t)
+	dir := t.TempDir()
+	pubId := uuid.New().String()
+
+	store, err := NewW3sDiskPublishStore(dir, time.Hour)
+	require.NoError(err)
+	out, err := w3up.newDriver(proof, "/video/hls", pubId, store).NewSession("").SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.NoError(store.Close())
+
+	// the publication is resumed after a restart
+	store, err = NewW3sDiskPublishStore(dir, time.Hour)
+	require.NoError(err)
+	defer store.Close()
+	driver := w3up.newDriver(proof, "", pubId, store)
+	out2, err := driver.NewSession("").SaveData(ctx, "index.m3u8", strings.NewReader("#EXTM3U"), nil, 0)
+	require.NoError(err)
+	u, err := driver.Publish(ctx)
+	require.NoError(err)
+	shards := w3up.uploads[strings.TrimPrefix(u, "ipfs://")]
+	require.Len(shards, 3)
+	require.Equal([]string{out.CarCID, out2.CarCID}, shards[:2])
+
+	// the publication is removed once published
+	err = store.Update(ctx, pubId, func(state *W3sPublishState, dag format.DAGService) error {
+		require.Empty(state.Root)
+		require.Empty(state.CarCids)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestW3sPublishStoreExpiry(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	w3up, proof := startFakeW3up(t)
+	store := NewW3sMemoryPublishStore(50 * time.Millisecond)
+	pubId := uuid.New().String()
+	driver := w3up.newDriver(proof, "", pubId, store)
+
+	_, err := driver.NewSession("").SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	ds := store.(*datastorePublishStore).ds
+	keys, err := dsKeys(ctx, store)
+	require.NoError(err)
+	require.NotEmpty(keys)
+
+	// the expired publications of other pubIds are removed with the blocks
+	time.Sleep(100 * time.Millisecond)
+	_, err = w3up.newDriver(proof, "", uuid.New().String(), store).NewSession("").SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	has, err := ds.Has(ctx, w3sStateKey(pubId))
+	require.NoError(err)
+	require.False(has)
+	newKeys, err := dsKeys(ctx, store)
+	require.NoError(err)
+	require.Len(newKeys, len(keys))
+	for _, key := range newKeys {
+		require.NotContains(key, base64Url.EncodeToString([]byte(pubId)))
+	}
+
+	// expired publications are restarted
+	time.Sleep(100 * time.Millisecond)
+	out, err := driver.NewSession("").SaveData(ctx, "2.ts", strings.NewReader("segment 2"), nil, 0)
+	require.NoError(err)
+	u, err := driver.Publish(ctx)
+	require.NoError(err)
+	shards := w3up.uploads[strings.TrimPrefix(u, "ipfs://")]
+	require.Len(shards, 2)
+	require.Equal(out.CarCID, shards[0])
+}
+
+func TestW3sPublishStoreAbort(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	w3up, proof := startFakeW3up(t)
+	store := NewW3sMemoryPublishStore(time.Hour)
+	pubId := uuid.New().String()
+	driver := w3up.newDriver(proof, "/video", pubId, store)
+
+	_, err := driver.NewSession("").SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.NoError(driver.Abort(ctx))
+	keys, err := dsKeys(ctx, store)
+	require.NoError(err)
+	require.Empty(keys)
+
+	// the aborted files aren't published
+	out, err := driver.NewSession("").SaveData(ctx, "2.ts", strings.NewReader("segment 2"), nil, 0)
+	require.NoError(err)
+	u, err := driver.Publish(ctx)
+	require.NoError(err)
+	require.Equal([]string{out.CarCID}, w3up.uploads[strings.TrimPrefix(u, "ipfs://")][:1])
+	require.Len(w3up.uploads[strings.TrimPrefix(u, "ipfs://")], 2)
+	require.NoError(driver.Abort(ctx))
+}
+
+// interleavedStore calls before ahead of the update number n of the store
+type interleavedStore struct {
+	W3sPublishStore
+	updates int
+	n       int
+	before  func() error
+}
+
+func (s *interleavedStore) Update(ctx context.Context, pubId string, fn func(state *W3sPublishState, dag format.DAGService) error) error {
+	s.updates++
+	if s.updates == s.n {
+		if err := s.before(); err != nil {
+			return err
+		}
+	}
+	return s.W3sPublishStore.Update(ctx, pubId, fn)
+}
+
+func TestW3sPublishInterleaved(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	w3up, proof := startFakeW3up(t)
+	store := NewW3sMemoryPublishStore(time.Hour)
+	pubId := uuid.New().String()
+	_, err := w3up.newDriver(proof, "", pubId, store).NewSession("").SaveData(ctx, "1.ts", strings.NewReader("segment 1"), nil, 0)
+	require.NoError(err)
+
+	// the files saved while publishing are kept for the next publish
+	var out *SaveDataOutput
+	interleaved := &interleavedStore{W3sPublishStore: store, n: 2, before: func() (err error) {
+		out, err = w3up.newDriver(proof, "", pubId, store).NewSession("").SaveData(ctx, "2.ts", strings.NewReader("segment 2"), nil, 0)
+		return err
+	}}
+	_, err = w3up.newDriver(proof, "", pubId, interleaved).Publish(ctx)
+	require.NoError(err)
+	pi, err := w3up.newDriver(proof, "", pubId, store).NewSession("").ListFiles(ctx, "", "")
+	require.NoError(err)
+	require.Len(pi.Files(), 2)
+	u, err := w3up.newDriver(proof, "", pubId, store).Publish(ctx)
+	require.NoError(err)
+	require.Contains(w3up.uploads[strings.TrimPrefix(u, "ipfs://")], out.CarCID)
+	keys, err := dsKeys(ctx, store)
+	require.NoError(err)
+	require.Empty(keys)
+
+	// the publish succeeds when the published files can't be removed
+	_, err = w3up.newDriver(proof, "", pubId, store).NewSession("").SaveData(ctx, "3.ts", strings.NewReader("segment 3"), nil, 0)
+	require.NoError(err)
+	failing := &interleavedStore{W3sPublishStore: store, n: 2, before: func() error {
+		return errors.New("store unavailable")
+	}}
+	u, err = w3up.newDriver(proof, "", pubId, failing).Publish(ctx)
+	require.NoError(err)
+	require.NotEmpty(w3up.uploads[strings.TrimPrefix(u, "ipfs://")])
+}
+
+// updateOnlyStore is a store that isn't a W3sPublishViewer
+type updateOnlyStore struct {
+	W3sPublishStore
+}
+
+func TestW3sPublishStoreUpdateOnly(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	w3up, proof := startFakeW3up(t)
+	store := NewW3sMemoryPublishStore(time.Hour)
+	pubId := uuid.New().String()
+	sess := w3up.newDriver(proof, "/video", pubId, updateOnlyStore{store}).NewSession("")
+
+	// the publications aren't created by the reads
+	pi, err := sess.ListFiles(ctx, "", "")
+	require.NoError(err)
+	require.Empty(pi.Files())
+	keys, err := dsKeys(ctx, store)
+	require.NoError(err)
+	require.Empty(keys)
+
+	out, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	pi, err = sess.ListFiles(ctx, "", "")
+	require.NoError(err)
+	require.Len(pi.Files(), 1)
+	require.Equal(out.URL, pi.Files()[0].ETag)
+	fi, err := sess.ReadData(ctx, "1.ts")
+	require.NoError(err)
+	fi.Body.Close()
+	require.Equal(out.URL, fi.ETag)
+}
+
+// dsKeys returns the keys of the datastore of the store
+func dsKeys(ctx context.Context, store W3sPublishStore) ([]string, error) {
+	res, err := store.(*datastorePublishStore).ds.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	return keys, nil
+}
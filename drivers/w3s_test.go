@@ -1,18 +1,40 @@
 package drivers
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	blocks "github.com/ipfs/go-block-format"
+	bserv "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	unixfsio "github.com/ipfs/go-unixfs/io"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"github.com/livepeer/go-tools/clients"
+	"github.com/multiformats/go-multihash"
 	require2 "github.com/stretchr/testify/require"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
-	"os/exec"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testFile struct {
@@ -30,17 +52,6 @@ func TestW3sOS(t *testing.T) {
 		fmt.Println("No w3s credentials, test skipped")
 		return
 	}
-	_, err := exec.LookPath("w3")
-	if err != nil {
-		fmt.Println("No w3 installed, test skipped")
-		return
-	}
-	_, err = exec.LookPath("ipfs-car")
-	if err != nil {
-		fmt.Println("No ipfs-car installed, test skipped")
-		return
-	}
-
 	pubId := uuid.New().String()
 	testFiles := []testFile{
 		{dirPath: "/foo/video/hls/", name: randFilename(), data: randFiledata()},
@@ -53,7 +64,7 @@ func TestW3sOS(t *testing.T) {
 	// add a number of files in different locations
 	for _, tf := range testFiles {
 		sess := NewW3sDriver(w3sUcanProof, tf.dirPath, pubId).NewSession("").(*W3sSession)
-		_, err = sess.SaveData(context.TODO(), tf.name, bytes.NewReader(tf.data), nil, 0)
+		_, err := sess.SaveData(context.TODO(), tf.name, bytes.NewReader(tf.data), nil, 0)
 		require.NoError(err)
 	}
 
@@ -83,6 +94,514 @@ func TestW3sOS(t *testing.T) {
 	}
 }
 
+// fakeW3up is a stand-in of the w3up service, verifying the invocations and
+// their delegation
+type fakeW3up struct {
+	t       *testing.T
+	url     string
+	space   string
+	lock    sync.Mutex
+	stored  map[string][]byte
+	uploads map[string][]string
+	fail    bool
+	// blocks are the blocks of the stored CARs served by the gateway, altered
+	// when tamper is set
+	blocks map[cid.Cid][]byte
+	tamper bool
+}
+
+func (f *fakeW3up) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	require := require2.New(f.t)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/ipfs/") {
+		f.serveGateway(w, r)
+		return
+	}
+	if r.Method == http.MethodPut {
+		data, err := io.ReadAll(r.Body)
+		require.NoError(err)
+		require.Equal("test", r.Header.Get("X-Upload"))
+		link := strings.TrimPrefix(r.URL.Path, "/put/")
+		c, err := cid.Prefix{Version: 1, Codec: 0x0202, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+		require.NoError(err)
+		require.Equal(link, c.String())
+		f.stored[link] = data
+		for c, data := range readCarBlocks(f.t, data) {
+			f.blocks[c] = data
+		}
+		return
+	}
+	require.Equal(http.MethodPost, r.Method)
+	require.Equal("application/car", r.Header.Get("Content-Type"))
+	cr, err := car.NewCarReader(r.Body)
+	require.NoError(err)
+	blocks := map[cid.Cid][]byte{}
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+		blocks[b.Cid()] = b.RawData()
+	}
+	invocation, err := clients.ParseUCAN(cr.Header.Roots[0], blocks[cr.Header.Roots[0]])
+	require.NoError(err)
+	require.NoError(invocation.Verify())
+	require.Equal(clients.W3upServiceDID, invocation.Audience)
+	require.Greater(invocation.Expiration, time.Now().Unix())
+	require.Len(invocation.Proofs, 1)
+	delegation, err := clients.ParseUCAN(invocation.Proofs[0], blocks[invocation.Proofs[0]])
+	require.NoError(err)
+	require.NoError(delegation.Verify())
+	require.Equal(f.space, delegation.Issuer)
+	require.Equal(invocation.Issuer, delegation.Audience)
+	require.Len(invocation.Capabilities, 1)
+	capability := invocation.Capabilities[0]
+	require.Equal(f.space, capability.With)
+
+	var result interface{}
+	switch {
+	case f.fail:
+		result = map[string]interface{}{"error": true, "name": "InsufficientStorage", "message": "no storage provider"}
+	case capability.Can == "store/add":
+		link := capability.Nb["link"].(cid.Cid).String()
+		result = map[string]interface{}{"status": "upload", "url": f.url + "/put/" + link, "headers": map[string]string{"X-Upload": "test"}}
+	case capability.Can == "upload/add":
+		root := capability.Nb["root"].(cid.Cid)
+		var shards []string
+		for _, shard := range capability.Nb["shards"].([]interface{}) {
+			shards = append(shards, shard.(cid.Cid).String())
+		}
+		f.uploads[root.String()] = shards
+		result = map[string]interface{}{"ok": map[string]interface{}{"root": root}}
+	default:
+		require.Fail("unexpected capability " + capability.Can)
+	}
+	data, err := cbornode.DumpObject([]interface{}{result})
+	require.NoError(err)
+	w.Write(data)
+}
+
+// serveGateway serves the files of the stored CARs, or the CARs of their DAGs
+// with format=car
+func (f *fakeW3up) serveGateway(w http.ResponseWriter, r *http.Request) {
+	require := require2.New(f.t)
+	ctx := r.Context()
+	fileCid, err := cid.Decode(strings.TrimPrefix(r.URL.Path, "/ipfs/"))
+	require.NoError(err)
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	for c, data := range f.blocks {
+		if f.tamper && c.Type() == cid.Raw {
+			data = append([]byte("tampered "), data...)
+		}
+		b, err := blocks.NewBlockWithCid(data, c)
+		require.NoError(err)
+		require.NoError(bs.Put(ctx, b))
+	}
+	dag := merkledag.NewDAGService(bserv.New(bs, nil))
+	if r.URL.Query().Get("format") == "car" {
+		require.Equal("application/vnd.ipld.car; version=1; order=dfs; dups=y", r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+		require.NoError(car.WriteCar(ctx, dag, []cid.Cid{fileCid}, w))
+		return
+	}
+	n, err := dag.Get(ctx, fileCid)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	dr, err := unixfsio.NewDagReader(ctx, n, dag)
+	require.NoError(err)
+	w.Header().Set("Etag", `"`+fileCid.String()+`"`)
+	http.ServeContent(w, r, "", time.Time{}, dr)
+}
+
+// delegationProof returns the base64url CAR of the UCAN delegating the
+// capabilities of the space to the principal
+func delegationProof(t *testing.T, space ed25519.PrivateKey, principal string) string {
+	require := require2.New(t)
+	u := &clients.UCAN{
+		Issuer:       clients.DIDKey(space.Public().(ed25519.PublicKey)),
+		Audience:     principal,
+		Capabilities: []clients.UCANCapability{{With: clients.DIDKey(space.Public().(ed25519.PublicKey)), Can: "*"}},
+		Expiration:   time.Now().Add(time.Hour).Unix(),
+	}
+	require.NoError(u.Sign(space))
+	c, data, err := u.Block()
+	require.NoError(err)
+	var buf bytes.Buffer
+	require.NoError(car.WriteHeader(&car.CarHeader{Roots: []cid.Cid{c}, Version: 1}, &buf))
+	require.NoError(util.LdWrite(&buf, c.Bytes(), data))
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// startFakeW3up starts a stand-in of the w3up service, and returns it with the
+// proof of a space delegated to the principal of W3_PRINCIPAL_KEY
+func startFakeW3up(t *testing.T) (*fakeW3up, string) {
+	_, space, _ := ed25519.GenerateKey(rand.Reader)
+	seed := make([]byte, ed25519.SeedSize)
+	rand.Read(seed)
+	t.Setenv("W3_PRINCIPAL_KEY", base64.StdEncoding.EncodeToString(seed))
+	principal := clients.DIDKey(ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey))
+
+	w3up := &fakeW3up{
+		t:       t,
+		space:   clients.DIDKey(space.Public().(ed25519.PublicKey)),
+		stored:  map[string][]byte{},
+		uploads: map[string][]string{},
+		blocks:  map[cid.Cid][]byte{},
+	}
+	server := httptest.NewServer(w3up)
+	t.Cleanup(server.Close)
+	w3up.url = server.URL
+	return w3up, delegationProof(t, space, principal)
+}
+
+// newDriver returns a W3s driver of the stand-in service, with the store
+func (f *fakeW3up) newDriver(proof, dirPath, pubId string, store W3sPublishStore) *W3sOS {
+	driver := NewW3sDriver(proof, dirPath, pubId)
+	driver.w3upURL = f.url
+	driver.gateway = f.url + "/ipfs/"
+	if store != nil {
+		driver.store = store
+	}
+	return driver
+}
+
+func TestW3sOSW3up(t *testing.T) {
+	require := require2.New(t)
+	ctx := context.Background()
+	w3up, proof := startFakeW3up(t)
+	newDriver := func(proof, dirPath, pubId string) *W3sOS {
+		return w3up.newDriver(proof, dirPath, pubId, nil)
+	}
+
+	pubId := uuid.New().String()
+	sess := newDriver(proof, "/video/hls/", pubId).NewSession("")
+	out, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	require.Equal(rawCid([]byte("segment")), out.URL)
+	require.Contains(w3up.stored, out.CarCID)
+	_, err = newDriver(proof, "", pubId).NewSession("").SaveData(ctx, "index.m3u8", strings.NewReader("#EXTM3U"), nil, 0)
+	require.NoError(err)
+
+	u, err := newDriver(proof, "", pubId).Publish(ctx)
+	require.NoError(err)
+	rootCid := strings.TrimPrefix(u, "ipfs://")
+	require.Contains(w3up.uploads, rootCid)
+	shards := w3up.uploads[rootCid]
+	require.Len(shards, 3)
+	require.Equal(out.CarCID, shards[0])
+	for _, shard := range shards {
+		require.Contains(w3up.stored, shard)
+	}
+
+	// the errors of the service are returned
+	w3up.fail = true
+	_, err = newDriver(proof, "", pubId).NewSession("").SaveData(ctx, "2.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "store/add failed: InsufficientStorage: no storage provider")
+	w3up.fail = false
+
+	// the proof must delegate to the principal
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	otherProof := delegationProof(t, other, clients.DIDKey(other.Public().(ed25519.PublicKey)))
+	_, err = newDriver(otherProof, "", pubId).NewSession("").SaveData(ctx, "2.ts", strings.NewReader("segment"), nil, 0)
+	require.ErrorContains(err, "not to the principal")
+	_, err = newDriver("", "", pubId).Publish(ctx)
+	require.ErrorContains(err, "UCAN proof not found")
+}
+
+func TestW3sOSReadList(t *testing.T) {
+	require := require2.New(t)
+	ctx := context.Background()
+	w3up, proof := startFakeW3up(t)
+	store := NewW3sMemoryPublishStore(time.Hour)
+	pubId := uuid.New().String()
+	driver := w3up.newDriver(proof, "/video/hls", pubId, store)
+	// the larger files are stored in multiple CARs
+	driver.shardSize = ipfsCarChunkSize + 1000
+	sess := driver.NewSession("")
+	big := make([]byte, 2*ipfsCarChunkSize+100)
+	rand.Read(big)
+	out, err := sess.SaveData(ctx, "1.ts", strings.NewReader("segment"), nil, 0)
+	require.NoError(err)
+	bigOut, err := sess.SaveData(ctx, "big.ts", bytes.NewReader(big), nil, 0)
+	require.NoError(err)
+	require.Len(w3up.stored, 3)
+	require.Contains(w3up.stored, bigOut.CarCID)
+	_, err = sess.SaveData(ctx, "source/1.ts", strings.NewReader("source segment"), nil, 0)
+	require.NoError(err)
+	rootSess := w3up.newDriver(proof, "", pubId, store).NewSession("")
+	_, err = rootSess.SaveData(ctx, "index.m3u8", strings.NewReader("#EXTM3U"), nil, 0)
+	require.NoError(err)
+
+	// the files are listed before they're published
+	names := func(pi PageInfo) []string {
+		var names []string
+		for _, f := range pi.Files() {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+	pi, err := rootSess.ListFiles(ctx, "", "/")
+	require.NoError(err)
+	require.Equal([]string{"index.m3u8"}, names(pi))
+	require.Equal([]string{"video/"}, pi.Directories())
+	pi, err = rootSess.ListFiles(ctx, "video/hls/", "/")
+	require.NoError(err)
+	require.Equal([]string{"video/hls/1.ts", "video/hls/big.ts"}, names(pi))
+	require.Equal(out.URL, pi.Files()[0].ETag)
+	require.Equal(int64(len("segment")), *pi.Files()[0].Size)
+	require.Equal(int64(len(big)), *pi.Files()[1].Size)
+	require.Equal([]string{"video/hls/source/"}, pi.Directories())
+	pi, err = sess.ListFiles(ctx, "", "")
+	require.NoError(err)
+	require.Equal([]string{"video/hls/1.ts", "video/hls/big.ts", "video/hls/source/1.ts"}, names(pi))
+	require.Empty(pi.Directories())
+	pi, err = rootSess.ListFiles(ctx, "video/hls/b", "")
+	require.NoError(err)
+	require.Equal([]string{"video/hls/big.ts"}, names(pi))
+	pi, err = rootSess.ListFiles(ctx, "audio/", "/")
+	require.NoError(err)
+	require.Empty(pi.Files())
+
+	// the files are read from the gateway, by name until they're published
+	read := func(sess OSSession, name, byteRange string) (*FileInfoReader, []byte, error) {
+		fi, err := sess.ReadDataRange(ctx, name, byteRange)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer fi.Body.Close()
+		data, err := io.ReadAll(fi.Body)
+		return fi, data, err
+	}
+	fi, data, err := read(sess, "1.ts", "")
+	require.NoError(err)
+	require.Equal("segment", string(data))
+	require.Equal(out.URL, fi.ETag)
+	fi, data, err = read(rootSess, "video/hls/big.ts", "bytes=524200-524299")
+	require.NoError(err)
+	require.Equal(big[524200:524300], data)
+	require.Equal(fmt.Sprintf("bytes 524200-524299/%d", len(big)), fi.ContentRange)
+	_, _, err = read(sess, "2.ts", "")
+	require.ErrorContains(err, "not found")
+	// the names are relative to the path of the session
+	_, _, err = read(sess, "video/hls/1.ts", "")
+	require.ErrorContains(err, "file video/hls/video/hls/1.ts not found")
+
+	verified := w3up.newDriver(proof, "", pubId, store)
+	verified.verify = true
+	fi, data, err = read(verified.NewSession(""), bigOut.URL, "")
+	require.NoError(err)
+	require.Equal(big, data)
+	require.Equal(int64(len(big)), *fi.Size)
+	fi, data, err = read(verified.NewSession(""), "video/hls/big.ts", "bytes=-100")
+	require.NoError(err)
+	require.Equal(big[len(big)-100:], data)
+	require.Equal(fmt.Sprintf("bytes %d-%d/%d", len(big)-100, len(big)-1, len(big)), fi.ContentRange)
+
+	// altered files are only detected with verification
+	w3up.tamper = true
+	_, data, err = read(sess, "1.ts", "")
+	require.NoError(err)
+	require.Equal("tampered segment", string(data))
+	_, _, err = read(verified.NewSession(""), out.URL, "")
+	require.ErrorContains(err, "mismatch in content integrity")
+	// the blocks of the larger files are verified while they're read
+	_, _, err = read(verified.NewSession(""), bigOut.URL, "bytes=0-9")
+	require.ErrorContains(err, "mismatch in content integrity")
+	w3up.tamper = false
+
+	u, err := rootSess.OS().Publish(ctx)
+	require.NoError(err)
+	// the upload has the CARs of the files and the one of the directory
+	shards := w3up.uploads[strings.TrimPrefix(u, "ipfs://")]
+	require.Len(shards, 6)
+	require.Equal(bigOut.CarCID, shards[2])
+	pi, err = rootSess.ListFiles(ctx, "", "")
+	require.NoError(err)
+	require.Empty(pi.Files())
+	_, data, err = read(sess, out.URL, "")
+	require.NoError(err)
+	require.Equal("segment", string(data))
+}
+
+// readCarBlocks returns the blocks of the CAR, checked against their CIDs. The
+// CARs of the shards with no root aren't read by car.NewCarReader.
+func readCarBlocks(t *testing.T, data []byte) map[cid.Cid][]byte {
+	require := require2.New(t)
+	br := bufio.NewReader(bytes.NewReader(data))
+	_, err := car.ReadHeader(br)
+	require.NoError(err)
+	res := map[cid.Cid][]byte{}
+	for {
+		c, data, err := util.ReadNode(br)
+		if err == io.EOF {
+			return res
+		}
+		require.NoError(err)
+		b, err := blocks.NewBlockWithCid(data, c)
+		require.NoError(err)
+		res[b.Cid()] = b.RawData()
+	}
+}
+
+// packCars packs the data with the shard size, and returns the file CID with
+// the CARs
+func packCars(ctx context.Context, data io.Reader, shardSize int) (string, [][]byte, error) {
+	var cars [][]byte
+	fileCid, carCids, err := ipfsCarPack(ctx, data, shardSize, func(carData []byte) (string, error) {
+		cars = append(cars, append([]byte(nil), carData...))
+		return fmt.Sprint(len(cars)), nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(carCids) != len(cars) || carCids[len(carCids)-1] != fmt.Sprint(len(cars)) {
+		return "", nil, fmt.Errorf("unexpected CAR CIDs %v", carCids)
+	}
+	return fileCid, cars, nil
+}
+
+// expectedFileCid returns the CID of the UnixFS file of the chunks laid out
+// like ipfs-car: a balanced tree of dag-pb nodes of up to ipfsCarMaxLinks
+// links above the raw leaves
+func expectedFileCid(t *testing.T, data []byte) string {
+	require := require2.New(t)
+	type node struct {
+		cid  cid.Cid
+		size uint64
+		// dataSize is the size of the data of the file under the node
+		dataSize uint64
+	}
+	var level []node
+	for off := 0; off < len(data); off += ipfsCarChunkSize {
+		end := off + ipfsCarChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaf, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(data[off:end])
+		require.NoError(err)
+		level = append(level, node{leaf, uint64(end - off), uint64(end - off)})
+	}
+	if len(level) == 1 {
+		return level[0].cid.String()
+	}
+	// the nodes of the levels are filled depth first, so the last subtrees are
+	// the ones not full
+	var build func(leaves []node, depth int) node
+	build = func(leaves []node, depth int) node {
+		if depth == 0 {
+			return leaves[0]
+		}
+		span := 1
+		for i := 1; i < depth; i++ {
+			span *= ipfsCarMaxLinks
+		}
+		fsn := unixfs.NewFSNode(unixfs.TFile)
+		n := merkledag.NodeWithData(nil)
+		require.NoError(n.SetCidBuilder(cidV1))
+		for off := 0; off < len(leaves); off += span {
+			end := off + span
+			if end > len(leaves) {
+				end = len(leaves)
+			}
+			child := build(leaves[off:end], depth-1)
+			require.NoError(n.AddRawLink("", &format.Link{Cid: child.cid, Size: child.size}))
+			fsn.AddBlockSize(child.dataSize)
+		}
+		fsData, err := fsn.GetBytes()
+		require.NoError(err)
+		n.SetData(fsData)
+		size, err := n.Size()
+		require.NoError(err)
+		return node{n.Cid(), size, fsn.FileSize()}
+	}
+	depth := 1
+	for span := ipfsCarMaxLinks; span < len(level); span *= ipfsCarMaxLinks {
+		depth++
+	}
+	return build(level, depth).cid.String()
+}
+
+func TestIpfsCarPack(t *testing.T) {
+	require := require2.New(t)
+	ctx := context.Background()
+
+	// single chunk files are raw blocks, as with ipfs-car
+	fileCid, cars, err := packCars(ctx, strings.NewReader("hello world"), w3sShardSize)
+	require.NoError(err)
+	require.Equal("bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e", fileCid)
+	require.Len(cars, 1)
+
+	// the files are laid out like ipfs-car, below and above ipfsCarMaxLinks
+	// chunks
+	for _, chunks := range []int{3, ipfsCarMaxLinks + 2} {
+		data := make([]byte, chunks*ipfsCarChunkSize+100)
+		rand.Read(data)
+		fileCid, cars, err := packCars(ctx, bytes.NewReader(data), w3sShardSize)
+		require.NoError(err)
+		require.Equal(expectedFileCid(t, data), fileCid)
+		require.Len(cars, 1)
+
+		cr, err := car.NewCarReader(bytes.NewReader(cars[0]))
+		require.NoError(err)
+		require.Equal([]cid.Cid{cid.MustParse(fileCid)}, cr.Header.Roots)
+		bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		for c, data := range readCarBlocks(t, cars[0]) {
+			block, err := blocks.NewBlockWithCid(data, c)
+			require.NoError(err)
+			require.NoError(bs.Put(ctx, block))
+		}
+		dag := merkledag.NewDAGService(bserv.New(bs, nil))
+		root, err := dag.Get(ctx, cr.Header.Roots[0])
+		require.NoError(err)
+		r, err := unixfsio.NewDagReader(ctx, root, dag)
+		require.NoError(err)
+		read, err := io.ReadAll(r)
+		require.NoError(err)
+		require.Equal(data, read)
+	}
+
+	// the blocks are split into CARs of up to the shard size, with the root in
+	// the last one
+	data := make([]byte, 10*ipfsCarChunkSize)
+	rand.Read(data)
+	shardSize := 3*ipfsCarChunkSize + 1000
+	fileCid, cars, err = packCars(ctx, bytes.NewReader(data), shardSize)
+	require.NoError(err)
+	require.Equal(expectedFileCid(t, data), fileCid)
+	require.Len(cars, 4)
+	blockCount := 0
+	for i, carData := range cars {
+		header, err := car.ReadHeader(bufio.NewReader(bytes.NewReader(carData)))
+		require.NoError(err)
+		headerSize, err := car.HeaderSize(header)
+		require.NoError(err)
+		require.LessOrEqual(len(carData)-int(headerSize), shardSize)
+		if i < len(cars)-1 {
+			require.Empty(header.Roots)
+		} else {
+			require.Equal([]cid.Cid{cid.MustParse(fileCid)}, header.Roots)
+		}
+		blockCount += len(readCarBlocks(t, carData))
+	}
+	// the leaves and the root
+	require.Equal(11, blockCount)
+
+	// the errors of the stores are returned
+	_, _, err = ipfsCarPack(ctx, bytes.NewReader(data), shardSize, func(carData []byte) (string, error) {
+		return "", errors.New("store failed")
+	})
+	require.EqualError(err, "store failed")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = packCars(ctx, bytes.NewReader(data), w3sShardSize)
+	require.ErrorIs(err, context.Canceled)
+}
+
 func randFilename() string {
 	return uuid.New().String() + ".ts"
 }
@@ -93,38 +612,3 @@ func randFiledata() []byte {
 	rand.Read(rndData)
 	return rndData
 }
-
-func TestBase64UrlToBase64(t *testing.T) {
-	require := require2.New(t)
-
-	tests := []struct {
-		name string
-		arg  string
-		exp  string
-	}{
-		{
-			name: "standard text",
-			arg:  "c29tZSB0ZXh0",
-			exp:  "c29tZSB0ZXh0",
-		},
-		{
-			name: "binary no padding",
-			arg:  "eSK_-HCmI596rRX4xY",
-			exp:  "eSK/+HCmI596rRX4xQ==",
-		},
-		{
-			name: "binary with padding",
-			arg:  "_-HCmI596rRX4xY",
-			exp:  "/+HCmI596rRX4xY=",
-		},
-	}
-
-	for _, tc := range tests {
-		tc := tc
-		t.Run(tc.name, func(t *testing.T) {
-			res, err := base64UrlToBase64(tc.arg)
-			require.NoError(err)
-			require.Equal(tc.exp, res)
-		})
-	}
-}